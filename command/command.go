@@ -1,35 +1,36 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"os/signal"
 	"os/user"
-	"path/filepath"
 	"reflect"
-	"sort"
 	"strings"
+	"syscall"
+	"time"
 
+	"github.com/Abc-Arbitrage/infix/engine"
 	"github.com/Abc-Arbitrage/infix/filter"
 	"github.com/Abc-Arbitrage/infix/logging"
 	"github.com/Abc-Arbitrage/infix/rules"
 	"github.com/Abc-Arbitrage/infix/storage"
 	"github.com/Abc-Arbitrage/infix/utils/bytesize"
 
-	"github.com/golang/snappy"
-	"github.com/influxdata/influxdb/tsdb"
-	"github.com/influxdata/influxdb/tsdb/engine/tsm1"
+	"github.com/influxdata/influxql"
 
 	"github.com/schollz/progressbar/v3"
 )
 
 var (
-	defaultCacheMaxMemorySize      = bytesize.ByteSize(tsdb.DefaultCacheMaxMemorySize)
-	defaultCacheSnapshotMemorySize = bytesize.ByteSize(tsdb.DefaultCacheSnapshotMemorySize)
+	defaultCacheMaxMemorySize      = bytesize.ByteSize(engine.DefaultMaxCacheSize)
+	defaultCacheSnapshotMemorySize = bytesize.ByteSize(engine.DefaultCacheSnapshotSize)
+	defaultCompactThroughput       = bytesize.ByteSize(engine.DefaultCompactThroughput)
 )
 
 // Command represents the program execution for "influxd dumptsm".
@@ -41,21 +42,56 @@ type Command struct {
 	config          string
 	dataDir         string
 	walDir          string
+	engineDir       string
+	boltPath        string
+	outDataDir      string
+	outWALDir       string
+	backupDir       string
+	outBackupDir    string
+	metaDir         string
 	database        string
 	retentionPolicy string
 	shardFilter     string
 
+	start             string
+	end               string
+	retentionDuration string
+	mergeDuration     string
+
+	moveMeasurements      string
+	moveToDatabase        string
+	moveToRetentionPolicy string
+	copyMeasurements      bool
+
+	timeRange          storage.TimeRange
+	rpDuration         *time.Duration
+	shardGroupDuration time.Duration
+
 	maxCacheSize      bytesize.Flag
 	cacheSnapshotSize bytesize.Flag
 
+	compact                bool
+	flushWAL               bool
+	compactThroughput      bytesize.Flag
+	compactThroughputBurst bytesize.Flag
+
 	listRules bool
 	verbose   bool
 	check     bool
+	repairWAL bool
 
-	shards []storage.ShardInfo
+	rebuildFieldsIndex bool
 
-	filter filter.Filter
-	rules  []rules.Rule
+	yes               bool
+	preserveOwnership bool
+	ignoreRunning     bool
+	ignoreDiskSpace   bool
+	pidFile           string
+
+	rules []rules.Rule
+
+	progress     *progressbar.ProgressBar
+	progressPath string
 }
 
 // NewCommand returns a new instace of Command
@@ -63,42 +99,53 @@ func NewCommand() *Command {
 	return &Command{
 		Stderr: os.Stderr,
 		Stdout: os.Stdout,
-		filter: &filter.AlwaysFalseFilter{},
-	}
-}
-
-// NewCommandWithRules returns a new instance of Command.
-func NewCommandWithRules(rs rules.Set) *Command {
-	return &Command{
-		Stderr: os.Stderr,
-		Stdout: os.Stdout,
-		rules:  rs.Rules(),
-		filter: &filter.AlwaysFalseFilter{},
 	}
 }
 
-// GlobalFilter sets the filter to apply globaly for all rules
-func (cmd *Command) GlobalFilter(filter filter.Filter) {
-	cmd.filter = filter
-}
-
 // Run executes the command.
 func (cmd *Command) Run(args ...string) error {
 	cmd.maxCacheSize.Default(defaultCacheMaxMemorySize)
 	cmd.cacheSnapshotSize.Default(defaultCacheSnapshotMemorySize)
+	cmd.compactThroughput.Default(defaultCompactThroughput)
 
 	fs := flag.NewFlagSet("file", flag.ExitOnError)
 	fs.StringVar(&cmd.dataDir, "datadir", "/var/lib/influxdb/data", "Path to data storage")
 	fs.StringVar(&cmd.walDir, "waldir", "/var/lib/influxdb/wal", "Path to WAL storage")
+	fs.StringVar(&cmd.engineDir, "enginedir", "", "Path to InfluxDB 2.x engine storage")
+	fs.StringVar(&cmd.boltPath, "bolt-path", "", "Path to InfluxDB 2.x bolt metadata store")
+	fs.StringVar(&cmd.outDataDir, "outdir", "", "Path to write data to instead of changing -datadir")
+	fs.StringVar(&cmd.outWALDir, "outwaldir", "", "Path to write WAL to instead of changing -waldir")
+	fs.StringVar(&cmd.backupDir, "backup", "", "Path to a portable backup to process instead of -datadir and -waldir")
+	fs.StringVar(&cmd.outBackupDir, "outbackup", "", "Path to write the processed portable backup to")
 	fs.StringVar(&cmd.database, "database", "", "The database to enforce")
 	fs.StringVar(&cmd.retentionPolicy, "retention", "", "The retention policy to enforce")
 	fs.StringVar(&cmd.shardFilter, "shard", "", "The id of the shard to fix")
+	fs.StringVar(&cmd.metaDir, "metadir", "", "Path to meta storage to read shard information from")
+	fs.StringVar(&cmd.start, "start", "", "Only fix shards with data after this time (RFC3339)")
+	fs.StringVar(&cmd.end, "end", "", "Only fix shards with data before this time (RFC3339)")
+	fs.StringVar(&cmd.retentionDuration, "retention-duration", "", "Only fix shards of retention policies with this duration")
+	fs.StringVar(&cmd.mergeDuration, "merge-shard-group-duration", "", "Merge shards into shard groups of this duration")
+	fs.StringVar(&cmd.moveMeasurements, "move-measurement", "", "Comma-separated measurements to move to -to-database and -to-retention")
+	fs.StringVar(&cmd.moveToDatabase, "to-database", "", "The database to move measurements to")
+	fs.StringVar(&cmd.moveToRetentionPolicy, "to-retention", "", "The retention policy to move measurements to")
+	fs.BoolVar(&cmd.copyMeasurements, "copy", false, "Copy measurements instead of moving them")
 	fs.Var(&cmd.maxCacheSize, "max-cache-size", "The maximum in-memory cache size")
 	fs.Var(&cmd.cacheSnapshotSize, "cache-snapshot-size", "The size after which the cache will be snapshotted to disk when re-writing TSM files.")
+	fs.BoolVar(&cmd.flushWAL, "flush-wal", false, "Flush WAL segments into TSM files before applying rules, if any")
+	fs.BoolVar(&cmd.compact, "compact", false, "Fully compact TSM files instead of applying rules")
+	fs.Var(&cmd.compactThroughput, "compact-throughput", "The rate limit in bytes per second of compactions")
+	fs.Var(&cmd.compactThroughputBurst, "compact-throughput-burst", "The rate limit burst in bytes of compactions")
 	fs.StringVar(&cmd.config, "config", "", "The configuration file for rules")
 	fs.BoolVar(&cmd.listRules, "list-rules", false, "Print a list of registered rules with sample config and exit")
 	fs.BoolVar(&cmd.verbose, "v", false, "Enable verbose logging")
 	fs.BoolVar(&cmd.check, "check", false, "Run in check mode")
+	fs.BoolVar(&cmd.repairWAL, "repair-wal", false, "Salvage readable entries past corruption points in WAL files")
+	fs.BoolVar(&cmd.rebuildFieldsIndex, "rebuild-field-index", false, "Rebuild fields.idx files from TSM and WAL files")
+	fs.BoolVar(&cmd.yes, "yes", false, "Do not ask for confirmation")
+	fs.BoolVar(&cmd.preserveOwnership, "preserve-ownership", false, "Restore the owner, group and mode of rewritten files")
+	fs.BoolVar(&cmd.ignoreRunning, "ignore-running", false, "Do not check that influxd is stopped")
+	fs.StringVar(&cmd.pidFile, "pidfile", "", "Path to the PID file of influxd")
+	fs.BoolVar(&cmd.ignoreDiskSpace, "ignore-disk-space", false, "Only warn when free disk space may be insufficient")
 
 	fs.SetOutput(cmd.Stdout)
 	fs.Usage = cmd.printUsage
@@ -124,465 +171,383 @@ func (cmd *Command) Run(args ...string) error {
 		return err
 	}
 
-	if err := checkRoot(); err != nil {
+	opts := cmd.options()
+	if err := opts.Validate(); err != nil {
 		return err
 	}
 
-	f, err := os.Open(cmd.config)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-
-	rs, err := rules.LoadConfig(cmd.config)
-	if err != nil {
-		return err
-	}
-
-	for _, r := range rs {
-		cmd.rules = append(cmd.rules, r)
-	}
-
-	shards, err := storage.LoadShards(cmd.dataDir, cmd.walDir, cmd.database, cmd.retentionPolicy, cmd.shardFilter)
-	if err != nil {
+	if err := cmd.checkRoot(); err != nil {
 		return err
 	}
 
-	return cmd.process(shards)
-}
-
-// printUsage prints the usage message to STDERR.
-func (cmd *Command) printUsage() {
-	usage := `Apply rules to TSM and WAL files.
-
-Usage: infix [options]
-
-    -datadir
-        Path to data storage (defaults to /var/lib/influxdb/data)
-    -waldir
-        Path to wal storage (defaults to /var/lib/influxdb/wal)
-    -database
-        The database to fix
-    -retention
-        The retention policy to fix
-    -shard
-        The id of the shard to fix
-    -max-cache-size
-        The maximum in-memory cache size in bytes (defaults to %s)
-    -cache-snapshot-size
-        The size in bytes after which the cache will be snapshotted to disk when re-writing TSM files (defaults to %s)
-    -list-rules
-        Print a list of registered rules with sample config and exit
-    -v
-        Enable verbose logging
-    -check
-        Run in check mode (do not apply any change)
-    -config
-        The configuration file
-`
-
-	fmt.Fprintf(cmd.Stdout, fmt.Sprintf(usage, defaultCacheMaxMemorySize.HumanString(), defaultCacheSnapshotMemorySize.HumanString()))
-}
-
-func (cmd *Command) process(shards []storage.ShardInfo) error {
-	for _, r := range cmd.rules {
-		log.Printf("Running rule %s", reflect.TypeOf(r))
-		r.CheckMode(cmd.check)
-		r.Start()
-	}
-
-	for _, sh := range shards {
-		if err := cmd.processShard(sh); err != nil {
+	if cmd.config != "" {
+		rs, err := rules.LoadConfig(cmd.config)
+		if err != nil {
 			return err
 		}
-	}
 
-	for _, r := range cmd.rules {
-		r.End()
+		for _, r := range rs {
+			cmd.rules = append(cmd.rules, r)
+		}
 	}
 
-	logging.Flush(cmd.Stdout)
-
-	return nil
-}
-
-func (cmd *Command) processShard(info storage.ShardInfo) error {
-	fmt.Fprintf(cmd.Stdout, "Enforcing shard %d...\n", info.ID)
-
-	for _, r := range cmd.rules {
-		r.StartShard(info)
+	if cmd.check {
+		cmd.printRules()
 	}
 
-	// we need to make sure we write the same order that the wal received the data
-	tsmFiles := info.TsmFiles
-	sort.Strings(tsmFiles)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	log.Printf("shard %d: enforcing %d tsm file(s)", info.ID, len(tsmFiles))
+	stop := cmd.handleSignals(cancel)
+	defer stop()
 
-	for _, f := range tsmFiles {
-		if err := cmd.processTSMFile(info, f); err != nil {
-			return err
-		}
+	opts.Rules = cmd.rules
+	err := engine.Run(ctx, opts)
+	if err != nil && err != context.Canceled {
+		return err
 	}
 
-	walFiles := info.WalFiles
-	sort.Strings(walFiles)
-
-	log.Printf("shard %d: enforcing %d wal file(s)", info.ID, len(walFiles))
-	for _, f := range walFiles {
-		if err := cmd.processWALFile(info, f); err != nil {
-			return err
-		}
-	}
+	logging.Flush(cmd.Stdout)
 
-	for _, r := range cmd.rules {
-		r.EndShard()
+	if err != nil {
+		return fmt.Errorf("interrupted, the file being processed has been left untouched")
 	}
 
-	if !cmd.check {
-		// Write Field Index
-		if err := info.FieldsIndex.Save(); err != nil {
-			return err
-		}
+	if !cmd.check && (cmd.mergeDuration != "" || cmd.moveMeasurements != "") {
+		fmt.Fprintf(cmd.Stdout, "The TSI index of changed shards has been removed, run influx_inspect buildtsi before starting influxd\n")
 	}
 
 	return nil
 }
 
-func (cmd *Command) processTSMFile(info storage.ShardInfo, tsmFilePath string) error {
-	fmt.Fprintf(cmd.Stdout, "Enforcing TSM file '%s'...\n", tsmFilePath)
+// handleSignals cancels the run on the first SIGINT or SIGTERM and exits immediately on the second one. The
+// returned function stops handling signals
+func (cmd *Command) handleSignals(cancel context.CancelFunc) func() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
 
-	rs := cmd.filterRules(cmd.rules, func(r rules.Rule) bool {
-		return r.StartTSM(tsmFilePath)
-	})
+	done := make(chan struct{})
 
-	if len(rs) == 0 {
-		log.Printf("No candidate rule found for processing TSM file, skipping.")
-		return nil
-	}
-
-	f, err := os.Open(tsmFilePath)
-	if err != nil {
-		return err
-	}
+	go func() {
+		for interrupted := false; ; interrupted = true {
+			select {
+			case <-signals:
+			case <-done:
+				return
+			}
 
-	defer f.Close()
-	r, err := tsm1.NewTSMReader(f)
-	if err != nil {
-		fmt.Fprintf(cmd.Stderr, "unable to read %s, skipping: %s\n", tsmFilePath, err.Error())
-		return nil
-	}
-	defer r.Close()
+			if interrupted {
+				fmt.Fprintln(cmd.Stderr, "Exiting immediately, temporary files may be left behind")
+				os.Exit(130)
+			}
 
-	w, err := cmd.createRewriter(tsmFilePath)
+			fmt.Fprintln(cmd.Stderr, "Interrupted, aborting the current file. Interrupt again to exit immediately")
+			cancel()
+		}
+	}()
 
-	if err != nil {
-		return err
+	return func() {
+		signal.Stop(signals)
+		close(done)
 	}
+}
 
-	keyCount := r.KeyCount()
-
-	log.Printf("%d total keys", keyCount)
-	filtered := 0
-
-	readRules := cmd.filterFlaggedRules(rs, rules.TSMReadOnly)
-	writeRules := cmd.filterFlaggedRules(rs, rules.TSMWriteOnly)
-
-	progress := progressbar.Default(int64(keyCount))
-
-	for i := 0; i < keyCount; i++ {
-		key, _ := r.KeyAt(i)
-
-		progress.Add(1)
+// options returns the engine options matching the command line
+func (cmd *Command) options() engine.Options {
+	return engine.Options{
+		DataDir:                 cmd.dataDir,
+		WALDir:                  cmd.walDir,
+		EngineDir:               cmd.engineDir,
+		BoltPath:                cmd.boltPath,
+		OutDataDir:              cmd.outDataDir,
+		OutWALDir:               cmd.outWALDir,
+		BackupDir:               cmd.backupDir,
+		OutBackupDir:            cmd.outBackupDir,
+		MetaDir:                 cmd.metaDir,
+		Database:                cmd.database,
+		RetentionPolicy:         cmd.retentionPolicy,
+		Shard:                   cmd.shardFilter,
+		TimeRange:               cmd.timeRange,
+		RetentionDuration:       cmd.rpDuration,
+		MergeShardGroupDuration: cmd.shardGroupDuration,
+		MoveMeasurements:        cmd.moveFilter(),
+		MoveToDatabase:          cmd.moveToDatabase,
+		MoveToRetentionPolicy:   cmd.moveToRetentionPolicy,
+		CopyMeasurements:        cmd.copyMeasurements,
+		MaxCacheSize:            cmd.maxCacheSize.Size().UInt64(),
+		CacheSnapshotSize:       cmd.cacheSnapshotSize.Size().UInt64(),
+		Compact:                 cmd.compact,
+		FlushWAL:                cmd.flushWAL,
+		CompactThroughput:       cmd.compactThroughput.Size().UInt64(),
+		CompactThroughputBurst:  cmd.compactThroughputBurst.Size().UInt64(),
+		Check:                   cmd.check,
+		RepairWAL:               cmd.repairWAL,
+		RebuildFieldsIndex:      cmd.rebuildFieldsIndex,
+		PreserveOwnership:       cmd.preserveOwnership,
+		IgnoreRunning:           cmd.ignoreRunning,
+		PIDFile:                 cmd.pidFile,
+		IgnoreDiskSpace:         cmd.ignoreDiskSpace,
+		OnEvent:                 cmd.printEvent,
+		OnProgress:              cmd.printProgress,
+	}
+}
 
-		if cmd.filter.Filter(key) {
-			filtered++
-			continue
+// printEvent prints the events of the engine to STDOUT and warnings to STDERR
+func (cmd *Command) printEvent(e engine.Event) {
+	switch e.Type {
+	case engine.ShardStarted:
+		fmt.Fprintf(cmd.Stdout, "Enforcing shard %d...\n", e.Shard.ID)
+		if m := e.Shard.Meta; m != nil {
+			fmt.Fprintf(cmd.Stdout, "Shard %d: group %d [%s, %s), retention %s, owners %v\n", e.Shard.ID, m.GroupID,
+				m.StartTime.Format(time.RFC3339), m.EndTime.Format(time.RFC3339), formatDuration(m.RetentionDuration), m.Owners)
 		}
-
-		readRules := cmd.filterRulesMatchingKey(readRules, key)
-		writeRules := cmd.filterRulesMatchingKey(writeRules, key)
-
-		if len(readRules) == 0 && len(writeRules) == 0 {
-			filtered++
-			continue
+	case engine.TSMFileStarted:
+		fmt.Fprintf(cmd.Stdout, "Enforcing TSM file '%s'...\n", e.Path)
+	case engine.WALFileStarted:
+		fmt.Fprintf(cmd.Stdout, "Enforcing WAL file '%s'...\n", e.Path)
+	case engine.FieldsIndexChecked:
+		if os.IsNotExist(e.Err) {
+			fmt.Fprintf(cmd.Stdout, "Shard %d: fields index '%s' is missing\n", e.Shard.ID, e.Path)
+		} else if e.Err != nil {
+			fmt.Fprintf(cmd.Stdout, "Shard %d: fields index '%s' is corrupt: %v\n", e.Shard.ID, e.Path, e.Err)
 		}
 
-		values, err := r.ReadAll(key)
-		if err != nil {
-			fmt.Fprintf(cmd.Stderr, "unable to read key %q in %s, skipping: %s\n", string(key), tsmFilePath, err.Error())
-			continue
+		fmt.Fprintf(cmd.Stdout, "Shard %d: %d change(s) in fields index\n", e.Shard.ID, len(e.Changes))
+		for _, c := range e.Changes {
+			fmt.Fprintf(cmd.Stdout, "    %s\n", c)
 		}
-
-		for _, r := range readRules {
-			_, _, err := r.Apply(key, values)
-			if err != nil {
-				return err
-			}
+	case engine.WALRangesLost:
+		var total int64
+		for _, l := range e.Lost {
+			total += l.Size()
 		}
 
-		for _, r := range writeRules {
-			key, values, err = r.Apply(key, values)
-			if err != nil {
-				return err
-			}
-
-			if key == nil {
-				break
-			}
+		fmt.Fprintf(cmd.Stdout, "Lost %d bytes in %d corrupt range(s) of WAL file '%s'\n", total, len(e.Lost), e.Path)
+		for _, l := range e.Lost {
+			fmt.Fprintf(cmd.Stdout, "    %s\n", l)
 		}
-
-		if key != nil {
-			if err := w.Write(key, values); err != nil {
-				return err
-			}
+	case engine.ShardsMerged:
+		fmt.Fprintf(cmd.Stdout, "Shard %d: shard group [%s, %s)\n", e.Shard.ID,
+			e.TimeRange.Start.Format(time.RFC3339), e.TimeRange.End.Format(time.RFC3339))
+		for _, id := range e.Merged {
+			fmt.Fprintf(cmd.Stdout, "    merging shard %d\n", id)
 		}
-	}
-
-	if err := w.WriteSnapshot(); err != nil {
-		return err
-	}
-
-	files, err := w.CompactFull()
-	if err != nil {
-		return err
-	}
-
-	if files != nil {
-		if len(files) > 1 {
-			return fmt.Errorf("Full compaction yielded more than one shard %v", files)
+	case engine.MetaUpdated:
+		fmt.Fprintf(cmd.Stdout, "Updated shard groups in '%s', previous snapshot saved as '%s.bak'\n", e.Path, e.Path)
+	case engine.MeasurementsMoved:
+		created := ""
+		if e.Created {
+			created = " (new shard group)"
 		}
-
-		newFile := files[0]
-		log.Printf("Fully compacted TSM file '%s'", newFile)
-
-		log.Printf("Renaming '%s' to '%s'", newFile, tsmFilePath)
-		if err := os.Rename(newFile, tsmFilePath); err != nil {
-			return err
+		fmt.Fprintf(cmd.Stdout, "Shard %d: shard group [%s, %s)%s\n", e.Shard.ID,
+			e.TimeRange.Start.Format(time.RFC3339), e.TimeRange.End.Format(time.RFC3339), created)
+		for _, m := range e.Measurements {
+			fmt.Fprintf(cmd.Stdout, "    moving measurement '%s'\n", m)
 		}
+	case engine.WALFlushed:
+		if cmd.check {
+			fmt.Fprintf(cmd.Stdout, "Shard %d: %d WAL file(s) to flush\n", e.Shard.ID, len(e.Shard.WalFiles))
+		} else {
+			fmt.Fprintf(cmd.Stdout, "Shard %d: flushed %d WAL file(s) into %d TSM file(s)\n", e.Shard.ID, len(e.Shard.WalFiles), len(e.Files))
+		}
+	case engine.ShardCompacted:
+		if cmd.check {
+			fmt.Fprintf(cmd.Stdout, "Shard %d: %d TSM file(s) to compact\n", e.Shard.ID, len(e.Shard.TsmFiles))
+		} else {
+			fmt.Fprintf(cmd.Stdout, "Shard %d: compacted %d TSM file(s) into %d\n", e.Shard.ID, len(e.Shard.TsmFiles), len(e.Files))
+		}
+	case engine.Warning:
+		fmt.Fprintln(cmd.Stderr, e.Err)
 	}
-
-	log.Printf("%d (%d%%) total filtered keys", filtered, (filtered*100)/keyCount)
-
-	if err := w.Close(); err != nil {
-		return err
-	}
-
-	for _, r := range cmd.rules {
-		r.EndTSM()
-	}
-
-	return nil
 }
 
-func (cmd *Command) processWALFile(info storage.ShardInfo, walFilePath string) error {
-	fmt.Fprintf(cmd.Stdout, "Enforcing WAL file '%s'...\n", walFilePath)
-
-	rs := cmd.filterRules(cmd.rules, func(r rules.Rule) bool {
-		return r.StartWAL(walFilePath)
-	})
-
-	if len(rs) == 0 {
-		log.Printf("No candidate rule found for processing WAL file, skipping.")
-		return nil
+// printProgress displays a progress bar for each TSM file
+func (cmd *Command) printProgress(p engine.Progress) {
+	if cmd.progress == nil || cmd.progressPath != p.Path {
+		cmd.progress = progressbar.Default(int64(p.Total))
+		cmd.progressPath = p.Path
 	}
+	cmd.progress.Set(p.Done)
+}
 
-	f, err := os.Open(walFilePath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return nil
+// printRules prints the rules in the order they will be applied
+func (cmd *Command) printRules() {
+	fmt.Fprintf(cmd.Stdout, "Rules will be applied in the following order:\n")
+	for i, r := range cmd.rules {
+		if sr, ok := r.(*rules.ScopedRule); ok {
+			fmt.Fprintf(cmd.Stdout, "    %d. %s (%s)\n", i+1, reflect.TypeOf(sr.Rule), sr.Scope())
+		} else {
+			fmt.Fprintf(cmd.Stdout, "    %d. %s\n", i+1, reflect.TypeOf(r))
 		}
-		return err
 	}
-	defer f.Close()
-
-	r := tsm1.NewWALSegmentReader(f)
-	defer r.Close()
-
-	w, output, outputPath, err := cmd.createWALWriter(rs, walFilePath)
-	if output != nil {
-		defer output.Close()
-	}
-
-	if err != nil {
-		return err
-	}
-
-	readRules := cmd.filterFlaggedRules(rs, rules.WALReadOnly)
-	writeRules := cmd.filterFlaggedRules(rs, rules.WALWriteOnly)
-
-	count := 0
-
-	for r.Next() {
-		entry, err := r.Read()
-		if err != nil {
-			n := r.Count()
-			fmt.Fprintf(cmd.Stderr, "file %s corrupt at position %d: %v", walFilePath, n, err)
-			break
-		}
-
-		switch t := entry.(type) {
-		case *tsm1.WriteWALEntry:
-			var toDelete []string
-			for key, values := range t.Values {
-				for _, r := range readRules {
-					_, _, err = r.Apply([]byte(key), values)
-					if err != nil {
-						return err
-					}
-				}
-
-				newKey := []byte(key)
-				for _, r := range writeRules {
-					newKey, values, err = r.Apply(newKey, values)
-					if err != nil {
-						return err
-					}
-				}
-
-				if newKey == nil {
-					toDelete = append(toDelete, string(key))
-				} else {
-					t.Values[string(newKey)] = values
-					if bytes.Compare([]byte(key), newKey) != 0 {
-						toDelete = append(toDelete, string(key))
-					}
-				}
-			}
-
-			for _, key := range toDelete {
-				delete(t.Values, key)
-			}
-		}
+}
 
-		if w != nil {
-			b, err := encodeWALEntry(entry)
-			if err != nil {
-				fmt.Fprintf(cmd.Stderr, "Failed to encode WAL entry: %v", err)
-				break
-			}
-			w.Write(entry.Type(), b)
-		}
-		count++
-	}
+// printUsage prints the usage message to STDERR.
+func (cmd *Command) printUsage() {
+	usage := `Apply rules to TSM and WAL files.
 
-	log.Printf("%d entries", count)
+Usage: infix [options]
 
-	if w != nil {
-		log.Printf("Renaming '%s' to '%s'", outputPath, walFilePath)
-		// Replace original file with new file.
-		return os.Rename(outputPath, walFilePath)
-	}
+    -datadir
+        Path to data storage (defaults to /var/lib/influxdb/data)
+    -waldir
+        Path to wal storage (defaults to /var/lib/influxdb/wal)
+    -enginedir
+        Path to InfluxDB 2.x engine storage (eg ~/.influxdbv2/engine). Overrides -datadir and -waldir
+    -bolt-path
+        Path to InfluxDB 2.x bolt metadata store used to resolve bucket names (defaults to influxd.bolt next to -enginedir)
+    -outdir
+        Path to write processed shards to, leaving -datadir (or the data directory of -enginedir) untouched
+    -outwaldir
+        Path to write the WAL of processed shards to, leaving -waldir (or the WAL directory of -enginedir) untouched
+    -backup
+        Path to a backup written by influxd backup -portable to process instead of -datadir and -waldir
+    -outbackup
+        Path to write a new portable backup with the processed shards to (required with -backup unless -check)
+    -database
+        The database (or InfluxDB 2.x bucket name or ID) to fix
+    -retention
+        The retention policy to fix
+    -shard
+        The id of the shard to fix
+    -metadir
+        Path to meta storage (eg /var/lib/influxdb/meta) to read shard groups and owners from
+    -start
+        Only fix TSM files with data after this time (RFC3339)
+    -end
+        Only fix TSM files with data before this time (RFC3339)
+    -retention-duration
+        Only fix shards of retention policies with this duration (eg 30d, INF, requires -metadir)
+    -merge-shard-group-duration
+        Merge the shards of -retention into shard groups of this duration (eg 7d) and update the shard groups of -metadir
+        instead of applying rules. Shards must not have WAL segments
+    -move-measurement
+        Comma-separated list of measurements to move from the selected shards to -to-database and -to-retention instead
+        of applying rules (requires -database and -metadir). Shards must not have WAL segments
+    -to-database
+        The database to move measurements to
+    -to-retention
+        The retention policy to move measurements to
+    -copy
+        Copy measurements instead of moving them, leaving the source shards untouched
+    -max-cache-size
+        The maximum in-memory cache size in bytes (defaults to %s)
+    -cache-snapshot-size
+        The size in bytes after which the cache will be snapshotted to disk when re-writing TSM files (defaults to %s)
+    -flush-wal
+        Write the WAL segments of the selected shards to TSM files and remove them, before applying rules if any
+    -compact
+        Fully compact the TSM files of the selected shards instead of applying rules
+    -compact-throughput
+        The rate limit in bytes per second of compactions, when rewriting or compacting TSM files, 0 to disable it
+        (defaults to %s)
+    -compact-throughput-burst
+        The rate limit burst in bytes of compactions (defaults to -compact-throughput)
+    -list-rules
+        Print a list of registered rules with sample config and exit
+    -v
+        Enable verbose logging
+    -check
+        Run in check mode (do not apply any change)
+    -repair-wal
+        Salvage readable entries past corruption points in WAL files and report lost byte ranges
+    -rebuild-field-index
+        Rebuild fields.idx files from the keys of TSM and WAL files and report differences with the existing ones
+    -preserve-ownership
+        Restore the owner, group and mode of rewritten TSM, WAL and fields.idx files
+    -yes
+        Do not ask for confirmation when running as root
+    -pidfile
+        Path to the PID file of influxd, checked along with open files to make sure influxd is stopped
+    -ignore-running
+        Do not check that influxd is stopped before changing files
+    -ignore-disk-space
+        Only warn, instead of failing, when free disk space may be insufficient to rewrite files
+    -config
+        The configuration file (optional with -repair-wal, -rebuild-field-index, -merge-shard-group-duration, -move-measurement, -compact and -flush-wal)
+`
 
-	return nil
+	fmt.Fprintf(cmd.Stdout, fmt.Sprintf(usage, defaultCacheMaxMemorySize.HumanString(), defaultCacheSnapshotMemorySize.HumanString(),
+		defaultCompactThroughput.HumanString()))
 }
 
 func (cmd *Command) validate() error {
-	if cmd.config == "" {
+	if cmd.config == "" && !cmd.repairWAL && !cmd.rebuildFieldsIndex && cmd.mergeDuration == "" && cmd.moveMeasurements == "" && !cmd.compact && !cmd.flushWAL {
 		return fmt.Errorf("must specify a configuration file")
 	}
-	if cmd.retentionPolicy != "" && cmd.database == "" {
-		return fmt.Errorf("must specify a database")
-	}
-	return nil
-}
-
-func (cmd *Command) createRewriter(tsmFilePath string) (storage.TSMRewriter, error) {
-	// If all rules are read-only, just return a NoopRewriter
-	readRules := cmd.filterFlaggedRules(cmd.rules, rules.TSMReadOnly)
-	readonly := len(readRules) == len(cmd.rules)
-
-	if cmd.check || readonly {
-		return &storage.NoopTSMRewriter{}, nil
-	}
-
-	// Remove previous temporary files.
-	outputDir := tsmFilePath + ".rewriting"
-
-	if _, err := os.Stat(outputDir); os.IsNotExist(err) {
-		if err := os.Mkdir(outputDir, os.ModePerm); err != nil {
-			return nil, err
+	if cmd.start != "" {
+		t, err := time.Parse(time.RFC3339, cmd.start)
+		if err != nil {
+			return fmt.Errorf("invalid start time: %v", err)
 		}
-	} else {
-		files, err := ioutil.ReadDir(outputDir)
+		cmd.timeRange.Start = t
+	}
+	if cmd.end != "" {
+		t, err := time.Parse(time.RFC3339, cmd.end)
 		if err != nil {
-			return nil, err
+			return fmt.Errorf("invalid end time: %v", err)
 		}
+		cmd.timeRange.End = t
+	}
 
-		for _, f := range files {
-			path := filepath.Join(outputDir, f.Name())
-			if err := os.Remove(path); err != nil {
-				return nil, err
-			}
+	if cmd.retentionDuration != "" {
+		d, err := parseDuration(cmd.retentionDuration)
+		if err != nil {
+			return fmt.Errorf("invalid retention duration: %v", err)
 		}
+		cmd.rpDuration = &d
 	}
 
-	if err := os.RemoveAll(tsmFilePath + ".idx.tmp"); err != nil {
-		return nil, err
+	if cmd.mergeDuration != "" {
+		d, err := influxql.ParseDuration(cmd.mergeDuration)
+		if err != nil {
+			return fmt.Errorf("invalid shard group duration: %v", err)
+		}
+		cmd.shardGroupDuration = d
 	}
 
-	log.Printf("Creating cached TSM rewriter to directory '%s'", outputDir)
-	w := storage.NewCachedTSMRewriter(cmd.maxCacheSize.Size().UInt64(), cmd.cacheSnapshotSize.Size().UInt64(), outputDir)
-	return w, nil
+	return nil
 }
 
-func (cmd *Command) createWALWriter(rs []rules.Rule, walFilePath string) (*tsm1.WALSegmentWriter, *os.File, string, error) {
-	// If all rules are read-only, just return nil
-	readRules := cmd.filterFlaggedRules(rs, rules.WALReadOnly)
-	readonly := len(readRules) == len(rs)
-
-	if cmd.check || readonly {
-		return nil, nil, "", nil
-	}
-
-	// Remove previous temporary files.
-	outputPath := walFilePath + ".rewriting.tmp"
-	if err := os.RemoveAll(outputPath); err != nil {
-		return nil, nil, "", err
-	}
-
-	// Create TSMWriter to temporary location.
-	output, err := os.Create(outputPath)
-	if err != nil {
-		return nil, nil, "", err
+// moveFilter returns the filter matching the measurements to move, nil if none
+func (cmd *Command) moveFilter() filter.Filter {
+	if cmd.moveMeasurements == "" {
+		return nil
 	}
-
-	w := tsm1.NewWALSegmentWriter(output)
-
-	return w, output, outputPath, nil
+	return filter.NewIncludeFilter(strings.Split(cmd.moveMeasurements, ","))
 }
 
-func (cmd *Command) filterRulesMatchingKey(rs []rules.Rule, key []byte) []rules.Rule {
-	return cmd.filterRules(rs, func(r rules.Rule) bool {
-		return r.FilterKey(key)
-	})
+// parseDuration parses an InfluxQL duration, where INF stands for an infinite duration
+func parseDuration(s string) (time.Duration, error) {
+	if strings.EqualFold(s, "INF") {
+		return 0, nil
+	}
+	return influxql.ParseDuration(s)
 }
 
-func (cmd *Command) filterFlaggedRules(rs []rules.Rule, flags int) []rules.Rule {
-	return cmd.filterRules(rs, func(r rules.Rule) bool {
-		return r.Flags()&flags != 0
-	})
+func formatDuration(d time.Duration) string {
+	if d == 0 {
+		return "INF"
+	}
+	return influxql.FormatDuration(d)
 }
 
-func (cmd *Command) filterRules(rules []rules.Rule, filterFn func(rules.Rule) bool) (ret []rules.Rule) {
-	for _, r := range rules {
-		if filterFn(r) {
-			ret = append(ret, r)
-		}
+// checkRoot asks for confirmation when running as root, unless the ownership of rewritten files is preserved
+func (cmd *Command) checkRoot() error {
+	if cmd.yes || cmd.preserveOwnership {
+		return nil
 	}
-	return
-}
 
-func checkRoot() error {
 	user, _ := user.Current()
 	if user != nil && user.Username == "root" {
 		warning := `You are currently running infix as root. This will write all your
 TSM and WAL files with root ownership and will be inacessible
 if you run influxd as a non-root user. You should run infix
 as the same user you are running influxd (eg sudo -u influxdb infix [...])
+or use -preserve-ownership to keep the ownership of rewritten files
 `
-		fmt.Print(warning)
-		fmt.Print("Are you sure you want to continue? (yN): ")
+		fmt.Fprint(cmd.Stdout, warning)
+		fmt.Fprint(cmd.Stdout, "Are you sure you want to continue? (yN): ")
 		var answer string
 		if fmt.Scanln(&answer); !strings.HasPrefix(strings.TrimSpace(strings.ToLower(answer)), "y") {
 			return fmt.Errorf("aborted by user")
@@ -591,14 +556,3 @@ as the same user you are running influxd (eg sudo -u influxdb infix [...])
 
 	return nil
 }
-
-func encodeWALEntry(entry tsm1.WALEntry) ([]byte, error) {
-	bytes := make([]byte, 1024<<2)
-
-	b, err := entry.Encode(bytes)
-	if err != nil {
-		return nil, err
-	}
-
-	return snappy.Encode(b, b), nil
-}
@@ -0,0 +1,145 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/Abc-Arbitrage/infix/storage"
+	"github.com/influxdata/influxdb/cmd/influxd/backup_util"
+)
+
+// runBackup extracts the selected shards of the backup in BackupDir to a temporary directory, processes them and
+// writes a new backup set to OutBackupDir. Nothing is written when the run fails or is canceled
+func (e *engine) runBackup(ctx context.Context) error {
+	b, err := storage.LoadBackup(e.BackupDir)
+	if err != nil {
+		return err
+	}
+
+	// Shards are extracted next to the output backup, which needs the space anyway
+	workDir := os.TempDir()
+	if !e.Check {
+		if err := e.checkOutBackupDir(); err != nil {
+			return err
+		}
+		workDir = e.OutBackupDir
+	}
+
+	tmp, err := ioutil.TempDir(workDir, ".infix-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	e.DataDir = filepath.Join(tmp, "data")
+	e.WALDir = filepath.Join(tmp, "wal")
+
+	var selected []backup_util.Entry
+	for _, f := range b.Files {
+		if !e.selectsBackupShard(f) {
+			continue
+		}
+
+		log.Printf("Extracting shard archive '%s'", f.FileName)
+		shardPath := filepath.Join(e.DataDir, storage.ShardPath(f))
+		if err := os.MkdirAll(shardPath, 0755); err != nil {
+			return err
+		}
+		if err := storage.ExtractShardArchive(filepath.Join(b.Dir, f.FileName), e.DataDir); err != nil {
+			return err
+		}
+		selected = append(selected, f)
+	}
+
+	if len(selected) == 0 {
+		log.Printf("No shard selected in backup '%s'", b.Dir)
+	} else if err := e.run(ctx); err != nil {
+		return err
+	}
+
+	if e.Check {
+		return nil
+	}
+
+	return e.writeBackup(b, selected)
+}
+
+// checkOutBackupDir creates the output backup directory, which must not hold another backup
+func (e *engine) checkOutBackupDir() error {
+	if err := os.MkdirAll(e.OutBackupDir, 0755); err != nil {
+		return err
+	}
+
+	manifests, err := filepath.Glob(filepath.Join(e.OutBackupDir, "*"+storage.BackupManifestExtension))
+	if err != nil {
+		return err
+	}
+	if len(manifests) > 0 {
+		return fmt.Errorf("output backup directory '%s' already holds a backup", e.OutBackupDir)
+	}
+	return nil
+}
+
+// selectsBackupShard returns true if a shard of a backup matches the database, retention policy and shard options
+func (e *engine) selectsBackupShard(f backup_util.Entry) bool {
+	return (e.Database == "" || e.Database == f.Database) &&
+		(e.RetentionPolicy == "" || e.RetentionPolicy == f.Policy) &&
+		(e.Shard == "" || e.Shard == strconv.FormatUint(f.ShardID, 10))
+}
+
+// writeBackup writes a backup set with the processed shards, and copies of the other shards and meta file of the
+// source backup. The manifest is written last so that the backup is only valid once complete
+func (e *engine) writeBackup(b *storage.Backup, processed []backup_util.Entry) error {
+	base := time.Now().UTC().Format(backup_util.PortableFileNamePattern)
+
+	manifest := b.Manifest
+	manifest.Files = nil
+	manifest.Meta = backup_util.MetaEntry{FileName: base + ".meta", Size: b.Meta.Size}
+
+	log.Printf("Writing backup '%s' to '%s'", base, e.OutBackupDir)
+	if err := storage.CopyFile(filepath.Join(b.Dir, b.Meta.FileName), filepath.Join(e.OutBackupDir, manifest.Meta.FileName), false); err != nil {
+		return err
+	}
+
+	written := make(map[uint64]bool)
+	for _, f := range processed {
+		entry := f
+		entry.FileName = fmt.Sprintf("%s.s%d.tar.gz", base, f.ShardID)
+
+		size, err := storage.WriteShardArchive(e.DataDir, storage.ShardPath(f), filepath.Join(e.OutBackupDir, entry.FileName))
+		if err != nil {
+			return err
+		}
+		entry.Size = size
+
+		manifest.Files = append(manifest.Files, entry)
+		written[f.ShardID] = true
+	}
+
+	for _, f := range b.Files {
+		if written[f.ShardID] {
+			continue
+		}
+
+		// Archives are never modified once written and can be linked
+		entry := f
+		entry.FileName = fmt.Sprintf("%s.s%d.tar.gz", base, f.ShardID)
+		if err := storage.CopyFile(filepath.Join(b.Dir, f.FileName), filepath.Join(e.OutBackupDir, entry.FileName), true); err != nil {
+			return err
+		}
+		manifest.Files = append(manifest.Files, entry)
+	}
+
+	sort.Slice(manifest.Files, func(i, j int) bool {
+		return manifest.Files[i].ShardID < manifest.Files[j].ShardID
+	})
+
+	return manifest.Save(filepath.Join(e.OutBackupDir, base+storage.BackupManifestExtension))
+}
@@ -0,0 +1,97 @@
+package engine
+
+import (
+	"context"
+	"log"
+	"os"
+
+	"github.com/Abc-Arbitrage/infix/storage"
+)
+
+// runCompact fully compacts the TSM files of the selected shards. Shards with a single TSM file and no tombstone are
+// already fully compacted and left untouched
+func (e *engine) runCompact(ctx context.Context) error {
+	e.detectEngineDir()
+
+	if err := e.checkNotRunning(); err != nil {
+		return err
+	}
+
+	shards, err := e.loadShards()
+	if err != nil {
+		return err
+	}
+
+	shards, err = e.filterShardsWithMeta(shards)
+	if err != nil {
+		return err
+	}
+
+	if err := e.checkDiskSpace(shards); err != nil {
+		return err
+	}
+
+	for _, sh := range shards {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		e.emit(Event{Type: ShardStarted, Shard: sh})
+
+		if compacted(sh) {
+			log.Printf("shard %d: already fully compacted, skipping", sh.ID)
+			continue
+		}
+
+		if e.Check {
+			e.emit(Event{Type: ShardCompacted, Shard: sh})
+			continue
+		}
+
+		// The new files get the ownership of the first compacted file
+		o, err := storage.ReadOwnership(sh.TsmFiles[0])
+		if err != nil {
+			return err
+		}
+
+		files, err := storage.CompactTSMFiles(ctx, sh.Path, int(e.CompactThroughput), int(e.CompactThroughputBurst))
+		if err != nil {
+			return err
+		}
+
+		if e.PreserveOwnership {
+			for _, f := range files {
+				log.Printf("Restoring ownership %d:%d and mode %s of '%s'", o.UID, o.GID, o.Mode, f)
+				if err := o.Apply(f); err != nil {
+					return err
+				}
+			}
+		}
+
+		e.emit(Event{Type: ShardCompacted, Shard: sh, Files: files})
+	}
+
+	return nil
+}
+
+// compacted returns true if a shard has at most a single TSM file without tombstone
+func compacted(info storage.ShardInfo) bool {
+	if len(info.TsmFiles) > 1 {
+		return false
+	}
+
+	for _, f := range info.TsmFiles {
+		if _, err := os.Stat(storage.TombstonePath(f)); err == nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+// newCachedTSMRewriter creates a rewriter writing to path with the cache and compaction settings of the options
+func (e *engine) newCachedTSMRewriter(path string) *storage.CachedTSMRewriter {
+	w := storage.NewCachedTSMRewriter(e.MaxCacheSize, e.CacheSnapshotSize, path)
+	w.SetCompactThroughput(int(e.CompactThroughput), int(e.CompactThroughputBurst))
+	return w
+}
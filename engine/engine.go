@@ -0,0 +1,437 @@
+// Package engine applies rules to the TSM and WAL files of InfluxDB shards. It is used by the infix command and
+// can be embedded in other programs
+package engine
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+
+	"github.com/Abc-Arbitrage/infix/rules"
+	"github.com/Abc-Arbitrage/infix/storage"
+)
+
+type engine struct {
+	Options
+
+	// mirroredSeries holds the series files already copied to the output directories
+	mirroredSeries map[string]bool
+}
+
+// Run loads the shards selected by the options and applies rules to them. When the context is canceled, the file
+// being processed is left untouched, the remaining files of its shard are only used to update the shard's fields
+// index, and rules are ended so that their reports are complete for the processed data. The context error is then
+// returned
+func Run(ctx context.Context, opts Options) error {
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+
+	e := &engine{Options: opts.withDefaults(), mirroredSeries: make(map[string]bool)}
+	if e.BackupDir != "" {
+		return e.runBackup(ctx)
+	}
+	if e.MergeShardGroupDuration != 0 {
+		return e.runMerge(ctx)
+	}
+	if e.MoveMeasurements != nil {
+		return e.runMove(ctx)
+	}
+	if e.Compact {
+		return e.runCompact(ctx)
+	}
+	if e.FlushWAL {
+		if err := e.flushWAL(ctx); err != nil {
+			return err
+		}
+		if len(e.Rules) == 0 && !e.RebuildFieldsIndex {
+			return nil
+		}
+	}
+
+	return e.run(ctx)
+}
+
+func (e *engine) run(ctx context.Context) error {
+	e.detectEngineDir()
+
+	if err := e.checkNotRunning(); err != nil {
+		return err
+	}
+
+	shards, err := e.loadShards()
+	if err != nil {
+		return err
+	}
+
+	shards, err = e.filterShardsWithMeta(shards)
+	if err != nil {
+		return err
+	}
+
+	if err := e.checkDiskSpace(shards); err != nil {
+		return err
+	}
+
+	return e.process(ctx, shards)
+}
+
+func (e *engine) emit(event Event) {
+	if e.OnEvent != nil {
+		e.OnEvent(event)
+	}
+}
+
+func (e *engine) warn(info storage.ShardInfo, path string, format string, args ...interface{}) {
+	e.emit(Event{Type: Warning, Shard: info, Path: path, Err: fmt.Errorf(format, args...)})
+}
+
+func (e *engine) progress(info storage.ShardInfo, path string, done int, total int) {
+	if e.OnProgress != nil {
+		e.OnProgress(Progress{Shard: info, Path: path, Done: done, Total: total})
+	}
+}
+
+// detectEngineDir sets the InfluxDB 2.x engine directory when DataDir points to one, and the default bolt path
+func (e *engine) detectEngineDir() {
+	if e.EngineDir == "" && storage.IsEngineDir(e.DataDir) {
+		log.Printf("Detected InfluxDB 2.x engine directory '%s'", e.DataDir)
+		e.EngineDir = e.DataDir
+	}
+
+	if e.EngineDir != "" && e.BoltPath == "" {
+		e.BoltPath = filepath.Join(filepath.Dir(filepath.Clean(e.EngineDir)), storage.DefaultBoltFileName)
+	}
+}
+
+// checkNotRunning returns an error if influxd, or any other process, seems to be using the storage. Nothing is
+// written in check mode, so the storage may then be in use
+func (e *engine) checkNotRunning() error {
+	if e.IgnoreRunning || e.Check {
+		return nil
+	}
+
+	const hint = "stop influxd first or use -ignore-running to skip this check"
+
+	if e.PIDFile != "" {
+		pid, err := storage.RunningPID(e.PIDFile)
+		if err != nil {
+			return err
+		}
+		if pid != 0 {
+			return fmt.Errorf("influxd is running with PID %d from '%s', %s", pid, e.PIDFile, hint)
+		}
+	}
+
+	dirs := []string{e.DataDir, e.WALDir}
+	if e.mirroring() {
+		// Source directories are only read
+		dirs = []string{e.OutDataDir, e.OutWALDir}
+	} else if e.EngineDir != "" {
+		locked, err := storage.BoltLocked(e.BoltPath)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if locked {
+			return fmt.Errorf("bolt file '%s' is locked by a running influxd, %s", e.BoltPath, hint)
+		}
+
+		dirs = []string{e.EngineDir}
+	}
+
+	processes, err := storage.FindProcesses(dirs...)
+	if err != nil {
+		return err
+	}
+	if len(processes) > 0 {
+		return fmt.Errorf("%s, %s", processes[0], hint)
+	}
+
+	return nil
+}
+
+func (e *engine) loadShards() ([]storage.ShardInfo, error) {
+	if e.EngineDir == "" {
+		return storage.LoadShards(e.DataDir, e.WALDir, e.Database, e.RetentionPolicy, e.Shard, e.TimeRange)
+	}
+
+	return storage.LoadEngineShards(e.EngineDir, e.BoltPath, e.Database, e.RetentionPolicy, e.Shard, e.TimeRange)
+}
+
+func (e *engine) filterShardsWithMeta(shards []storage.ShardInfo) ([]storage.ShardInfo, error) {
+	if e.MetaDir == "" {
+		return shards, nil
+	}
+
+	data, err := storage.LoadMeta(e.MetaDir)
+	if err != nil {
+		return nil, err
+	}
+
+	storage.AttachMeta(shards, data)
+
+	var ret []storage.ShardInfo
+	for _, sh := range shards {
+		if sh.Meta == nil {
+			if e.RetentionDuration != nil {
+				log.Printf("shard %d: no meta information, skipping", sh.ID)
+				continue
+			}
+		} else {
+			if !sh.Meta.Overlaps(e.TimeRange) {
+				log.Printf("shard %d: shard group [%s, %s) out of time range, skipping", sh.ID, sh.Meta.StartTime, sh.Meta.EndTime)
+				continue
+			}
+			if e.RetentionDuration != nil && sh.Meta.RetentionDuration != *e.RetentionDuration {
+				log.Printf("shard %d: retention policy duration %s does not match, skipping", sh.ID, sh.Meta.RetentionDuration)
+				continue
+			}
+		}
+		ret = append(ret, sh)
+	}
+
+	return ret, nil
+}
+
+func (e *engine) process(ctx context.Context, shards []storage.ShardInfo) error {
+	for _, r := range e.Rules {
+		log.Printf("Running rule %s", reflect.TypeOf(r))
+		r.CheckMode(e.Check)
+		r.Start()
+	}
+
+	if err := e.scan(ctx, shards); err != nil {
+		return err
+	}
+
+	var err error
+	for _, sh := range shards {
+		if err = ctx.Err(); err != nil {
+			break
+		}
+
+		if err = e.processShard(ctx, sh); err != nil && !canceled(ctx, err) {
+			return err
+		}
+	}
+
+	for _, r := range e.Rules {
+		r.End()
+	}
+
+	return err
+}
+
+// canceled returns true if err has been returned because ctx has been canceled
+func canceled(ctx context.Context, err error) bool {
+	return err != nil && err == ctx.Err()
+}
+
+func (e *engine) processShard(ctx context.Context, info storage.ShardInfo) error {
+	e.emit(Event{Type: ShardStarted, Shard: info})
+
+	if err := e.mirrorShard(&info); err != nil {
+		return err
+	}
+
+	// Rules may save the fields index themselves, replacing the file before it is updated
+	fieldsIndexPath := filepath.Join(info.Path, storage.FieldsIndexFileName)
+	restoreFieldsIndex, err := e.snapshotOwnership(fieldsIndexPath, e.outPath(fieldsIndexPath))
+	if err != nil {
+		return err
+	}
+
+	rs := filterRules(e.Rules, func(r rules.Rule) bool {
+		return r.StartShard(info)
+	})
+
+	if len(rs) == 0 && !e.RepairWAL && !e.RebuildFieldsIndex {
+		log.Printf("No candidate rule found for processing shard %d, skipping.", info.ID)
+		for _, files := range [][]string{info.TsmFiles, info.WalFiles} {
+			for _, f := range files {
+				if err := e.keepFile(f); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	if info.FieldsIndexErr != nil {
+		e.warn(info, "", "shard %d: unable to load fields index: %v", info.ID, info.FieldsIndexErr)
+	}
+
+	// Track the fields remaining in the shard to rebuild its index once rewritten
+	var fields *storage.FieldTracker
+	if e.RebuildFieldsIndex || (!e.Check && len(filterFlaggedRules(rs, rules.TSMWriteOnly|rules.WALWriteOnly)) > 0) {
+		fields = storage.NewFieldTracker()
+	}
+
+	// we need to make sure we write the same order that the wal received the data
+	tsmFiles := info.TsmFiles
+	sort.Strings(tsmFiles)
+
+	log.Printf("shard %d: enforcing %d tsm file(s)", info.ID, len(tsmFiles))
+
+	// Once interrupted, remaining files are left untouched but still tracked so that the fields index matches them
+	var interrupted error
+
+	for _, f := range tsmFiles {
+		if interrupted != nil {
+			if err := e.trackTSMFile(info, f, fields); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := e.processTSMFile(ctx, info, rs, f, fields); canceled(ctx, err) {
+			interrupted = err
+		} else if err != nil {
+			return err
+		}
+	}
+
+	walFiles := info.WalFiles
+	sort.Strings(walFiles)
+
+	log.Printf("shard %d: enforcing %d wal file(s)", info.ID, len(walFiles))
+	for _, f := range walFiles {
+		if interrupted != nil {
+			if err := e.trackWALFile(info, f, fields); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := e.processWALFile(ctx, info, rs, f, fields); canceled(ctx, err) {
+			interrupted = err
+		} else if err != nil {
+			return err
+		}
+	}
+
+	for _, r := range rs {
+		if err := r.EndShard(); err != nil {
+			e.warn(info, "", "shard %d: %v", info.ID, err)
+		}
+	}
+
+	if err := e.updateFieldsIndex(info, fields, restoreFieldsIndex); err != nil {
+		return err
+	}
+
+	return interrupted
+}
+
+// updateFieldsIndex rebuilds the fields index of a shard from the tracked fields when possible, otherwise saves the
+// index as updated by the rules. restoreOwnership gives the index the ownership it had before the rules ran
+func (e *engine) updateFieldsIndex(info storage.ShardInfo, fields *storage.FieldTracker, restoreOwnership func() error) error {
+	path := filepath.Join(info.Path, storage.FieldsIndexFileName)
+	outPath := e.outPath(path)
+
+	if fields.Valid() {
+		if e.RebuildFieldsIndex {
+			previous, err := storage.ReadFieldsIndex(path)
+			e.emit(Event{Type: FieldsIndexChecked, Shard: info, Path: path, Err: err, Changes: fields.Diff(previous)})
+		}
+
+		if e.Check {
+			return nil
+		}
+
+		log.Printf("shard %d: rebuilding fields index from remaining keys", info.ID)
+		if err := fields.Rebuild(outPath, info.FieldsIndex); err != nil {
+			return err
+		}
+		return restoreOwnership()
+	}
+
+	if fields != nil {
+		e.warn(info, path, "shard %d: some data could not be read, fields index will not be rebuilt", info.ID)
+	}
+
+	if e.Check {
+		return nil
+	}
+
+	if info.FieldsIndexErr != nil {
+		// Saving the index would replace the unreadable file with the fields known by the rules only
+		e.warn(info, path, "shard %d: fields index left untouched, use -rebuild-field-index to regenerate it", info.ID)
+		return restoreOwnership()
+	}
+
+	// Write Field Index
+	if err := info.FieldsIndex.Save(); err != nil {
+		return err
+	}
+	return restoreOwnership()
+}
+
+// replaceFile calls replace to create or replace the file at dst from the file at src, which are the same file unless
+// mirroring. With PreserveOwnership, dst then gets the ownership of src, or the owner and group of its directory if
+// src does not exist
+func (e *engine) replaceFile(src string, dst string, replace func() error) error {
+	restore, err := e.snapshotOwnership(src, dst)
+	if err != nil {
+		return err
+	}
+
+	if err := replace(); err != nil {
+		return err
+	}
+
+	return restore()
+}
+
+// snapshotOwnership reads the ownership of src, or of the directory of dst if src does not exist, and returns a
+// function giving it to dst once replaced. It does nothing without PreserveOwnership
+func (e *engine) snapshotOwnership(src string, dst string) (func() error, error) {
+	if !e.PreserveOwnership {
+		return func() error { return nil }, nil
+	}
+
+	o, err := storage.ReadOwnership(src)
+	created := os.IsNotExist(err)
+	if created {
+		o, err = storage.ReadOwnership(filepath.Dir(dst))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return func() error {
+		fi, err := os.Stat(dst)
+		if os.IsNotExist(err) {
+			// The file has been removed, eg an empty fields index
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if created {
+			o.Mode = fi.Mode().Perm()
+		}
+
+		log.Printf("Restoring ownership %d:%d and mode %s of '%s'", o.UID, o.GID, o.Mode, dst)
+		return o.Apply(dst)
+	}, nil
+}
+
+func filterFlaggedRules(rs []rules.Rule, flags int) []rules.Rule {
+	return filterRules(rs, func(r rules.Rule) bool {
+		return r.Flags()&flags != 0
+	})
+}
+
+func filterRules(rs []rules.Rule, filterFn func(rules.Rule) bool) (ret []rules.Rule) {
+	for _, r := range rs {
+		if filterFn(r) {
+			ret = append(ret, r)
+		}
+	}
+	return
+}
@@ -0,0 +1,931 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Abc-Arbitrage/infix/filter"
+	"github.com/Abc-Arbitrage/infix/rules"
+	"github.com/Abc-Arbitrage/infix/storage"
+	"github.com/influxdata/influxdb/cmd/influxd/backup_util"
+	"github.com/influxdata/influxdb/services/meta"
+	"github.com/influxdata/influxdb/tsdb"
+	"github.com/influxdata/influxdb/tsdb/engine/tsm1"
+	"github.com/influxdata/influxql"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeTestTSMFile(t *testing.T, path string, keys ...string) {
+	f, err := os.Create(path)
+	assert.NoError(t, err)
+
+	w, err := tsm1.NewTSMWriter(f)
+	assert.NoError(t, err)
+
+	for _, key := range keys {
+		assert.NoError(t, w.Write([]byte(key), []tsm1.Value{tsm1.NewFloatValue(0, 1.0)}))
+	}
+	assert.NoError(t, w.WriteIndex())
+	assert.NoError(t, w.Close())
+}
+
+func readTestTSMKeys(t *testing.T, path string) []string {
+	f, err := os.Open(path)
+	assert.NoError(t, err)
+
+	r, err := tsm1.NewTSMReader(f)
+	assert.NoError(t, err)
+	defer r.Close()
+
+	var keys []string
+	for i := 0; i < r.KeyCount(); i++ {
+		key, _ := r.KeyAt(i)
+		keys = append(keys, string(key))
+	}
+	return keys
+}
+
+func newTestShard(t *testing.T) (string, string) {
+	dir, err := ioutil.TempDir("", "infix-engine")
+	assert.NoError(t, err)
+
+	shPath := filepath.Join(dir, "data", "telegraf", "autogen", "1")
+	assert.NoError(t, os.MkdirAll(shPath, 0755))
+
+	tsmPath := filepath.Join(shPath, "000000001-000000001.tsm")
+	writeTestTSMFile(t, tsmPath, "cpu,host=a#!~#idle", "disk,host=a#!~#free", "mem,host=a#!~#used")
+
+	return dir, tsmPath
+}
+
+func TestRun_ShouldApplyRulesAndReportEvents(t *testing.T) {
+	dir, tsmPath := newTestShard(t)
+	defer os.RemoveAll(dir)
+
+	var events []Event
+	var progress []Progress
+
+	err := Run(context.Background(), Options{
+		DataDir:    filepath.Join(dir, "data"),
+		WALDir:     filepath.Join(dir, "wal"),
+		Rules:      []rules.Rule{rules.NewDropMeasurement("disk")},
+		OnEvent:    func(e Event) { events = append(events, e) },
+		OnProgress: func(p Progress) { progress = append(progress, p) },
+	})
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{"cpu,host=a#!~#idle", "mem,host=a#!~#used"}, readTestTSMKeys(t, tsmPath))
+
+	if assert.Len(t, events, 2) {
+		assert.Equal(t, ShardStarted, events[0].Type)
+		assert.Equal(t, uint64(1), events[0].Shard.ID)
+		assert.Equal(t, TSMFileStarted, events[1].Type)
+		assert.Equal(t, tsmPath, events[1].Path)
+	}
+
+	if assert.Len(t, progress, 3) {
+		assert.Equal(t, Progress{Shard: events[0].Shard, Path: tsmPath, Done: 3, Total: 3}, progress[2])
+	}
+}
+
+func TestRun_ShouldReportRuleShardErrors(t *testing.T) {
+	dir, _ := newTestShard(t)
+	defer os.RemoveAll(dir)
+
+	var warnings []error
+	err := Run(context.Background(), Options{
+		DataDir: filepath.Join(dir, "data"),
+		WALDir:  filepath.Join(dir, "wal"),
+		Rules:   []rules.Rule{rules.NewRenameField(filter.NewIncludeFilter([]string{"cpu"}), filter.NewIncludeFilter([]string{"idle"}), func(string) string { return "usage_idle" })},
+		OnEvent: func(e Event) {
+			if e.Type == Warning {
+				warnings = append(warnings, e.Err)
+			}
+		},
+	})
+	assert.NoError(t, err)
+
+	// The fields index of the shard is empty
+	if assert.Len(t, warnings, 1) {
+		assert.Contains(t, warnings[0].Error(), "Failed to find fields in index for measurement 'cpu'")
+	}
+}
+
+func TestRun_ShouldNotChangeFilesInCheckMode(t *testing.T) {
+	dir, tsmPath := newTestShard(t)
+	defer os.RemoveAll(dir)
+
+	err := Run(context.Background(), Options{
+		DataDir: filepath.Join(dir, "data"),
+		WALDir:  filepath.Join(dir, "wal"),
+		Check:   true,
+		Rules:   []rules.Rule{rules.NewDropMeasurement("disk")},
+	})
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{"cpu,host=a#!~#idle", "disk,host=a#!~#free", "mem,host=a#!~#used"}, readTestTSMKeys(t, tsmPath))
+}
+
+func TestRun_ShouldStopWhenCanceled(t *testing.T) {
+	dir, tsmPath := newTestShard(t)
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := Run(ctx, Options{
+		DataDir: filepath.Join(dir, "data"),
+		WALDir:  filepath.Join(dir, "wal"),
+		Rules:   []rules.Rule{rules.NewDropMeasurement("disk")},
+	})
+	assert.Equal(t, context.Canceled, err)
+
+	assert.Len(t, readTestTSMKeys(t, tsmPath), 3)
+}
+
+func TestRun_ShouldLeaveInterruptedFileUntouched(t *testing.T) {
+	dir, tsmPath := newTestShard(t)
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	err := Run(ctx, Options{
+		DataDir: filepath.Join(dir, "data"),
+		WALDir:  filepath.Join(dir, "wal"),
+		Rules:   []rules.Rule{rules.NewDropMeasurement("disk")},
+		OnProgress: func(p Progress) {
+			if p.Done == 2 {
+				cancel()
+			}
+		},
+	})
+	assert.Equal(t, context.Canceled, err)
+
+	assert.Equal(t, []string{"cpu,host=a#!~#idle", "disk,host=a#!~#free", "mem,host=a#!~#used"}, readTestTSMKeys(t, tsmPath))
+
+	_, err = os.Stat(tsmPath + ".rewriting")
+	assert.True(t, os.IsNotExist(err))
+
+	// The fields index is rebuilt from the untouched file
+	index, err := storage.ReadFieldsIndex(filepath.Join(filepath.Dir(tsmPath), storage.FieldsIndexFileName))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]map[string]influxql.DataType{
+		"cpu":  {"idle": influxql.Float},
+		"disk": {"free": influxql.Float},
+		"mem":  {"used": influxql.Float},
+	}, index)
+}
+
+func TestRun_ShouldPreserveOwnership(t *testing.T) {
+	dir, tsmPath := newTestShard(t)
+	defer os.RemoveAll(dir)
+
+	// The rule saves the fields index before it is rebuilt, its ownership must be kept all the same
+	fieldsIndexPath := filepath.Join(filepath.Dir(tsmPath), storage.FieldsIndexFileName)
+	fs, err := tsdb.NewMeasurementFieldSet(fieldsIndexPath)
+	assert.NoError(t, err)
+	for _, measurement := range []string{"cpu", "disk", "mem"} {
+		assert.NoError(t, fs.CreateFieldsIfNotExists([]byte(measurement)).CreateFieldIfNotExists([]byte("value"), influxql.Float))
+	}
+	assert.NoError(t, fs.Save())
+	fs.Close()
+
+	assert.NoError(t, os.Chmod(tsmPath, 0600))
+	assert.NoError(t, os.Chmod(fieldsIndexPath, 0600))
+
+	before := make(map[string]storage.Ownership)
+	for _, path := range []string{tsmPath, fieldsIndexPath} {
+		before[path], err = storage.ReadOwnership(path)
+		assert.NoError(t, err)
+	}
+
+	err = Run(context.Background(), Options{
+		DataDir:           filepath.Join(dir, "data"),
+		WALDir:            filepath.Join(dir, "wal"),
+		PreserveOwnership: true,
+		Rules:             []rules.Rule{rules.NewDropMeasurement("disk")},
+	})
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{"cpu,host=a#!~#idle", "mem,host=a#!~#used"}, readTestTSMKeys(t, tsmPath))
+
+	for path, o := range before {
+		after, err := storage.ReadOwnership(path)
+		assert.NoError(t, err)
+		assert.Equal(t, o, after, path)
+	}
+}
+
+func TestRun_ShouldPreserveOwnershipOfMovedData(t *testing.T) {
+	dir, _ := newTestShard(t)
+	defer os.RemoveAll(dir)
+
+	dataDir := filepath.Join(dir, "data")
+	assert.NoError(t, os.Chmod(dataDir, 0750))
+	if os.Geteuid() == 0 {
+		assert.NoError(t, os.Chown(dataDir, 1234, 1234))
+	}
+	expected, err := storage.ReadOwnership(dataDir)
+	assert.NoError(t, err)
+
+	data := &meta.Data{MaxShardGroupID: 1, MaxShardID: 1, Databases: []meta.DatabaseInfo{
+		{Name: "telegraf", RetentionPolicies: []meta.RetentionPolicyInfo{{Name: "autogen", ShardGroupDuration: time.Hour}}},
+		{Name: "system", RetentionPolicies: []meta.RetentionPolicyInfo{{Name: "autogen", ShardGroupDuration: time.Hour}}},
+	}}
+
+	metaDir := filepath.Join(dir, "meta")
+	assert.NoError(t, os.MkdirAll(metaDir, 0755))
+	assert.NoError(t, storage.SaveMeta(metaDir, data))
+
+	err = Run(context.Background(), Options{
+		DataDir:               dataDir,
+		WALDir:                filepath.Join(dir, "wal"),
+		MetaDir:               metaDir,
+		Database:              "telegraf",
+		MoveMeasurements:      filter.NewIncludeFilter([]string{"disk"}),
+		MoveToDatabase:        "system",
+		MoveToRetentionPolicy: "autogen",
+		CopyMeasurements:      true,
+		PreserveOwnership:     true,
+	})
+	assert.NoError(t, err)
+
+	// Created directories and the files they hold get the ownership of the data directory
+	shPath := filepath.Join(dataDir, "system", "autogen", "2")
+	for _, path := range []string{filepath.Join(dataDir, "system"), filepath.Dir(shPath), shPath} {
+		o, err := storage.ReadOwnership(path)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, o)
+	}
+	for _, path := range []string{filepath.Join(shPath, "000000001-000000002.tsm"), filepath.Join(shPath, storage.FieldsIndexFileName)} {
+		o, err := storage.ReadOwnership(path)
+		assert.NoError(t, err)
+		assert.Equal(t, expected.UID, o.UID)
+		assert.Equal(t, expected.GID, o.GID)
+	}
+}
+
+func TestRun_ShouldRefuseToRunWhenInfluxdIsRunning(t *testing.T) {
+	dir, tsmPath := newTestShard(t)
+	defer os.RemoveAll(dir)
+
+	pidFile := filepath.Join(dir, "influxd.pid")
+	assert.NoError(t, ioutil.WriteFile(pidFile, []byte(strconv.Itoa(os.Getpid())), 0644))
+
+	opts := Options{
+		DataDir: filepath.Join(dir, "data"),
+		WALDir:  filepath.Join(dir, "wal"),
+		PIDFile: pidFile,
+		Rules:   []rules.Rule{rules.NewDropMeasurement("disk")},
+	}
+
+	assert.Error(t, Run(context.Background(), opts))
+	assert.Len(t, readTestTSMKeys(t, tsmPath), 3)
+
+	opts.IgnoreRunning = true
+	assert.NoError(t, Run(context.Background(), opts))
+	assert.Len(t, readTestTSMKeys(t, tsmPath), 2)
+}
+
+func TestRun_ShouldCheckDiskSpace(t *testing.T) {
+	dir, tsmPath := newTestShard(t)
+	defer os.RemoveAll(dir)
+
+	fi, err := os.Stat(tsmPath)
+	assert.NoError(t, err)
+
+	var checked []string
+	freeSpace = func(path string) (uint64, error) {
+		checked = append(checked, path)
+		return uint64(fi.Size()), nil
+	}
+	defer func() { freeSpace = storage.FreeSpace }()
+
+	var events []Event
+	opts := Options{
+		DataDir: filepath.Join(dir, "data"),
+		WALDir:  filepath.Join(dir, "wal"),
+		Rules:   []rules.Rule{rules.NewDropMeasurement("disk")},
+		OnEvent: func(e Event) { events = append(events, e) },
+	}
+
+	assert.Error(t, Run(context.Background(), opts))
+	assert.Equal(t, []string{filepath.Dir(tsmPath)}, checked)
+	assert.Len(t, readTestTSMKeys(t, tsmPath), 3)
+
+	opts.IgnoreDiskSpace = true
+	assert.NoError(t, Run(context.Background(), opts))
+	assert.Len(t, readTestTSMKeys(t, tsmPath), 2)
+
+	if assert.NotEmpty(t, events) {
+		assert.Equal(t, Warning, events[0].Type)
+	}
+}
+
+func TestCheckEstimates_ShouldCheckRemainingDirectoriesWhenUnsupported(t *testing.T) {
+	freeSpace = func(path string) (uint64, error) {
+		if path == "data" {
+			return 0, storage.ErrFreeSpaceUnsupported
+		}
+		return 1, nil
+	}
+	defer func() { freeSpace = storage.FreeSpace }()
+
+	e := &engine{}
+	err := e.checkEstimates(storage.ShardInfo{}, "shard 1", []spaceEstimate{{Dir: "data", Size: 2}, {Dir: "wal", Size: 2}})
+	assert.Error(t, err)
+}
+
+func TestRun_ShouldCheckDiskSpaceOfAllMirroredShards(t *testing.T) {
+	dir, tsmPath := newTestShard(t)
+	defer os.RemoveAll(dir)
+
+	sh2Path := filepath.Join(dir, "data", "telegraf", "autogen", "2")
+	assert.NoError(t, os.MkdirAll(sh2Path, 0755))
+	writeTestTSMFile(t, filepath.Join(sh2Path, filepath.Base(tsmPath)), "cpu,host=a#!~#idle", "disk,host=a#!~#free", "mem,host=a#!~#used")
+
+	fi, err := os.Stat(tsmPath)
+	assert.NoError(t, err)
+
+	// Enough for the rewritten copy of either shard, but not both
+	freeSpace = func(path string) (uint64, error) {
+		return uint64(3 * fi.Size()), nil
+	}
+	defer func() { freeSpace = storage.FreeSpace }()
+
+	outDataDir := filepath.Join(dir, "out", "data")
+	err = Run(context.Background(), Options{
+		DataDir:    filepath.Join(dir, "data"),
+		WALDir:     filepath.Join(dir, "wal"),
+		OutDataDir: outDataDir,
+		OutWALDir:  filepath.Join(dir, "out", "wal"),
+		Rules:      []rules.Rule{rules.NewDropMeasurement("disk")},
+	})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "2 shard(s): not enough disk space")
+	}
+
+	_, err = os.Stat(outDataDir)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestRun_ShouldWriteToOutputDirectories(t *testing.T) {
+	dir, tsmPath := newTestShard(t)
+	defer os.RemoveAll(dir)
+
+	shPath := filepath.Dir(tsmPath)
+	untouchedPath := filepath.Join(shPath, "000000002-000000001.tsm")
+	writeTestTSMFile(t, untouchedPath, "cpu,host=b#!~#idle")
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(shPath, "000000002-000000001.tombstone"), nil, 0644))
+
+	err := Run(context.Background(), Options{
+		DataDir:    filepath.Join(dir, "data"),
+		WALDir:     filepath.Join(dir, "wal"),
+		OutDataDir: filepath.Join(dir, "out", "data"),
+		OutWALDir:  filepath.Join(dir, "out", "wal"),
+		Rules:      []rules.Rule{rules.NewDropMeasurement("disk")},
+	})
+	assert.NoError(t, err)
+
+	// Source files are left untouched
+	assert.Len(t, readTestTSMKeys(t, tsmPath), 3)
+	_, err = os.Stat(filepath.Join(shPath, storage.FieldsIndexFileName))
+	assert.True(t, os.IsNotExist(err))
+
+	outPath := filepath.Join(dir, "out", "data", "telegraf", "autogen", "1")
+	assert.Equal(t, []string{"cpu,host=a#!~#idle", "mem,host=a#!~#used"}, readTestTSMKeys(t, filepath.Join(outPath, filepath.Base(tsmPath))))
+
+	// Untouched TSM files are hard linked, other files are copied
+	source, err := os.Stat(untouchedPath)
+	assert.NoError(t, err)
+	linked, err := os.Stat(filepath.Join(outPath, filepath.Base(untouchedPath)))
+	assert.NoError(t, err)
+	assert.True(t, os.SameFile(source, linked))
+
+	_, err = os.Stat(filepath.Join(outPath, "000000002-000000001.tombstone"))
+	assert.NoError(t, err)
+
+	index, err := storage.ReadFieldsIndex(filepath.Join(outPath, storage.FieldsIndexFileName))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]map[string]influxql.DataType{
+		"cpu": {"idle": influxql.Float},
+		"mem": {"used": influxql.Float},
+	}, index)
+
+	_, err = os.Stat(filepath.Join(dir, "out", "wal", "telegraf", "autogen", "1"))
+	assert.NoError(t, err)
+}
+
+func TestRun_ShouldNotWriteUnreadableFieldsIndexToSourceDirectory(t *testing.T) {
+	dir, tsmPath := newTestShard(t)
+	defer os.RemoveAll(dir)
+
+	fieldsIndexPath := filepath.Join(filepath.Dir(tsmPath), storage.FieldsIndexFileName)
+	assert.NoError(t, ioutil.WriteFile(fieldsIndexPath, []byte("corrupt"), 0644))
+
+	err := Run(context.Background(), Options{
+		DataDir:    filepath.Join(dir, "data"),
+		WALDir:     filepath.Join(dir, "wal"),
+		OutDataDir: filepath.Join(dir, "out", "data"),
+		OutWALDir:  filepath.Join(dir, "out", "wal"),
+		Rules:      []rules.Rule{rules.NewDropMeasurement("disk")},
+	})
+	assert.NoError(t, err)
+
+	// The rule saves the index it has been given, which must be the copy
+	content, err := ioutil.ReadFile(fieldsIndexPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "corrupt", string(content))
+}
+
+func TestRun_ShouldProcessBackup(t *testing.T) {
+	dir, tsmPath := newTestShard(t)
+	defer os.RemoveAll(dir)
+
+	backupDir := filepath.Join(dir, "backup")
+	assert.NoError(t, os.MkdirAll(backupDir, 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(backupDir, "20210301T000000Z.meta"), []byte("meta"), 0600))
+
+	manifest := backup_util.Manifest{Meta: backup_util.MetaEntry{FileName: "20210301T000000Z.meta", Size: 4}}
+	for _, id := range []uint64{1, 2} {
+		entry := backup_util.Entry{Database: "telegraf", Policy: "autogen", ShardID: id, FileName: fmt.Sprintf("20210301T000000Z.s%d.tar.gz", id)}
+		if id == 2 {
+			shPath := filepath.Join(dir, "data", "telegraf", "autogen", "2")
+			assert.NoError(t, os.MkdirAll(shPath, 0755))
+			writeTestTSMFile(t, filepath.Join(shPath, filepath.Base(tsmPath)), "cpu,host=b#!~#idle", "disk,host=b#!~#free")
+		}
+		size, err := storage.WriteShardArchive(filepath.Join(dir, "data"), storage.ShardPath(entry), filepath.Join(backupDir, entry.FileName))
+		assert.NoError(t, err)
+		entry.Size = size
+		manifest.Files = append(manifest.Files, entry)
+	}
+	assert.NoError(t, manifest.Save(filepath.Join(backupDir, "20210301T000000Z.manifest")))
+
+	outDir := filepath.Join(dir, "out")
+	err := Run(context.Background(), Options{
+		BackupDir:    backupDir,
+		OutBackupDir: outDir,
+		Shard:        "2",
+		Rules:        []rules.Rule{rules.NewDropMeasurement("disk")},
+	})
+	assert.NoError(t, err)
+
+	out, err := storage.LoadBackup(outDir)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(4), out.Meta.Size)
+	if !assert.Len(t, out.Files, 2) {
+		return
+	}
+
+	extracted := filepath.Join(dir, "extracted")
+	for _, f := range out.Files {
+		assert.NoError(t, storage.ExtractShardArchive(filepath.Join(outDir, f.FileName), extracted))
+	}
+
+	// Only the selected shard is processed, the other one is copied as is
+	assert.Len(t, readTestTSMKeys(t, filepath.Join(extracted, "telegraf", "autogen", "1", filepath.Base(tsmPath))), 3)
+	assert.Equal(t, []string{"cpu,host=b#!~#idle"}, readTestTSMKeys(t, filepath.Join(extracted, "telegraf", "autogen", "2", filepath.Base(tsmPath))))
+
+	// Temporary files are removed
+	entries, err := ioutil.ReadDir(outDir)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 4)
+
+	// The output directory cannot be reused
+	assert.Error(t, Run(context.Background(), Options{BackupDir: backupDir, OutBackupDir: outDir}))
+}
+
+func TestRun_ShouldMergeShards(t *testing.T) {
+	dir, tsmPath := newTestShard(t)
+	defer os.RemoveAll(dir)
+
+	day := time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)
+
+	data := &meta.Data{Databases: []meta.DatabaseInfo{{
+		Name:              "telegraf",
+		RetentionPolicies: []meta.RetentionPolicyInfo{{Name: "autogen", ShardGroupDuration: time.Hour}},
+	}}}
+	rp := &data.Databases[0].RetentionPolicies[0]
+	for id, start := range map[uint64]time.Time{1: day, 2: day.Add(time.Hour), 3: day.Add(24 * time.Hour)} {
+		rp.ShardGroups = append(rp.ShardGroups, meta.ShardGroupInfo{ID: id, StartTime: start, EndTime: start.Add(time.Hour),
+			Shards: []meta.ShardInfo{{ID: id}}})
+
+		if id != 1 {
+			shPath := filepath.Join(dir, "data", "telegraf", "autogen", strconv.FormatUint(id, 10))
+			assert.NoError(t, os.MkdirAll(shPath, 0755))
+			writeTestTSMFile(t, filepath.Join(shPath, filepath.Base(tsmPath)), "cpu,host=b#!~#idle", "net,host=b#!~#bytes")
+		}
+	}
+
+	metaDir := filepath.Join(dir, "meta")
+	assert.NoError(t, os.MkdirAll(metaDir, 0755))
+	assert.NoError(t, storage.SaveMeta(metaDir, data))
+
+	opts := Options{
+		DataDir:                 filepath.Join(dir, "data"),
+		WALDir:                  filepath.Join(dir, "wal"),
+		MetaDir:                 metaDir,
+		Database:                "telegraf",
+		RetentionPolicy:         "autogen",
+		MergeShardGroupDuration: 24 * time.Hour,
+	}
+
+	// Shards spanning several new shard groups cannot be merged
+	assert.Error(t, Run(context.Background(), Options{DataDir: opts.DataDir, WALDir: opts.WALDir, MetaDir: metaDir,
+		Database: "telegraf", RetentionPolicy: "autogen", MergeShardGroupDuration: 30 * time.Minute}))
+
+	// Merges need the size of all their shards on the filesystem of the target shard
+	var checked []string
+	freeSpace = func(path string) (uint64, error) {
+		checked = append(checked, path)
+		return 1, nil
+	}
+	err := Run(context.Background(), opts)
+	freeSpace = storage.FreeSpace
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "not enough disk space")
+	}
+	assert.Equal(t, []string{filepath.Dir(tsmPath)}, checked)
+	assert.Len(t, readTestTSMKeys(t, tsmPath), 3)
+
+	var merged []uint64
+	opts.OnEvent = func(e Event) {
+		if e.Type == ShardsMerged {
+			merged = append(merged, e.Merged...)
+		}
+	}
+	assert.NoError(t, Run(context.Background(), opts))
+	assert.Equal(t, []uint64{2}, merged)
+
+	shPath := filepath.Dir(tsmPath)
+	_, err = os.Stat(filepath.Join(dir, "data", "telegraf", "autogen", "2"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(tsmPath)
+	assert.True(t, os.IsNotExist(err))
+
+	keys := readTestTSMKeys(t, filepath.Join(shPath, "000000002-000000002.tsm"))
+	assert.Equal(t, []string{"cpu,host=a#!~#idle", "cpu,host=b#!~#idle", "disk,host=a#!~#free", "mem,host=a#!~#used", "net,host=b#!~#bytes"}, keys)
+
+	index, err := storage.ReadFieldsIndex(filepath.Join(shPath, storage.FieldsIndexFileName))
+	assert.NoError(t, err)
+	assert.Contains(t, index, "net")
+
+	data, err = storage.LoadMeta(metaDir)
+	assert.NoError(t, err)
+	rp = &data.Databases[0].RetentionPolicies[0]
+	assert.Equal(t, 24*time.Hour, rp.ShardGroupDuration)
+	assert.Len(t, rp.ShardGroups, 3)
+	for _, sg := range rp.ShardGroups {
+		switch sg.ID {
+		case 1:
+			assert.Equal(t, day, sg.StartTime.UTC())
+			assert.Equal(t, day.Add(24*time.Hour), sg.EndTime.UTC())
+		case 2:
+			assert.True(t, sg.Deleted())
+		case 3:
+			assert.Equal(t, day.Add(48*time.Hour), sg.EndTime.UTC())
+		}
+	}
+
+	_, err = os.Stat(filepath.Join(metaDir, storage.MetaFileName+".bak"))
+	assert.NoError(t, err)
+}
+
+func TestRun_ShouldUpdateMetaOfCompletedMergesOnError(t *testing.T) {
+	dir, tsmPath := newTestShard(t)
+	defer os.RemoveAll(dir)
+
+	day := time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)
+
+	data := &meta.Data{Databases: []meta.DatabaseInfo{{
+		Name:              "telegraf",
+		RetentionPolicies: []meta.RetentionPolicyInfo{{Name: "autogen", ShardGroupDuration: time.Hour}},
+	}}}
+	rp := &data.Databases[0].RetentionPolicies[0]
+	for id, start := range map[uint64]time.Time{1: day, 2: day.Add(time.Hour), 3: day.Add(24 * time.Hour), 4: day.Add(25 * time.Hour)} {
+		rp.ShardGroups = append(rp.ShardGroups, meta.ShardGroupInfo{ID: id, StartTime: start, EndTime: start.Add(time.Hour),
+			Shards: []meta.ShardInfo{{ID: id}}})
+
+		if id != 1 {
+			shPath := filepath.Join(dir, "data", "telegraf", "autogen", strconv.FormatUint(id, 10))
+			assert.NoError(t, os.MkdirAll(shPath, 0755))
+			writeTestTSMFile(t, filepath.Join(shPath, filepath.Base(tsmPath)), "cpu,host=b#!~#idle")
+		}
+	}
+
+	// The second merge fails on an unreadable file
+	corruptPath := filepath.Join(dir, "data", "telegraf", "autogen", "4", "000000002-000000001.tsm")
+	assert.NoError(t, ioutil.WriteFile(corruptPath, []byte("corrupt"), 0644))
+
+	metaDir := filepath.Join(dir, "meta")
+	assert.NoError(t, os.MkdirAll(metaDir, 0755))
+	assert.NoError(t, storage.SaveMeta(metaDir, data))
+
+	err := Run(context.Background(), Options{
+		DataDir:                 filepath.Join(dir, "data"),
+		WALDir:                  filepath.Join(dir, "wal"),
+		MetaDir:                 metaDir,
+		Database:                "telegraf",
+		RetentionPolicy:         "autogen",
+		MergeShardGroupDuration: 24 * time.Hour,
+	})
+	assert.Error(t, err)
+
+	_, err = os.Stat(filepath.Join(dir, "data", "telegraf", "autogen", "2"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(corruptPath)
+	assert.NoError(t, err)
+
+	data, err = storage.LoadMeta(metaDir)
+	assert.NoError(t, err)
+	rp = &data.Databases[0].RetentionPolicies[0]
+	for _, sg := range rp.ShardGroups {
+		switch sg.ID {
+		case 1:
+			assert.Equal(t, day.Add(24*time.Hour), sg.EndTime.UTC())
+		case 2:
+			assert.True(t, sg.Deleted())
+		case 3, 4:
+			assert.False(t, sg.Deleted())
+		}
+	}
+}
+
+func TestRun_ShouldMoveMeasurements(t *testing.T) {
+	dir, tsmPath := newTestShard(t)
+	defer os.RemoveAll(dir)
+
+	data := &meta.Data{MaxShardGroupID: 1, MaxShardID: 1, Databases: []meta.DatabaseInfo{
+		{Name: "telegraf", RetentionPolicies: []meta.RetentionPolicyInfo{{Name: "autogen", ShardGroupDuration: time.Hour,
+			ShardGroups: []meta.ShardGroupInfo{{ID: 1, StartTime: time.Unix(0, 0), EndTime: time.Unix(3600, 0), Shards: []meta.ShardInfo{{ID: 1}}}}}}},
+		{Name: "system", RetentionPolicies: []meta.RetentionPolicyInfo{{Name: "autogen", ShardGroupDuration: 24 * time.Hour}}},
+	}}
+
+	metaDir := filepath.Join(dir, "meta")
+	assert.NoError(t, os.MkdirAll(metaDir, 0755))
+	assert.NoError(t, storage.SaveMeta(metaDir, data))
+
+	opts := Options{
+		DataDir:               filepath.Join(dir, "data"),
+		WALDir:                filepath.Join(dir, "wal"),
+		MetaDir:               metaDir,
+		Database:              "telegraf",
+		MoveMeasurements:      filter.NewIncludeFilter([]string{"disk", "mem"}),
+		MoveToDatabase:        "system",
+		MoveToRetentionPolicy: "autogen",
+	}
+
+	// The moved data is checked against the free space of the destination filesystem
+	var checked []string
+	freeSpace = func(path string) (uint64, error) {
+		checked = append(checked, path)
+		return 1, nil
+	}
+	err := Run(context.Background(), opts)
+	freeSpace = storage.FreeSpace
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "system.autogen: not enough disk space")
+	}
+	assert.Equal(t, []string{filepath.Join(dir, "data")}, checked)
+	assert.Len(t, readTestTSMKeys(t, tsmPath), 3)
+
+	var moved []string
+	opts.OnEvent = func(e Event) {
+		if e.Type == MeasurementsMoved {
+			assert.Equal(t, uint64(2), e.Shard.ID)
+			assert.True(t, e.Created)
+			moved = append(moved, e.Measurements...)
+		}
+	}
+	assert.NoError(t, Run(context.Background(), opts))
+	assert.Equal(t, []string{"disk", "mem"}, moved)
+
+	assert.Equal(t, []string{"cpu,host=a#!~#idle"}, readTestTSMKeys(t, tsmPath))
+
+	shPath := filepath.Join(dir, "data", "system", "autogen", "2")
+	assert.Equal(t, []string{"disk,host=a#!~#free", "mem,host=a#!~#used"}, readTestTSMKeys(t, filepath.Join(shPath, "000000001-000000002.tsm")))
+
+	index, err := storage.ReadFieldsIndex(filepath.Join(shPath, storage.FieldsIndexFileName))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]map[string]influxql.DataType{"disk": {"free": influxql.Float}, "mem": {"used": influxql.Float}}, index)
+
+	data, err = storage.LoadMeta(metaDir)
+	assert.NoError(t, err)
+	sg, err := data.ShardGroupByTimestamp("system", "autogen", time.Unix(0, 0))
+	assert.NoError(t, err)
+	if assert.NotNil(t, sg) {
+		assert.Equal(t, uint64(2), sg.Shards[0].ID)
+	}
+}
+
+func TestRun_ShouldCompactShards(t *testing.T) {
+	dir, tsmPath := newTestShard(t)
+	defer os.RemoveAll(dir)
+
+	shPath := filepath.Dir(tsmPath)
+	writeTestTSMFile(t, filepath.Join(shPath, "000000002-000000001.tsm"), "cpu,host=b#!~#idle")
+
+	opts := Options{DataDir: filepath.Join(dir, "data"), WALDir: filepath.Join(dir, "wal"), Compact: true, Check: true}
+	assert.NoError(t, Run(context.Background(), opts))
+
+	files, err := filepath.Glob(filepath.Join(shPath, "*.tsm"))
+	assert.NoError(t, err)
+	assert.Len(t, files, 2)
+
+	var compacted []string
+	opts.Check = false
+	opts.OnEvent = func(e Event) {
+		if e.Type == ShardCompacted {
+			compacted = append(compacted, e.Files...)
+		}
+	}
+	assert.NoError(t, Run(context.Background(), opts))
+
+	files, err = filepath.Glob(filepath.Join(shPath, "*.tsm"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{filepath.Join(shPath, "000000002-000000002.tsm")}, files)
+	assert.Equal(t, files, compacted)
+	assert.Len(t, readTestTSMKeys(t, files[0]), 4)
+
+	// A fully compacted shard is left untouched
+	compacted = nil
+	assert.NoError(t, Run(context.Background(), opts))
+	assert.Empty(t, compacted)
+}
+
+func writeTestWALFile(t *testing.T, path string, entries ...tsm1.WALEntry) {
+	assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+
+	f, err := os.Create(path)
+	assert.NoError(t, err)
+	defer f.Close()
+
+	w := tsm1.NewWALSegmentWriter(f)
+	for _, entry := range entries {
+		b, err := encodeWALEntry(entry)
+		assert.NoError(t, err)
+		assert.NoError(t, w.Write(entry.Type(), b))
+	}
+	assert.NoError(t, w.Flush())
+}
+
+func TestRun_ShouldFlushWAL(t *testing.T) {
+	dir, tsmPath := newTestShard(t)
+	defer os.RemoveAll(dir)
+
+	walPath := filepath.Join(dir, "wal", "telegraf", "autogen", "1", "_00001.wal")
+	writeTestWALFile(t, walPath,
+		&tsm1.WriteWALEntry{Values: map[string][]tsm1.Value{
+			"cpu,host=c#!~#idle":  {tsm1.NewFloatValue(0, 1.0)},
+			"net,host=c#!~#bytes": {tsm1.NewIntegerValue(0, 1)},
+		}},
+		&tsm1.DeleteRangeWALEntry{Keys: [][]byte{[]byte("net,host=c#!~#bytes")}, Min: 0, Max: 5},
+		&tsm1.WriteWALEntry{Values: map[string][]tsm1.Value{"net,host=c#!~#bytes": {tsm1.NewIntegerValue(10, 2)}}},
+	)
+
+	var flushed []string
+	err := Run(context.Background(), Options{
+		DataDir:  filepath.Join(dir, "data"),
+		WALDir:   filepath.Join(dir, "wal"),
+		FlushWAL: true,
+		OnEvent: func(e Event) {
+			if e.Type == WALFlushed {
+				flushed = append(flushed, e.Files...)
+			}
+		},
+	})
+	assert.NoError(t, err)
+
+	_, err = os.Stat(walPath)
+	assert.True(t, os.IsNotExist(err))
+
+	shPath := filepath.Dir(tsmPath)
+	if !assert.Len(t, flushed, 1) {
+		return
+	}
+	assert.Equal(t, shPath, filepath.Dir(flushed[0]))
+	assert.Equal(t, []string{"cpu,host=c#!~#idle", "net,host=c#!~#bytes"}, readTestTSMKeys(t, flushed[0]))
+	assert.Len(t, readTestTSMKeys(t, tsmPath), 3)
+
+	f, err := os.Open(flushed[0])
+	assert.NoError(t, err)
+	r, err := tsm1.NewTSMReader(f)
+	assert.NoError(t, err)
+	defer r.Close()
+
+	// Deletes only apply to the values written before them
+	values, err := r.ReadAll([]byte("net,host=c#!~#bytes"))
+	assert.NoError(t, err)
+	assert.Equal(t, []tsm1.Value{tsm1.NewIntegerValue(10, 2)}, values)
+
+	index, err := storage.ReadFieldsIndex(filepath.Join(shPath, storage.FieldsIndexFileName))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]map[string]influxql.DataType{"cpu": {"idle": influxql.Float}, "net": {"bytes": influxql.Integer}}, index)
+}
+
+func TestRun_ShouldListOldSeriesFromTSMAndWAL(t *testing.T) {
+	dir, _ := newTestShard(t)
+	defer os.RemoveAll(dir)
+
+	writeTestWALFile(t, filepath.Join(dir, "wal", "telegraf", "autogen", "1", "_00001.wal"),
+		&tsm1.WriteWALEntry{Values: map[string][]tsm1.Value{"mem,host=a#!~#used": {tsm1.NewFloatValue(100, 1.0)}}},
+	)
+
+	var out bytes.Buffer
+	rule, err := rules.NewOldSerieRule(time.Unix(0, 50), false, &out, "text")
+	assert.NoError(t, err)
+
+	err = Run(context.Background(), Options{
+		DataDir: filepath.Join(dir, "data"),
+		WALDir:  filepath.Join(dir, "wal"),
+		Rules:   []rules.Rule{rule},
+	})
+	assert.NoError(t, err)
+
+	// The recent WAL value of mem keeps it from being old
+	assert.Equal(t, "cpu,host=a\ndisk,host=a\n", out.String())
+}
+
+func TestRun_ShouldDropOldSeriesAcrossShards(t *testing.T) {
+	dir, tsmPath := newTestShard(t)
+	defer os.RemoveAll(dir)
+
+	sh2Path := filepath.Join(dir, "data", "telegraf", "autogen", "2")
+	assert.NoError(t, os.MkdirAll(sh2Path, 0755))
+	tsm2Path := filepath.Join(sh2Path, "000000001-000000001.tsm")
+	writeTestTSMFile(t, tsm2Path, "cpu,host=a#!~#idle", "cpu,host=b#!~#idle")
+
+	// Shards out of the scope of the rule are not scanned, a recent value there does not keep a serie
+	sh3Path := filepath.Join(dir, "data", "other", "autogen", "3")
+	assert.NoError(t, os.MkdirAll(sh3Path, 0755))
+	writeTestWALFile(t, filepath.Join(dir, "wal", "other", "autogen", "3", "_00001.wal"),
+		&tsm1.WriteWALEntry{Values: map[string][]tsm1.Value{"cpu,host=a#!~#idle": {tsm1.NewFloatValue(100, 1.0)}}},
+	)
+
+	// Recent values of the WAL keep their series, even when they are not the last values of an entry
+	writeTestWALFile(t, filepath.Join(dir, "wal", "telegraf", "autogen", "1", "_00001.wal"),
+		&tsm1.WriteWALEntry{Values: map[string][]tsm1.Value{"mem,host=a#!~#used": {tsm1.NewFloatValue(100, 1.0)}}},
+	)
+	writeTestWALFile(t, filepath.Join(dir, "wal", "telegraf", "autogen", "2", "_00001.wal"),
+		&tsm1.WriteWALEntry{Values: map[string][]tsm1.Value{
+			"disk,host=a#!~#free": {tsm1.NewFloatValue(100, 1.0)},
+			"cpu,host=b#!~#idle":  {tsm1.NewFloatValue(100, 1.0), tsm1.NewFloatValue(10, 1.0)},
+		}},
+	)
+
+	var out bytes.Buffer
+	rule, err := rules.NewDropOldSerieRule(time.Unix(0, 50), false, &out, "text")
+	assert.NoError(t, err)
+
+	err = Run(context.Background(), Options{
+		DataDir: filepath.Join(dir, "data"),
+		WALDir:  filepath.Join(dir, "wal"),
+		Rules:   []rules.Rule{rules.NewScopedRule(rule, &rules.Scope{Database: filter.NewIncludeFilter([]string{"telegraf"})})},
+	})
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{"disk,host=a#!~#free", "mem,host=a#!~#used"}, readTestTSMKeys(t, tsmPath))
+	assert.Equal(t, []string{"cpu,host=b#!~#idle"}, readTestTSMKeys(t, tsm2Path))
+	assert.Equal(t, "cpu,host=a\n", out.String())
+
+	_, err = os.Stat(filepath.Join(dir, "wal", "other", "autogen", "3", "_00001.wal"))
+	assert.NoError(t, err)
+}
+
+func TestOptions_ShouldValidate(t *testing.T) {
+	assert.NoError(t, (&Options{}).Validate())
+	assert.Error(t, (&Options{RetentionPolicy: "autogen"}).Validate())
+	assert.Error(t, (&Options{OutDataDir: "/out/data"}).Validate())
+	assert.Error(t, (&Options{DataDir: "/data", OutDataDir: "/data/", OutWALDir: "/out/wal"}).Validate())
+	assert.NoError(t, (&Options{DataDir: "/data", OutDataDir: "/out/data", OutWALDir: "/out/wal"}).Validate())
+	assert.Error(t, (&Options{Database: "telegraf", RetentionPolicy: "autogen", MergeShardGroupDuration: time.Hour}).Validate())
+	assert.NoError(t, (&Options{Database: "telegraf", RetentionPolicy: "autogen", MetaDir: "/meta", MergeShardGroupDuration: time.Hour}).Validate())
+	move := filter.NewIncludeFilter([]string{"cpu"})
+	assert.Error(t, (&Options{Database: "telegraf", MetaDir: "/meta", MoveMeasurements: move, MoveToDatabase: "telegraf", MoveToRetentionPolicy: "autogen"}).Validate())
+	assert.NoError(t, (&Options{Database: "telegraf", MetaDir: "/meta", MoveMeasurements: move, MoveToDatabase: "system", MoveToRetentionPolicy: "autogen"}).Validate())
+	drop, err := rules.NewDropOldSerieRule(time.Unix(0, 0), false, &bytes.Buffer{}, "text")
+	assert.NoError(t, err)
+	assert.NoError(t, (&Options{Database: "telegraf", Rules: []rules.Rule{drop}}).Validate())
+	assert.Error(t, (&Options{Shard: "1", Rules: []rules.Rule{drop}}).Validate())
+	assert.Error(t, (&Options{TimeRange: storage.TimeRange{Start: time.Unix(0, 0)}, Rules: []rules.Rule{rules.NewScopedRule(drop, &rules.Scope{})}}).Validate())
+}
+
+func TestOptions_ShouldDefaultCompactThroughputBurstToThroughput(t *testing.T) {
+	opts := Options{CompactThroughput: 200}.withDefaults()
+	assert.Equal(t, uint64(200), opts.CompactThroughputBurst)
+
+	opts = Options{CompactThroughput: 200, CompactThroughputBurst: 400}.withDefaults()
+	assert.Equal(t, uint64(400), opts.CompactThroughputBurst)
+
+	// No rate limiting
+	opts = Options{}.withDefaults()
+	assert.Equal(t, uint64(0), opts.CompactThroughput)
+}
@@ -0,0 +1,96 @@
+package engine
+
+import (
+	"github.com/Abc-Arbitrage/infix/storage"
+)
+
+// EventType defines the type of an Event
+type EventType int
+
+const (
+	// ShardStarted is sent before processing a shard
+	ShardStarted EventType = iota
+	// TSMFileStarted is sent before processing a TSM file
+	TSMFileStarted
+	// WALFileStarted is sent before processing a WAL file
+	WALFileStarted
+	// FieldsIndexChecked is sent with the differences between the fields index of a shard and its keys when
+	// rebuilding fields indexes. Err is set when the existing index could not be read
+	FieldsIndexChecked
+	// WALRangesLost is sent with the corrupt byte ranges of a WAL file skipped when repairing it
+	WALRangesLost
+	// Warning is sent with a problem that does not stop the run
+	Warning
+	// ShardsMerged is sent before merging shards into Shard, the shard group of which then spans TimeRange
+	ShardsMerged
+	// MetaUpdated is sent once the meta store has been saved with the merged or created shard groups
+	MetaUpdated
+	// MeasurementsMoved is sent with the measurements moved to Shard, the shard group of which spans TimeRange. Created
+	// is set when the shard group is created
+	MeasurementsMoved
+	// ShardCompacted is sent once the TSM files of Shard have been compacted into Files, which is empty in check mode
+	ShardCompacted
+	// WALFlushed is sent once the WAL segments of Shard have been flushed into Files, which is empty in check mode
+	WALFlushed
+)
+
+// String implements Stringer interface
+func (t EventType) String() string {
+	switch t {
+	case ShardStarted:
+		return "shard started"
+	case TSMFileStarted:
+		return "TSM file started"
+	case WALFileStarted:
+		return "WAL file started"
+	case FieldsIndexChecked:
+		return "fields index checked"
+	case WALRangesLost:
+		return "WAL ranges lost"
+	case Warning:
+		return "warning"
+	case ShardsMerged:
+		return "shards merged"
+	case MetaUpdated:
+		return "meta updated"
+	case MeasurementsMoved:
+		return "measurements moved"
+	case ShardCompacted:
+		return "shard compacted"
+	case WALFlushed:
+		return "WAL flushed"
+	default:
+		return "unknown"
+	}
+}
+
+// Event describes a step or a problem of a run
+type Event struct {
+	Type  EventType
+	Shard storage.ShardInfo
+	// Path is the file the event relates to, if any
+	Path string
+	Err  error
+
+	Changes []storage.FieldsIndexChange
+	Lost    []storage.WALByteRange
+
+	// Merged are the IDs of the shards merged into Shard, TimeRange the bounds of its new shard group
+	Merged    []uint64
+	TimeRange storage.TimeRange
+
+	// Measurements are the measurements moved to Shard, Created is set when its shard group has been created
+	Measurements []string
+	Created      bool
+
+	// Files are the TSM files written for Shard
+	Files []string
+}
+
+// Progress reports the number of keys processed in a TSM file
+type Progress struct {
+	Shard storage.ShardInfo
+	Path  string
+	Done  int
+	Total int
+}
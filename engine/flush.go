@@ -0,0 +1,210 @@
+package engine
+
+import (
+	"context"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/Abc-Arbitrage/infix/storage"
+	"github.com/influxdata/influxdb/tsdb/engine/tsm1"
+)
+
+// flushWAL writes the WAL segments of the selected shards to new TSM files, as influxd does when replaying them, and
+// removes them. A shard is left untouched if its WAL cannot be flushed entirely
+func (e *engine) flushWAL(ctx context.Context) error {
+	e.detectEngineDir()
+
+	if err := e.checkNotRunning(); err != nil {
+		return err
+	}
+
+	shards, err := e.loadShards()
+	if err != nil {
+		return err
+	}
+
+	shards, err = e.filterShardsWithMeta(shards)
+	if err != nil {
+		return err
+	}
+
+	if err := e.checkDiskSpace(shards); err != nil {
+		return err
+	}
+
+	for _, sh := range shards {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if len(sh.WalFiles) == 0 {
+			continue
+		}
+
+		if err := e.flushShardWAL(ctx, sh); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// flushShardWAL replays the WAL segments of a shard in order into a rewriter, then adds the written TSM files to the
+// shard, updates its fields index and removes the segments
+func (e *engine) flushShardWAL(ctx context.Context, info storage.ShardInfo) error {
+	e.emit(Event{Type: ShardStarted, Shard: info})
+
+	var w *storage.CachedTSMRewriter
+	if !e.Check {
+		outputDir := filepath.Join(info.Path, "flushing")
+		if err := os.RemoveAll(outputDir); err != nil {
+			return err
+		}
+		if err := os.Mkdir(outputDir, os.ModePerm); err != nil {
+			return err
+		}
+
+		w = e.newCachedTSMRewriter(outputDir)
+		defer w.Close()
+	}
+
+	fields := storage.NewFieldTracker()
+
+	walFiles := info.WalFiles
+	sort.Strings(walFiles)
+
+	for _, path := range walFiles {
+		if err := e.replayWALFile(ctx, info, path, w, fields); err != nil {
+			return err
+		}
+	}
+
+	if e.Check {
+		e.emit(Event{Type: WALFlushed, Shard: info})
+		return nil
+	}
+
+	if err := w.WriteSnapshot(); err != nil {
+		return err
+	}
+
+	files, err := w.CompactFull()
+	if err != nil {
+		return err
+	}
+
+	// New files get a generation above the existing ones so that their values take precedence, as the ones of the
+	// cache of influxd
+	generation := 0
+	for _, path := range info.TsmFiles {
+		if g, _, err := tsm1.DefaultParseFileName(path); err == nil && g > generation {
+			generation = g
+		}
+	}
+
+	var tsmFiles []string
+	for _, f := range files {
+		_, sequence, err := tsm1.DefaultParseFileName(f)
+		if err != nil {
+			return err
+		}
+
+		path := filepath.Join(info.Path, tsm1.DefaultFormatFileName(generation+1, sequence)+"."+tsm1.TSMFileExtension)
+		log.Printf("Renaming '%s' to '%s'", f, path)
+		if err := e.replaceFile(path, path, func() error { return os.Rename(f, path) }); err != nil {
+			return err
+		}
+		tsmFiles = append(tsmFiles, path)
+	}
+
+	fieldsIndexPath := filepath.Join(info.Path, storage.FieldsIndexFileName)
+	if info.FieldsIndexErr != nil {
+		// Saving the index would replace the unreadable file with the fields of the WAL only
+		e.warn(info, fieldsIndexPath, "shard %d: unable to load fields index, use -rebuild-field-index to regenerate it: %v", info.ID, info.FieldsIndexErr)
+	} else {
+		if err := fields.AddTo(info.FieldsIndex); err != nil {
+			return err
+		}
+		if err := e.replaceFile(fieldsIndexPath, fieldsIndexPath, info.FieldsIndex.Save); err != nil {
+			return err
+		}
+	}
+
+	for _, path := range walFiles {
+		log.Printf("Removing flushed WAL file '%s'", path)
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+
+	e.emit(Event{Type: WALFlushed, Shard: info, Files: tsmFiles})
+	return nil
+}
+
+// replayWALFile writes the entries of a WAL segment to a rewriter, which is nil in check mode. As when influxd replays
+// it, entries past a corruption point are discarded
+func (e *engine) replayWALFile(ctx context.Context, info storage.ShardInfo, path string, w *storage.CachedTSMRewriter, fields *storage.FieldTracker) error {
+	e.emit(Event{Type: WALFileStarted, Shard: info, Path: path})
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r, err := e.createWALReader(f)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	count := 0
+	for r.Next() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		entry, err := r.Read()
+		if err != nil {
+			e.warn(info, path, "file %s corrupt at position %d: %v", path, r.Count(), err)
+			e.warn(info, path, "entries after position %d will be discarded, use -repair-wal to salvage them", r.Count())
+			break
+		}
+		count++
+
+		if w == nil {
+			continue
+		}
+
+		switch t := entry.(type) {
+		case *tsm1.WriteWALEntry:
+			for key, values := range t.Values {
+				if err := w.Write([]byte(key), values); err != nil {
+					return err
+				}
+				fields.AddValues([]byte(key), values)
+			}
+		case *tsm1.DeleteRangeWALEntry:
+			if err := w.DeleteRange(t.Keys, t.Min, t.Max); err != nil {
+				return err
+			}
+		case *tsm1.DeleteWALEntry:
+			if err := w.DeleteRange(t.Keys, math.MinInt64, math.MaxInt64); err != nil {
+				return err
+			}
+		}
+	}
+
+	log.Printf("%d entries", count)
+
+	if rr, ok := r.(*storage.WALRepairReader); ok {
+		if lost := rr.Lost(); len(lost) > 0 {
+			e.emit(Event{Type: WALRangesLost, Shard: info, Path: path, Lost: lost})
+		}
+	}
+
+	return nil
+}
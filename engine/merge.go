@@ -0,0 +1,306 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/Abc-Arbitrage/infix/storage"
+	"github.com/influxdata/influxdb/services/meta"
+	"github.com/influxdata/influxdb/tsdb/engine/tsm1"
+)
+
+// shardMerge describes the shards of a shard group of the new duration. Sources are merged into Target, which
+// holds the lowest shard ID
+type shardMerge struct {
+	Group   storage.TimeRange
+	Target  storage.ShardInfo
+	Sources []storage.ShardInfo
+}
+
+// runMerge merges the shards of a retention policy into shard groups of MergeShardGroupDuration, then updates the
+// shard groups of the meta store. When canceled, the meta store is updated with the merges done so far
+func (e *engine) runMerge(ctx context.Context) error {
+	if err := e.checkNotRunning(); err != nil {
+		return err
+	}
+
+	shards, err := e.loadShards()
+	if err != nil {
+		return err
+	}
+
+	data, err := storage.LoadMeta(e.MetaDir)
+	if err != nil {
+		return err
+	}
+	storage.AttachMeta(shards, data)
+
+	merges, err := planMerges(shards, e.MergeShardGroupDuration)
+	if err != nil {
+		return err
+	}
+
+	if err := e.checkMergeSpace(merges); err != nil {
+		return err
+	}
+
+	var done []shardMerge
+	for _, m := range merges {
+		if err = ctx.Err(); err != nil {
+			break
+		}
+
+		var merged []uint64
+		for _, sh := range m.Sources {
+			merged = append(merged, sh.ID)
+		}
+		e.emit(Event{Type: ShardsMerged, Shard: m.Target, Merged: merged, TimeRange: m.Group})
+
+		if e.Check {
+			continue
+		}
+
+		if err = e.mergeShards(ctx, m); err != nil {
+			break
+		}
+		done = append(done, m)
+	}
+
+	// The source shards of completed merges are gone, they are recorded in the meta store even if a later merge failed
+	if e.Check || len(done) == 0 {
+		return err
+	}
+
+	if err := e.updateMergedMeta(data, done); err != nil {
+		return err
+	}
+	return err
+}
+
+// planMerges groups shards by shard group of the given duration. Each shard must fit in a single new shard group
+func planMerges(shards []storage.ShardInfo, duration time.Duration) ([]shardMerge, error) {
+	groups := make(map[time.Time]*shardMerge)
+
+	sort.Slice(shards, func(i, j int) bool {
+		return shards[i].ID < shards[j].ID
+	})
+
+	for _, sh := range shards {
+		if sh.Meta == nil {
+			return nil, fmt.Errorf("shard %d not found in meta store", sh.ID)
+		}
+		if len(sh.WalFiles) > 0 {
+			return nil, fmt.Errorf("shard %d has WAL segments, they must be flushed to TSM files before merging shards", sh.ID)
+		}
+
+		start := sh.Meta.StartTime.Truncate(duration)
+		if sh.Meta.EndTime.Add(-1).Truncate(duration) != start {
+			return nil, fmt.Errorf("shard %d: shard group [%s, %s) spans several shard groups of %s", sh.ID,
+				sh.Meta.StartTime.Format(time.RFC3339), sh.Meta.EndTime.Format(time.RFC3339), duration)
+		}
+
+		if m, ok := groups[start]; ok {
+			m.Sources = append(m.Sources, sh)
+			continue
+		}
+		groups[start] = &shardMerge{Group: storage.TimeRange{Start: start, End: start.Add(duration)}, Target: sh}
+	}
+
+	var merges []shardMerge
+	for _, m := range groups {
+		merges = append(merges, *m)
+	}
+
+	sort.Slice(merges, func(i, j int) bool {
+		return merges[i].Group.Start.Before(merges[j].Group.Start)
+	})
+
+	return merges, nil
+}
+
+// mergeShards writes the data of all the shards of a merge to new TSM files in the target shard, rebuilds its fields
+// index and removes the source shards. The target shard is left untouched if the merge fails or is canceled
+func (e *engine) mergeShards(ctx context.Context, m shardMerge) error {
+	if len(m.Sources) == 0 {
+		return nil
+	}
+
+	outputDir := filepath.Join(m.Target.Path, "merging")
+	if err := os.RemoveAll(outputDir); err != nil {
+		return err
+	}
+	if err := os.Mkdir(outputDir, os.ModePerm); err != nil {
+		return err
+	}
+
+	w := e.newCachedTSMRewriter(outputDir)
+	defer w.Close()
+
+	fields := storage.NewFieldTracker()
+
+	for _, sh := range append([]storage.ShardInfo{m.Target}, m.Sources...) {
+		tsmFiles := sh.TsmFiles
+		sort.Strings(tsmFiles)
+
+		for _, path := range tsmFiles {
+			e.emit(Event{Type: TSMFileStarted, Shard: sh, Path: path})
+			if err := e.copyTSMFile(ctx, sh, path, w, fields); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := w.WriteSnapshot(); err != nil {
+		return err
+	}
+
+	files, err := w.CompactFull()
+	if err != nil {
+		return err
+	}
+
+	// New files get a generation above the existing ones so that data is duplicated rather than lost if interrupted
+	// before the previous files are removed
+	generation := 0
+	for _, path := range m.Target.TsmFiles {
+		if g, _, err := tsm1.DefaultParseFileName(path); err == nil && g > generation {
+			generation = g
+		}
+	}
+
+	for _, f := range files {
+		_, sequence, err := tsm1.DefaultParseFileName(f)
+		if err != nil {
+			return err
+		}
+
+		path := filepath.Join(m.Target.Path, tsm1.DefaultFormatFileName(generation+1, sequence)+"."+tsm1.TSMFileExtension)
+		log.Printf("Renaming '%s' to '%s'", f, path)
+		if err := e.replaceFile(path, path, func() error { return os.Rename(f, path) }); err != nil {
+			return err
+		}
+	}
+
+	for _, path := range m.Target.TsmFiles {
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		if err := os.RemoveAll(storage.TombstonePath(path)); err != nil {
+			return err
+		}
+	}
+
+	fieldsIndexPath := filepath.Join(m.Target.Path, storage.FieldsIndexFileName)
+	if err := e.replaceFile(fieldsIndexPath, fieldsIndexPath, func() error {
+		return fields.Rebuild(fieldsIndexPath, m.Target.FieldsIndex)
+	}); err != nil {
+		return err
+	}
+
+	// The TSI index of the target shard is removed so that influx_inspect buildtsi rebuilds it
+	if err := os.RemoveAll(filepath.Join(m.Target.Path, "index")); err != nil {
+		return err
+	}
+
+	for _, sh := range m.Sources {
+		log.Printf("shard %d: removing '%s' and '%s'", sh.ID, sh.Path, sh.WALPath)
+		if err := os.RemoveAll(sh.Path); err != nil {
+			return err
+		}
+		if err := os.RemoveAll(sh.WALPath); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// copyTSMFile writes all the keys of a TSM file to a rewriter
+func (e *engine) copyTSMFile(ctx context.Context, info storage.ShardInfo, path string, w storage.TSMRewriter, fields *storage.FieldTracker) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r, err := tsm1.NewTSMReader(f)
+	if err != nil {
+		return fmt.Errorf("unable to read %s: %v", path, err)
+	}
+	defer r.Close()
+
+	keyCount := r.KeyCount()
+	for i := 0; i < keyCount; i++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		key, _ := r.KeyAt(i)
+		e.progress(info, path, i+1, keyCount)
+
+		values, err := r.ReadAll(key)
+		if err != nil {
+			return fmt.Errorf("unable to read key %q in %s: %v", string(key), path, err)
+		}
+
+		if err := w.Write(key, values); err != nil {
+			return err
+		}
+		fields.AddValues(key, values)
+	}
+
+	return nil
+}
+
+// updateMergedMeta sets the shard groups of merged shards to the new shard group bounds, deletes the shard groups they
+// now cover and sets the new shard group duration of the retention policy
+func (e *engine) updateMergedMeta(data *meta.Data, merges []shardMerge) error {
+	rp, err := data.RetentionPolicy(e.Database, e.RetentionPolicy)
+	if err != nil {
+		return err
+	} else if rp == nil {
+		return fmt.Errorf("retention policy '%s' not found in meta store", e.RetentionPolicy)
+	}
+
+	rp.ShardGroupDuration = e.MergeShardGroupDuration
+
+	for _, m := range merges {
+		for i := range rp.ShardGroups {
+			sg := &rp.ShardGroups[i]
+			if sg.ID == m.Target.Meta.GroupID {
+				sg.StartTime = m.Group.Start
+				sg.EndTime = m.Group.End
+			}
+		}
+	}
+
+	// Shard groups starting within a merged shard group, the ones of merged shards or without any shard on disk, are
+	// deleted so that shard groups do not overlap
+	for _, m := range merges {
+		for _, sg := range rp.ShardGroups {
+			if sg.Deleted() || sg.ID == m.Target.Meta.GroupID {
+				continue
+			}
+			if !sg.StartTime.Before(m.Group.Start) && sg.StartTime.Before(m.Group.End) {
+				if err := data.DeleteShardGroup(e.Database, e.RetentionPolicy, sg.ID); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	sort.Sort(meta.ShardGroupInfos(rp.ShardGroups))
+
+	path := filepath.Join(e.MetaDir, storage.MetaFileName)
+	if err := e.replaceFile(path, path, func() error { return storage.SaveMeta(e.MetaDir, data) }); err != nil {
+		return err
+	}
+
+	e.emit(Event{Type: MetaUpdated, Path: path})
+	return nil
+}
@@ -0,0 +1,131 @@
+package engine
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Abc-Arbitrage/infix/storage"
+	"github.com/influxdata/influxdb/tsdb"
+	"github.com/influxdata/influxdb/tsdb/engine/tsm1"
+)
+
+// mirroring returns true when files are written to output directories, leaving the source directories untouched
+func (e *engine) mirroring() bool {
+	return e.OutDataDir != ""
+}
+
+// sourceDirs returns the data and WAL directories shards are loaded from
+func (e *engine) sourceDirs() (string, string) {
+	if e.EngineDir != "" {
+		return storage.EngineDirs(e.EngineDir)
+	}
+	return e.DataDir, e.WALDir
+}
+
+// outPath returns the path a file of the source directories is written to. It is the file itself unless mirroring
+func (e *engine) outPath(path string) string {
+	if !e.mirroring() {
+		return path
+	}
+
+	dataDir, walDir := e.sourceDirs()
+	for _, dirs := range [][2]string{{dataDir, e.OutDataDir}, {walDir, e.OutWALDir}} {
+		rel, err := filepath.Rel(dirs[0], path)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return filepath.Join(dirs[1], rel)
+		}
+	}
+	return path
+}
+
+// keepFile copies a file left untouched to the output directories when mirroring. TSM files are hard linked when
+// possible since they are never modified once written
+func (e *engine) keepFile(path string) error {
+	out := e.outPath(path)
+	if out == path || e.Check {
+		return nil
+	}
+
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+
+	link := filepath.Ext(path) == "."+tsm1.TSMFileExtension
+	return e.replaceFile(path, out, func() error {
+		return storage.CopyFile(path, out, link)
+	})
+}
+
+// removeFile removes a file whose content has been entirely dropped. When mirroring, only its copy is removed
+func (e *engine) removeFile(path string) error {
+	err := os.Remove(e.outPath(path))
+	if os.IsNotExist(err) && e.mirroring() {
+		return nil
+	}
+	return err
+}
+
+// mirrorShard creates the output directories of a shard and copies the files infix does not process, like tombstones,
+// the TSI index or the series file of its database. The fields index is copied and reopened from its output path so
+// that rules update the copy
+func (e *engine) mirrorShard(info *storage.ShardInfo) error {
+	if !e.mirroring() || e.Check {
+		return nil
+	}
+
+	outPath := e.outPath(info.Path)
+	log.Printf("shard %d: mirroring '%s' to '%s'", info.ID, info.Path, outPath)
+
+	if err := storage.MirrorDir(info.Path, outPath, e.PreserveOwnership); err != nil {
+		return err
+	}
+	if err := storage.MirrorDir(info.WALPath, e.outPath(info.WALPath), e.PreserveOwnership); err != nil {
+		return err
+	}
+
+	if seriesPath := info.SeriesFilePath(); !e.mirroredSeries[seriesPath] {
+		if _, err := os.Stat(seriesPath); err == nil {
+			log.Printf("Copying series file '%s'", seriesPath)
+			if err := storage.CopyDir(seriesPath, e.outPath(seriesPath), e.PreserveOwnership); err != nil {
+				return err
+			}
+		}
+		e.mirroredSeries[seriesPath] = true
+	}
+
+	entries, err := ioutil.ReadDir(info.Path)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		path := filepath.Join(info.Path, entry.Name())
+
+		// TSM files are copied once processed, leftovers of previous runs are not copied
+		if filepath.Ext(path) == "."+tsm1.TSMFileExtension || strings.HasSuffix(path, ".rewriting") {
+			continue
+		}
+
+		if entry.IsDir() {
+			if err := storage.CopyDir(path, e.outPath(path), e.PreserveOwnership); err != nil {
+				return err
+			}
+		} else if err := e.keepFile(path); err != nil {
+			return err
+		}
+	}
+
+	// The index is reopened even if it could not be loaded so that rules saving it never write to the source path,
+	// its load error is kept
+	fieldsIndexPath := e.outPath(filepath.Join(info.Path, storage.FieldsIndexFileName))
+	fieldsIndex, err := tsdb.NewMeasurementFieldSet(fieldsIndexPath)
+	if info.FieldsIndexErr == nil {
+		info.FieldsIndexErr = err
+	}
+	info.FieldsIndex = fieldsIndex
+
+	return nil
+}
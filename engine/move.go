@@ -0,0 +1,408 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/Abc-Arbitrage/infix/filter"
+	"github.com/Abc-Arbitrage/infix/rules"
+	"github.com/Abc-Arbitrage/infix/storage"
+	"github.com/influxdata/influxdb/services/meta"
+	"github.com/influxdata/influxdb/tsdb"
+	"github.com/influxdata/influxdb/tsdb/engine/tsm1"
+)
+
+// moveTarget is a shard of the destination retention policy receiving moved data
+type moveTarget struct {
+	Info    storage.ShardInfo
+	Group   storage.TimeRange
+	Created bool
+
+	w            storage.TSMRewriter
+	outputDir    string
+	madeDir      bool
+	fields       *storage.FieldTracker
+	measurements map[string]bool
+}
+
+// runMove copies the measurements matched by MoveMeasurements to the shards of the destination retention policy
+// covering their timestamps, then drops them from the source shards unless CopyMeasurements is set. Destination shards
+// are only changed once all the data has been copied, and the meta store is saved first when shard groups are created
+func (e *engine) runMove(ctx context.Context) error {
+	if err := e.checkNotRunning(); err != nil {
+		return err
+	}
+
+	shards, err := e.loadShards()
+	if err != nil {
+		return err
+	}
+
+	for _, sh := range shards {
+		if len(sh.WalFiles) > 0 {
+			return fmt.Errorf("shard %d has WAL segments, they must be flushed to TSM files before moving measurements", sh.ID)
+		}
+	}
+
+	data, err := storage.LoadMeta(e.MetaDir)
+	if err != nil {
+		return err
+	}
+
+	rp, err := data.RetentionPolicy(e.MoveToDatabase, e.MoveToRetentionPolicy)
+	if err != nil {
+		return err
+	} else if rp == nil {
+		return fmt.Errorf("retention policy '%s' not found in database '%s'", e.MoveToRetentionPolicy, e.MoveToDatabase)
+	}
+
+	existing, err := storage.LoadShards(e.DataDir, e.WALDir, e.MoveToDatabase, e.MoveToRetentionPolicy, "", storage.TimeRange{})
+	if err != nil {
+		return err
+	}
+
+	targets := make(map[uint64]*moveTarget)
+	defer func() {
+		for _, t := range targets {
+			t.close()
+		}
+	}()
+
+	target := func(sg *meta.ShardGroupInfo, created bool) (*moveTarget, error) {
+		if t, ok := targets[sg.ID]; ok {
+			return t, nil
+		}
+		t, err := e.newMoveTarget(data, sg, created, existing)
+		if err != nil {
+			return nil, err
+		}
+		targets[sg.ID] = t
+		return t, nil
+	}
+
+	f := filter.NewMeasurementFilter(e.MoveMeasurements)
+
+	if err := e.checkMoveSpace(shards, f); err != nil {
+		return err
+	}
+
+	sort.Slice(shards, func(i, j int) bool {
+		return shards[i].ID < shards[j].ID
+	})
+
+	for _, sh := range shards {
+		tsmFiles := sh.TsmFiles
+		sort.Strings(tsmFiles)
+
+		for _, path := range tsmFiles {
+			e.emit(Event{Type: TSMFileStarted, Shard: sh, Path: path})
+			if err := e.moveTSMFile(ctx, sh, path, f, data, target); err != nil {
+				return err
+			}
+		}
+	}
+
+	var ids []uint64
+	for id, t := range targets {
+		if conflicts := t.fields.Conflicts(t.Info.FieldsIndex); len(conflicts) > 0 {
+			return fmt.Errorf("shard %d: moved field conflicts with the fields index: %s", t.Info.ID, conflicts[0])
+		}
+		ids = append(ids, id)
+	}
+
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+
+	for _, id := range ids {
+		t := targets[id]
+		var measurements []string
+		for m := range t.measurements {
+			measurements = append(measurements, m)
+		}
+		sort.Strings(measurements)
+
+		e.emit(Event{Type: MeasurementsMoved, Shard: t.Info, Measurements: measurements, TimeRange: t.Group, Created: t.Created})
+	}
+
+	if e.Check {
+		return e.dropMoved(ctx, shards)
+	}
+
+	created := false
+	for _, t := range targets {
+		created = created || t.Created
+	}
+
+	if created {
+		path := filepath.Join(e.MetaDir, storage.MetaFileName)
+		if err := e.replaceFile(path, path, func() error { return storage.SaveMeta(e.MetaDir, data) }); err != nil {
+			return err
+		}
+		e.emit(Event{Type: MetaUpdated, Path: path})
+	}
+
+	for _, id := range ids {
+		if err := e.commitMoveTarget(targets[id]); err != nil {
+			return err
+		}
+	}
+
+	return e.dropMoved(ctx, shards)
+}
+
+// checkMoveSpace compares the space needed to copy the moved data with the free space of the destination filesystem,
+// then the space needed to drop it from each source shard with the free space of its filesystem
+func (e *engine) checkMoveSpace(shards []storage.ShardInfo, f *filter.MeasurementFilter) error {
+	if e.Check {
+		return nil
+	}
+
+	est, err := e.estimateMoveSpace(shards, f)
+	if err != nil {
+		return err
+	}
+
+	what := fmt.Sprintf("%s.%s", e.MoveToDatabase, e.MoveToRetentionPolicy)
+	if err := e.checkEstimates(storage.ShardInfo{}, what, []spaceEstimate{est}); err != nil {
+		return err
+	}
+
+	if e.CopyMeasurements {
+		return nil
+	}
+
+	e.Rules = dropMovedRules(e.MoveMeasurements)
+	return e.checkDiskSpace(shards)
+}
+
+// dropMoved drops the moved measurements from the source shards, unless they are only copied
+func (e *engine) dropMoved(ctx context.Context, shards []storage.ShardInfo) error {
+	if e.CopyMeasurements {
+		return nil
+	}
+
+	e.Rules = dropMovedRules(e.MoveMeasurements)
+	return e.process(ctx, shards)
+}
+
+func dropMovedRules(f filter.Filter) []rules.Rule {
+	return []rules.Rule{rules.NewDropMeasurementWithFilter(f)}
+}
+
+// moveTSMFile writes the keys of a TSM file matched by a measurement filter to the shards covering their timestamps
+func (e *engine) moveTSMFile(ctx context.Context, info storage.ShardInfo, path string, f *filter.MeasurementFilter, data *meta.Data, target func(*meta.ShardGroupInfo, bool) (*moveTarget, error)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	r, err := tsm1.NewTSMReader(file)
+	if err != nil {
+		return fmt.Errorf("unable to read %s: %v", path, err)
+	}
+	defer r.Close()
+
+	if min, max := r.TimeRange(); !e.TimeRange.Overlaps(min, max) {
+		log.Printf("TSM file '%s' out of time range, skipping", path)
+		return nil
+	}
+
+	keyCount := r.KeyCount()
+	for i := 0; i < keyCount; i++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		key, _ := r.KeyAt(i)
+		e.progress(info, path, i+1, keyCount)
+
+		k := filter.NewKey(key)
+		if !f.FilterKey(k) {
+			continue
+		}
+
+		values, err := r.ReadAll(key)
+		if err != nil {
+			return fmt.Errorf("unable to read key %q in %s: %v", string(key), path, err)
+		}
+
+		// Values are sorted by time, each run of values of the same shard group is written at once
+		for len(values) > 0 {
+			ts := time.Unix(0, values[0].UnixNano()).UTC()
+
+			created := false
+			sg, err := data.ShardGroupByTimestamp(e.MoveToDatabase, e.MoveToRetentionPolicy, ts)
+			if err != nil {
+				return err
+			}
+			if sg == nil {
+				if err := data.CreateShardGroup(e.MoveToDatabase, e.MoveToRetentionPolicy, ts); err != nil {
+					return err
+				}
+				if sg, err = data.ShardGroupByTimestamp(e.MoveToDatabase, e.MoveToRetentionPolicy, ts); err != nil {
+					return err
+				}
+				created = true
+			}
+
+			t, err := target(sg, created)
+			if err != nil {
+				return err
+			}
+
+			end := sg.EndTime
+			if sg.Truncated() {
+				end = sg.TruncatedAt
+			}
+			n := sort.Search(len(values), func(i int) bool {
+				return values[i].UnixNano() >= end.UnixNano()
+			})
+
+			if err := t.w.Write(key, values[:n]); err != nil {
+				return err
+			}
+			t.fields.AddValues(key, values[:n])
+			t.measurements[string(k.Measurement())] = true
+
+			values = values[n:]
+		}
+	}
+
+	return nil
+}
+
+// newMoveTarget prepares a shard of the destination retention policy to receive moved data, loading its fields index
+// if it already exists
+func (e *engine) newMoveTarget(data *meta.Data, sg *meta.ShardGroupInfo, created bool, existing []storage.ShardInfo) (*moveTarget, error) {
+	if len(sg.Shards) == 0 {
+		return nil, fmt.Errorf("shard group %d has no shard", sg.ID)
+	}
+
+	id := sg.Shards[0].ID
+	info := storage.ShardInfo{
+		Path:            filepath.Join(e.DataDir, e.MoveToDatabase, e.MoveToRetentionPolicy, strconv.FormatUint(id, 10)),
+		ID:              id,
+		Database:        e.MoveToDatabase,
+		RetentionPolicy: e.MoveToRetentionPolicy,
+		WALPath:         filepath.Join(e.WALDir, e.MoveToDatabase, e.MoveToRetentionPolicy, strconv.FormatUint(id, 10)),
+	}
+	for _, sh := range existing {
+		if sh.ID == id {
+			info = sh
+		}
+	}
+
+	shards := []storage.ShardInfo{info}
+	storage.AttachMeta(shards, data)
+	info = shards[0]
+
+	if info.FieldsIndexErr != nil {
+		return nil, fmt.Errorf("shard %d: unable to load fields index: %v", id, info.FieldsIndexErr)
+	}
+
+	t := &moveTarget{
+		Info:         info,
+		Group:        storage.TimeRange{Start: sg.StartTime, End: sg.EndTime},
+		Created:      created,
+		fields:       storage.NewFieldTracker(),
+		measurements: make(map[string]bool),
+	}
+
+	if e.Check {
+		t.w = &storage.NoopTSMRewriter{}
+		return t, nil
+	}
+
+	if _, err := os.Stat(info.Path); os.IsNotExist(err) {
+		// New directories get the ownership of the data directory, so that influxd can write to them
+		if err := storage.MkdirAllLike(info.Path, e.PreserveOwnership); err != nil {
+			return nil, err
+		}
+		t.madeDir = true
+	} else if err != nil {
+		return nil, err
+	}
+
+	if t.Info.FieldsIndex == nil {
+		fs, err := tsdb.NewMeasurementFieldSet(filepath.Join(info.Path, storage.FieldsIndexFileName))
+		if err != nil {
+			return nil, err
+		}
+		t.Info.FieldsIndex = fs
+	}
+
+	t.outputDir = filepath.Join(info.Path, "moving")
+	if err := os.RemoveAll(t.outputDir); err != nil {
+		return nil, err
+	}
+	if err := os.Mkdir(t.outputDir, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	t.w = e.newCachedTSMRewriter(t.outputDir)
+	return t, nil
+}
+
+// close removes the temporary files of a target, and the shard directory if it has been created and is still empty
+func (t *moveTarget) close() {
+	if t.w != nil {
+		t.w.Close()
+	}
+	if t.madeDir {
+		// Fails unless the directory is empty
+		os.Remove(t.Info.Path)
+	}
+}
+
+// commitMoveTarget adds the TSM files written for a target to its shard and updates its fields index. The TSI index
+// of the shard is removed so that influx_inspect buildtsi rebuilds it with the moved series
+func (e *engine) commitMoveTarget(t *moveTarget) error {
+	if err := t.w.WriteSnapshot(); err != nil {
+		return err
+	}
+
+	files, err := t.w.CompactFull()
+	if err != nil {
+		return err
+	}
+
+	// New files get a generation above the existing ones
+	generation := 0
+	for _, path := range t.Info.TsmFiles {
+		if g, _, err := tsm1.DefaultParseFileName(path); err == nil && g > generation {
+			generation = g
+		}
+	}
+
+	for _, f := range files {
+		_, sequence, err := tsm1.DefaultParseFileName(f)
+		if err != nil {
+			return err
+		}
+
+		path := filepath.Join(t.Info.Path, tsm1.DefaultFormatFileName(generation+1, sequence)+"."+tsm1.TSMFileExtension)
+		log.Printf("Renaming '%s' to '%s'", f, path)
+		if err := e.replaceFile(path, path, func() error { return os.Rename(f, path) }); err != nil {
+			return err
+		}
+	}
+
+	if err := t.fields.AddTo(t.Info.FieldsIndex); err != nil {
+		return err
+	}
+
+	path := filepath.Join(t.Info.Path, storage.FieldsIndexFileName)
+	if err := e.replaceFile(path, path, t.Info.FieldsIndex.Save); err != nil {
+		return err
+	}
+
+	return os.RemoveAll(filepath.Join(t.Info.Path, "index"))
+}
@@ -0,0 +1,225 @@
+package engine
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/Abc-Arbitrage/infix/filter"
+	"github.com/Abc-Arbitrage/infix/rules"
+	"github.com/Abc-Arbitrage/infix/storage"
+	"github.com/influxdata/influxdb/tsdb"
+)
+
+var (
+	// DefaultMaxCacheSize is the default maximum in-memory cache size used when rewriting TSM files
+	DefaultMaxCacheSize = uint64(tsdb.DefaultCacheMaxMemorySize)
+	// DefaultCacheSnapshotSize is the default size after which the cache is snapshotted to disk when rewriting TSM files
+	DefaultCacheSnapshotSize = uint64(tsdb.DefaultCacheSnapshotMemorySize)
+	// DefaultCompactThroughput is the rate limit in bytes per second of compactions used by influxd by default
+	DefaultCompactThroughput = uint64(storage.DefaultCompactThroughput)
+)
+
+// Options defines the shards to process and how to process them
+type Options struct {
+	// DataDir and WALDir are the InfluxDB 1.x data and WAL directories
+	DataDir string
+	WALDir  string
+
+	// EngineDir is the InfluxDB 2.x engine directory. It takes precedence over DataDir and WALDir, and is detected
+	// when DataDir points to an engine directory
+	EngineDir string
+	// BoltPath is the InfluxDB 2.x bolt metadata store, next to EngineDir by default
+	BoltPath string
+
+	// OutDataDir and OutWALDir are the directories files are written to instead of DataDir and WALDir, or the data and
+	// WAL directories of EngineDir. Source directories are then left untouched, and the processed shards are written
+	// to the output directories with their untouched files copied over
+	OutDataDir string
+	OutWALDir  string
+
+	// BackupDir is a portable backup set, as written by influxd backup -portable, to process instead of DataDir and
+	// WALDir. The shards of the backup are extracted to a temporary directory and a new backup set is written to
+	// OutBackupDir with the processed shards, the other ones being copied as is
+	BackupDir    string
+	OutBackupDir string
+
+	// MetaDir is the meta directory to read shard groups and owners from
+	MetaDir string
+
+	// Database, RetentionPolicy and Shard restrict the processed shards. Empty values match every shard
+	Database        string
+	RetentionPolicy string
+	Shard           string
+
+	// TimeRange restricts the processed shards and TSM files to those overlapping it
+	TimeRange storage.TimeRange
+	// RetentionDuration restricts the processed shards to retention policies with this duration, 0 standing for an
+	// infinite duration. It requires MetaDir
+	RetentionDuration *time.Duration
+
+	// MaxCacheSize and CacheSnapshotSize control memory usage when rewriting TSM files
+	MaxCacheSize      uint64
+	CacheSnapshotSize uint64
+
+	// CompactThroughput and CompactThroughputBurst limit the rate in bytes per second at which compactions write TSM
+	// files, when rewriting or compacting them. A CompactThroughput of 0 disables rate limiting, and the burst defaults
+	// to the throughput
+	CompactThroughput      uint64
+	CompactThroughputBurst uint64
+
+	// FlushWAL writes the WAL segments of the selected shards to TSM files and removes them before applying rules, if
+	// any, so that rules only reading TSM files see all the data
+	FlushWAL bool
+
+	// Compact fully compacts the TSM files of the selected shards instead of applying rules
+	Compact bool
+
+	// Check runs rules without applying any change
+	Check bool
+	// RepairWAL salvages readable entries past corruption points in WAL files
+	RepairWAL bool
+	// RebuildFieldsIndex rebuilds fields indexes from the keys of TSM and WAL files
+	RebuildFieldsIndex bool
+	// IgnoreRunning skips the check made before changing any file that no process, like a running influxd, has the
+	// storage open
+	IgnoreRunning bool
+	// PIDFile is the PID file of influxd, checked along with open files
+	PIDFile string
+
+	// IgnoreDiskSpace only warns when the free space of a filesystem is lower than the space estimated to process a
+	// shard, instead of failing before changing any file
+	IgnoreDiskSpace bool
+
+	// MergeShardGroupDuration merges the shards of the retention policy into shard groups of this duration instead of
+	// applying rules. The shards of each new shard group are merged into the one with the lowest ID, and the meta store
+	// is updated. It requires Database, RetentionPolicy and MetaDir
+	MergeShardGroupDuration time.Duration
+
+	// MoveMeasurements moves the measurements it matches from the selected shards to the shards of MoveToDatabase and
+	// MoveToRetentionPolicy covering their timestamps instead of applying rules. Missing shard groups are created in
+	// the meta store. It requires Database and MetaDir
+	MoveMeasurements      filter.Filter
+	MoveToDatabase        string
+	MoveToRetentionPolicy string
+	// CopyMeasurements leaves the measurements matched by MoveMeasurements in the source shards
+	CopyMeasurements bool
+
+	// PreserveOwnership restores the owner, group and mode of each replaced file. New files get the owner and group
+	// of their directory
+	PreserveOwnership bool
+
+	// Rules are applied in order to every key
+	Rules []rules.Rule
+	// Filter excludes the keys it matches from all rules
+	Filter filter.Filter
+
+	// OnEvent is called for each notable step or problem of a run
+	OnEvent func(Event)
+	// OnProgress is called for each key of the TSM files being processed
+	OnProgress func(Progress)
+}
+
+// Validate checks that options are consistent
+func (o *Options) Validate() error {
+	if o.RetentionPolicy != "" && o.Database == "" {
+		return fmt.Errorf("must specify a database")
+	}
+	if !o.TimeRange.Start.IsZero() && !o.TimeRange.End.IsZero() && !o.TimeRange.Start.Before(o.TimeRange.End) {
+		return fmt.Errorf("start time must be before end time")
+	}
+	if o.RetentionDuration != nil && o.MetaDir == "" {
+		return fmt.Errorf("must specify a meta directory to filter shards by retention duration")
+	}
+	if o.BackupDir != "" {
+		if o.OutBackupDir == "" && !o.Check {
+			return fmt.Errorf("must specify an output backup directory")
+		}
+		if sameDir(o.BackupDir, o.OutBackupDir) {
+			return fmt.Errorf("output backup directory '%s' must differ from the backup directory", o.OutBackupDir)
+		}
+		if o.EngineDir != "" || o.OutDataDir != "" || o.MetaDir != "" {
+			return fmt.Errorf("backups cannot be processed along with engine, output or meta directories")
+		}
+	}
+	if o.MergeShardGroupDuration != 0 {
+		if o.MergeShardGroupDuration < 0 {
+			return fmt.Errorf("shard group duration must be positive")
+		}
+		if o.Database == "" || o.RetentionPolicy == "" || o.MetaDir == "" {
+			return fmt.Errorf("must specify a database, a retention policy and a meta directory to merge shards")
+		}
+		if o.EngineDir != "" || o.BackupDir != "" || o.OutDataDir != "" {
+			return fmt.Errorf("shards cannot be merged along with engine, backup or output directories")
+		}
+		if o.Shard != "" || !o.TimeRange.IsZero() {
+			return fmt.Errorf("all the shards of the retention policy are merged, they cannot be filtered")
+		}
+		if len(o.Rules) > 0 {
+			return fmt.Errorf("rules cannot be applied while merging shards")
+		}
+	}
+	if o.MoveMeasurements != nil {
+		if o.Database == "" || o.MetaDir == "" {
+			return fmt.Errorf("must specify a database and a meta directory to move measurements")
+		}
+		if o.MoveToDatabase == "" || o.MoveToRetentionPolicy == "" {
+			return fmt.Errorf("must specify the database and retention policy to move measurements to")
+		}
+		if o.MoveToDatabase == o.Database && (o.RetentionPolicy == "" || o.MoveToRetentionPolicy == o.RetentionPolicy) {
+			return fmt.Errorf("measurements must be moved to another retention policy")
+		}
+		if o.EngineDir != "" || o.BackupDir != "" || o.OutDataDir != "" || o.MergeShardGroupDuration != 0 {
+			return fmt.Errorf("measurements cannot be moved along with engine, backup or output directories, or merging shards")
+		}
+		if len(o.Rules) > 0 {
+			return fmt.Errorf("rules cannot be applied while moving measurements")
+		}
+	}
+	if o.FlushWAL && (o.BackupDir != "" || o.OutDataDir != "" || o.MergeShardGroupDuration != 0 || o.MoveMeasurements != nil || o.Compact) {
+		return fmt.Errorf("WAL segments cannot be flushed along with backup or output directories, or merging shards, moving measurements or compacting shards")
+	}
+	if o.Compact {
+		if o.BackupDir != "" || o.OutDataDir != "" || o.MergeShardGroupDuration != 0 || o.MoveMeasurements != nil {
+			return fmt.Errorf("shards cannot be compacted along with backup or output directories, or merging shards or moving measurements")
+		}
+		if len(o.Rules) > 0 {
+			return fmt.Errorf("rules cannot be applied while compacting shards")
+		}
+	}
+	for _, r := range o.Rules {
+		if rules.Scans(r) && (o.Shard != "" || !o.TimeRange.IsZero()) {
+			return fmt.Errorf("rules reading all the shards first, like old-serie with action \"drop\", cannot be used when filtering shards or time ranges")
+		}
+	}
+	if (o.OutDataDir == "") != (o.OutWALDir == "") {
+		return fmt.Errorf("must specify both output data and WAL directories")
+	}
+	for _, dir := range []string{o.OutDataDir, o.OutWALDir} {
+		if dir != "" && (sameDir(dir, o.DataDir) || sameDir(dir, o.WALDir) || sameDir(dir, o.EngineDir)) {
+			return fmt.Errorf("output directory '%s' must differ from source directories", dir)
+		}
+	}
+	return nil
+}
+
+// withDefaults returns a copy of the options with defaults for unset values
+func (o Options) withDefaults() Options {
+	if o.MaxCacheSize == 0 {
+		o.MaxCacheSize = DefaultMaxCacheSize
+	}
+	if o.CacheSnapshotSize == 0 {
+		o.CacheSnapshotSize = DefaultCacheSnapshotSize
+	}
+	if o.CompactThroughputBurst == 0 {
+		o.CompactThroughputBurst = o.CompactThroughput
+	}
+	if o.Filter == nil {
+		o.Filter = &filter.AlwaysFalseFilter{}
+	}
+	return o
+}
+
+func sameDir(a string, b string) bool {
+	return a != "" && b != "" && filepath.Clean(a) == filepath.Clean(b)
+}
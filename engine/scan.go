@@ -0,0 +1,159 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+
+	"github.com/Abc-Arbitrage/infix/filter"
+	"github.com/Abc-Arbitrage/infix/rules"
+	"github.com/Abc-Arbitrage/infix/storage"
+	"github.com/influxdata/influxdb/tsdb/engine/tsm1"
+)
+
+// scan gives the keys of the TSM and WAL files of the shards to the rules implementing rules.ScanRule that scan them,
+// before any shard is processed. Nothing is written
+func (e *engine) scan(ctx context.Context, shards []storage.ShardInfo) error {
+	var scanRules []rules.ScanRule
+	for _, r := range e.Rules {
+		if rules.Scans(r) {
+			scanRules = append(scanRules, r.(rules.ScanRule))
+		}
+	}
+
+	if len(scanRules) == 0 {
+		return nil
+	}
+
+	for _, sh := range shards {
+		var rs []rules.ScanRule
+		for _, r := range scanRules {
+			if r.ScanShard(sh) {
+				rs = append(rs, r)
+			}
+		}
+
+		if len(rs) == 0 {
+			continue
+		}
+
+		tsmFiles := sh.TsmFiles
+		sort.Strings(tsmFiles)
+
+		log.Printf("shard %d: scanning %d tsm file(s)", sh.ID, len(tsmFiles))
+		for _, f := range tsmFiles {
+			if err := e.scanTSMFile(ctx, sh, rs, f); err != nil {
+				return err
+			}
+		}
+
+		walFiles := sh.WalFiles
+		sort.Strings(walFiles)
+
+		log.Printf("shard %d: scanning %d wal file(s)", sh.ID, len(walFiles))
+		for _, f := range walFiles {
+			if err := e.scanWALFile(ctx, sh, rs, f); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (e *engine) scanTSMFile(ctx context.Context, info storage.ShardInfo, rs []rules.ScanRule, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r, err := tsm1.NewTSMReader(f)
+	if err != nil {
+		return fmt.Errorf("unable to read %s: %v", path, err)
+	}
+	defer r.Close()
+
+	keyCount := r.KeyCount()
+	for i := 0; i < keyCount; i++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		key, _ := r.KeyAt(i)
+		e.progress(info, path, i+1, keyCount)
+
+		parsed := filter.NewKey(key)
+		if filter.FilterKey(e.Filter, parsed) {
+			continue
+		}
+
+		values, err := r.ReadAll(key)
+		if err != nil {
+			return fmt.Errorf("unable to read key %q in %s: %v", string(key), path, err)
+		}
+
+		if err := scanKey(rs, parsed, values); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// scanWALFile gives the written keys of a WAL segment to the rules. Entries past a corruption point are discarded, as
+// they are once the segment is processed
+func (e *engine) scanWALFile(ctx context.Context, info storage.ShardInfo, rs []rules.ScanRule, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r, err := e.createWALReader(f)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	for r.Next() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		entry, err := r.Read()
+		if err != nil {
+			log.Printf("file %s corrupt at position %d, scanning stopped: %v", path, r.Count(), err)
+			break
+		}
+
+		write, ok := entry.(*tsm1.WriteWALEntry)
+		if !ok {
+			continue
+		}
+
+		for key, values := range write.Values {
+			parsed := filter.NewKey([]byte(key))
+			if filter.FilterKey(e.Filter, parsed) {
+				continue
+			}
+
+			if err := scanKey(rs, parsed, values); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func scanKey(rs []rules.ScanRule, key *filter.Key, values []tsm1.Value) error {
+	for _, r := range rs {
+		if err := r.Scan(key, values); err != nil {
+			return err
+		}
+	}
+	return nil
+}
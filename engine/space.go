@@ -0,0 +1,290 @@
+package engine
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/Abc-Arbitrage/infix/filter"
+	"github.com/Abc-Arbitrage/infix/rules"
+	"github.com/Abc-Arbitrage/infix/storage"
+	"github.com/Abc-Arbitrage/infix/utils/bytesize"
+	"github.com/influxdata/influxdb/tsdb/engine/tsm1"
+)
+
+// freeSpace is overridden by tests
+var freeSpace = storage.FreeSpace
+
+// spaceEstimate is the free space needed to process the files of a shard in a directory
+type spaceEstimate struct {
+	Dir  string
+	Size uint64
+}
+
+// estimateSpace returns the free space needed to process a shard in its data and WAL directories. Files are
+// processed one at a time and their temporary files are removed once done, so the space needed is the one of the
+// largest file. Rewriting a TSM file takes snapshots and a fully compacted copy, about twice its size, while a WAL
+// segment is rewritten to a single copy. When mirroring, every file is also copied, except TSM files hard linked on
+// the same filesystem. Compacting a shard writes all its TSM files before removing the compacted ones, and flushing
+// its WAL writes TSM files about the size of its WAL segments before removing them
+func (e *engine) estimateSpace(info storage.ShardInfo) ([]spaceEstimate, error) {
+	if e.mirroring() {
+		return e.estimateMirrorSpace(info)
+	}
+
+	if e.Compact {
+		if compacted(info) {
+			return nil, nil
+		}
+		_, total, err := fileSizes(info.TsmFiles)
+		if err != nil {
+			return nil, err
+		}
+		return []spaceEstimate{{Dir: info.Path, Size: total}}, nil
+	}
+
+	var estimates []spaceEstimate
+
+	if e.FlushWAL && len(info.WalFiles) > 0 {
+		_, total, err := fileSizes(info.WalFiles)
+		if err != nil {
+			return nil, err
+		}
+		estimates = append(estimates, spaceEstimate{Dir: info.Path, Size: total})
+	}
+
+	if len(filterFlaggedRules(e.Rules, rules.TSMWriteOnly)) > 0 && len(info.TsmFiles) > 0 {
+		largest, _, err := fileSizes(info.TsmFiles)
+		if err != nil {
+			return nil, err
+		}
+		estimates = append(estimates, spaceEstimate{Dir: info.Path, Size: 2 * largest})
+	}
+
+	if (e.RepairWAL || len(filterFlaggedRules(e.Rules, rules.WALWriteOnly)) > 0) && len(info.WalFiles) > 0 {
+		largest, _, err := fileSizes(info.WalFiles)
+		if err != nil {
+			return nil, err
+		}
+		estimates = append(estimates, spaceEstimate{Dir: info.WALPath, Size: largest})
+	}
+
+	return estimates, nil
+}
+
+func (e *engine) estimateMirrorSpace(info storage.ShardInfo) ([]spaceEstimate, error) {
+	largest, total, err := fileSizes(info.TsmFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	dataDir := existingDir(e.outPath(info.Path))
+	linked, err := storage.SameFilesystem(info.Path, dataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	data := spaceEstimate{Dir: dataDir, Size: largest + total}
+	if linked {
+		data.Size = 2 * largest
+	}
+
+	_, walTotal, err := fileSizes(info.WalFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	return []spaceEstimate{data, {Dir: existingDir(e.outPath(info.WALPath)), Size: walTotal}}, nil
+}
+
+// checkDiskSpace compares the space needed by each shard with the free space of its filesystems before changing
+// any file. When mirroring, nothing is freed between shards, so the space needed by all the shards is compared at
+// once. It fails when space is missing, or only warns with IgnoreDiskSpace
+func (e *engine) checkDiskSpace(shards []storage.ShardInfo) error {
+	if e.Check {
+		return nil
+	}
+
+	var total []spaceEstimate
+	for _, sh := range shards {
+		estimates, err := e.estimateSpace(sh)
+		if err != nil {
+			return err
+		}
+
+		if e.mirroring() {
+			if total, err = addEstimates(total, estimates); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := e.checkEstimates(sh, fmt.Sprintf("shard %d", sh.ID), estimates); err != nil {
+			return err
+		}
+	}
+
+	return e.checkEstimates(storage.ShardInfo{}, fmt.Sprintf("%d shard(s)", len(shards)), total)
+}
+
+// checkMergeSpace compares the space needed by each merge with the free space of the filesystem of its target shard.
+// A merge writes all the data of its shards to the target shard before removing the merged files, and merges are done
+// one at a time
+func (e *engine) checkMergeSpace(merges []shardMerge) error {
+	if e.Check {
+		return nil
+	}
+
+	for _, m := range merges {
+		if len(m.Sources) == 0 {
+			continue
+		}
+
+		var size uint64
+		for _, sh := range append([]storage.ShardInfo{m.Target}, m.Sources...) {
+			_, total, err := fileSizes(sh.TsmFiles)
+			if err != nil {
+				return err
+			}
+			size += total
+		}
+
+		if err := e.checkEstimates(m.Target, fmt.Sprintf("shard %d", m.Target.ID), []spaceEstimate{{Dir: m.Target.Path, Size: size}}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// estimateMoveSpace returns the free space needed to move the keys matched by a filter to the shards of the
+// destination retention policy, from the size of their blocks. As when rewriting TSM files, they are written to cache
+// snapshots and to a fully compacted copy, about twice their size
+func (e *engine) estimateMoveSpace(shards []storage.ShardInfo, f *filter.MeasurementFilter) (spaceEstimate, error) {
+	var size uint64
+	for _, sh := range shards {
+		for _, path := range sh.TsmFiles {
+			n, err := matchedSize(path, f)
+			if err != nil {
+				return spaceEstimate{}, err
+			}
+			size += n
+		}
+	}
+
+	dir := existingDir(filepath.Join(e.DataDir, e.MoveToDatabase, e.MoveToRetentionPolicy))
+	return spaceEstimate{Dir: dir, Size: 2 * size}, nil
+}
+
+// matchedSize returns the size of the blocks of the keys of a TSM file matched by a filter
+func matchedSize(path string, f *filter.MeasurementFilter) (uint64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	r, err := tsm1.NewTSMReader(file)
+	if err != nil {
+		return 0, fmt.Errorf("unable to read %s: %v", path, err)
+	}
+	defer r.Close()
+
+	var size uint64
+	var entries []tsm1.IndexEntry
+	for i := 0; i < r.KeyCount(); i++ {
+		key, _ := r.KeyAt(i)
+		if !f.FilterKey(filter.NewKey(key)) {
+			continue
+		}
+
+		for _, entry := range r.ReadEntries(key, &entries) {
+			size += uint64(entry.Size)
+		}
+	}
+
+	return size, nil
+}
+
+// checkEstimates compares estimates with the free space of their filesystems, what describing what they are
+// needed for in messages
+func (e *engine) checkEstimates(info storage.ShardInfo, what string, estimates []spaceEstimate) error {
+	for _, est := range estimates {
+		free, err := freeSpace(est.Dir)
+		if err == storage.ErrFreeSpaceUnsupported {
+			log.Printf("%s: %v, skipping disk space check of '%s'", what, err, est.Dir)
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		log.Printf("%s: %s needed in '%s', %s free", what, bytesize.ByteSize(est.Size).HumanString(), est.Dir, bytesize.ByteSize(free).HumanString())
+		if free >= est.Size {
+			continue
+		}
+
+		err = fmt.Errorf("%s: not enough disk space in '%s', %d bytes needed but only %d bytes free", what, est.Dir, est.Size, free)
+		if !e.IgnoreDiskSpace {
+			return fmt.Errorf("%v, free some space or use -ignore-disk-space to run anyway", err)
+		}
+		e.emit(Event{Type: Warning, Shard: info, Path: est.Dir, Err: err})
+	}
+
+	return nil
+}
+
+// addEstimates adds estimates to total, summing the sizes of the ones on the same filesystem
+func addEstimates(total []spaceEstimate, estimates []spaceEstimate) ([]spaceEstimate, error) {
+	for _, est := range estimates {
+		found := false
+		for i := range total {
+			same, err := storage.SameFilesystem(total[i].Dir, est.Dir)
+			if err != nil {
+				return nil, err
+			}
+			if same {
+				total[i].Size += est.Size
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			total = append(total, est)
+		}
+	}
+
+	return total, nil
+}
+
+// fileSizes returns the size of the largest file and the total size of the files
+func fileSizes(paths []string) (uint64, uint64, error) {
+	var largest, total uint64
+	for _, path := range paths {
+		fi, err := os.Stat(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return 0, 0, err
+		}
+
+		size := uint64(fi.Size())
+		if size > largest {
+			largest = size
+		}
+		total += size
+	}
+	return largest, total, nil
+}
+
+// existingDir returns the closest existing ancestor of a directory that may not exist yet
+func existingDir(dir string) string {
+	for {
+		if _, err := os.Stat(dir); err == nil || filepath.Dir(dir) == dir {
+			return dir
+		}
+		dir = filepath.Dir(dir)
+	}
+}
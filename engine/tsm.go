@@ -0,0 +1,308 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/Abc-Arbitrage/infix/filter"
+	"github.com/Abc-Arbitrage/infix/rules"
+	"github.com/Abc-Arbitrage/infix/storage"
+	"github.com/influxdata/influxdb/tsdb/engine/tsm1"
+)
+
+func (e *engine) processTSMFile(ctx context.Context, info storage.ShardInfo, shardRules []rules.Rule, tsmFilePath string, fields *storage.FieldTracker) error {
+	e.emit(Event{Type: TSMFileStarted, Shard: info, Path: tsmFilePath})
+
+	rs := filterRules(shardRules, func(r rules.Rule) bool {
+		return r.StartTSM(tsmFilePath)
+	})
+
+	if len(rs) == 0 {
+		log.Printf("No candidate rule found for processing TSM file, skipping.")
+		return e.trackTSMFile(info, tsmFilePath, fields)
+	}
+
+	f, err := os.Open(tsmFilePath)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+	r, err := tsm1.NewTSMReader(f)
+	if err != nil {
+		e.warn(info, tsmFilePath, "unable to read %s, skipping: %s", tsmFilePath, err.Error())
+		fields.Invalidate()
+		return e.keepFile(tsmFilePath)
+	}
+	defer r.Close()
+
+	if min, max := r.TimeRange(); !e.TimeRange.Overlaps(min, max) {
+		log.Printf("TSM file out of time range, skipping.")
+		fields.AddTSMKeys(r)
+		return e.keepFile(tsmFilePath)
+	}
+
+	if !e.mayMatchKeys(r, rs) {
+		log.Printf("No key matching candidate rules, skipping.")
+		fields.AddTSMKeys(r)
+		return e.keepFile(tsmFilePath)
+	}
+
+	outPath := e.outPath(tsmFilePath)
+	w, err := e.createRewriter(rs, r, outPath)
+
+	if err != nil {
+		return err
+	}
+
+	keyCount := r.KeyCount()
+
+	log.Printf("%d total keys", keyCount)
+	filtered := 0
+
+	tsmReadRules := filterFlaggedRules(rs, rules.TSMReadOnly)
+	tsmWriteRules := filterFlaggedRules(rs, rules.TSMWriteOnly)
+
+	// Fields written to the new file, only accounted for if the file is actually replaced
+	written := storage.NewFieldTracker()
+
+	dropped := 0
+
+	copied := 0
+
+	for i := 0; i < keyCount; i++ {
+		if err := ctx.Err(); err != nil {
+			log.Printf("Interrupted, leaving '%s' untouched", tsmFilePath)
+			fields.AddTSMKeys(r)
+			if err := e.keepFile(tsmFilePath); err != nil {
+				return err
+			}
+
+			// Closing the rewriter removes its temporary files
+			if err := w.Close(); err != nil {
+				return err
+			}
+
+			for _, r := range shardRules {
+				r.EndTSM()
+			}
+			return err
+		}
+
+		key, blockType := r.KeyAt(i)
+		parsed := filter.NewKey(key)
+
+		e.progress(info, tsmFilePath, i+1, keyCount)
+
+		var readRules, writeRules []rules.Rule
+		if !filter.FilterKey(e.Filter, parsed) {
+			readRules = e.filterRulesMatchingKey(tsmReadRules, parsed)
+			writeRules = e.filterRulesMatchingKey(tsmWriteRules, parsed)
+		}
+
+		// Keys not matching any rule are copied without being decoded
+		if len(readRules) == 0 && len(writeRules) == 0 {
+			filtered++
+			copied++
+			if err := w.CopyBlocks(key); err != nil {
+				return err
+			}
+			written.AddBlockType(key, blockType)
+			continue
+		}
+
+		values, err := r.ReadAll(key)
+		if err != nil {
+			e.warn(info, tsmFilePath, "unable to read key %q in %s, skipping: %s", string(key), tsmFilePath, err.Error())
+			continue
+		}
+
+		for _, r := range readRules {
+			_, _, err := r.Apply(parsed, values)
+			if err != nil {
+				return err
+			}
+		}
+
+		newKey, newValues, err := rules.ApplyChain(writeRules, parsed, values)
+		if err != nil {
+			return err
+		}
+
+		if newKey == nil {
+			dropped++
+			continue
+		}
+
+		if rules.Unchanged(key, values, newKey, newValues) {
+			copied++
+			if err := w.CopyBlocks(key); err != nil {
+				return err
+			}
+			written.AddBlockType(key, blockType)
+			continue
+		}
+
+		if err := w.Write(newKey, newValues); err != nil {
+			return err
+		}
+		written.AddValues(newKey, newValues)
+	}
+
+	if err := w.WriteSnapshot(); err != nil {
+		return err
+	}
+
+	files, err := w.CompactFull()
+	if err != nil {
+		return err
+	}
+
+	if files != nil {
+		if len(files) > 1 {
+			return fmt.Errorf("Full compaction yielded more than one shard %v", files)
+		}
+
+		newFile := files[0]
+		log.Printf("Fully compacted TSM file '%s'", newFile)
+
+		log.Printf("Renaming '%s' to '%s'", newFile, outPath)
+		if err := e.replaceFile(tsmFilePath, outPath, func() error { return os.Rename(newFile, outPath) }); err != nil {
+			return err
+		}
+
+		fields.Merge(written)
+	} else if e.Check {
+		// Report the fields the file would hold once rewritten
+		fields.Merge(written)
+	} else if _, noop := w.(*storage.NoopTSMRewriter); !noop && dropped == keyCount {
+		log.Printf("All keys dropped, removing '%s'", outPath)
+		if err := e.removeFile(tsmFilePath); err != nil {
+			return err
+		}
+	} else {
+		// The original file has been left untouched
+		fields.AddTSMKeys(r)
+		if err := e.keepFile(tsmFilePath); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("%d (%d%%) total filtered keys", filtered, (filtered*100)/keyCount)
+	log.Printf("%d (%d%%) keys copied unchanged", copied, (copied*100)/keyCount)
+
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	for _, r := range shardRules {
+		r.EndTSM()
+	}
+
+	return nil
+}
+
+// trackTSMFile records the fields of a TSM file left untouched
+func (e *engine) trackTSMFile(info storage.ShardInfo, tsmFilePath string, fields *storage.FieldTracker) error {
+	if err := e.keepFile(tsmFilePath); err != nil {
+		return err
+	}
+
+	if fields == nil {
+		return nil
+	}
+
+	f, err := os.Open(tsmFilePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r, err := tsm1.NewTSMReader(f)
+	if err != nil {
+		e.warn(info, tsmFilePath, "unable to read %s: %s", tsmFilePath, err.Error())
+		fields.Invalidate()
+		return nil
+	}
+	defer r.Close()
+
+	fields.AddTSMKeys(r)
+	return nil
+}
+
+// createRewriter creates a rewriter to the TSM file at outPath, which is the source file unless mirroring
+func (e *engine) createRewriter(rs []rules.Rule, source *tsm1.TSMReader, outPath string) (storage.BlockTSMRewriter, error) {
+	// If all rules are read-only, just return a NoopRewriter
+	readRules := filterFlaggedRules(rs, rules.TSMReadOnly)
+	readonly := len(readRules) == len(rs)
+
+	if e.Check || readonly {
+		return &storage.NoopTSMRewriter{}, nil
+	}
+
+	// Remove previous temporary files.
+	outputDir := outPath + ".rewriting"
+
+	if _, err := os.Stat(outputDir); os.IsNotExist(err) {
+		if err := os.Mkdir(outputDir, os.ModePerm); err != nil {
+			return nil, err
+		}
+	} else {
+		files, err := ioutil.ReadDir(outputDir)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, f := range files {
+			path := filepath.Join(outputDir, f.Name())
+			if err := os.Remove(path); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := os.RemoveAll(outPath + ".idx.tmp"); err != nil {
+		return nil, err
+	}
+
+	log.Printf("Creating passthrough TSM rewriter to directory '%s'", outputDir)
+	w := storage.NewPassthroughTSMRewriter(source, e.MaxCacheSize, e.CacheSnapshotSize, outputDir)
+	w.SetCompactThroughput(int(e.CompactThroughput), int(e.CompactThroughputBurst))
+	return w, nil
+}
+
+// mayMatchKeys uses the sorted index of a TSM file to check whether some keys might match one of the rules
+// without filtering every key. It is only conclusive when all rules implement rules.MeasurementRule
+func (e *engine) mayMatchKeys(r *tsm1.TSMReader, rs []rules.Rule) bool {
+	var measurementRules []rules.MeasurementRule
+	for _, rule := range rs {
+		mr, ok := rule.(rules.MeasurementRule)
+		if !ok {
+			return true
+		}
+		measurementRules = append(measurementRules, mr)
+	}
+
+	matched := false
+	storage.ScanMeasurements(r, func(measurement []byte) bool {
+		for _, mr := range measurementRules {
+			if mr.FilterMeasurement(measurement) {
+				matched = true
+				return false
+			}
+		}
+		return true
+	})
+
+	return matched
+}
+
+func (e *engine) filterRulesMatchingKey(rs []rules.Rule, key *filter.Key) []rules.Rule {
+	return filterRules(rs, func(r rules.Rule) bool {
+		return r.FilterKey(key)
+	})
+}
@@ -0,0 +1,283 @@
+package engine
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+
+	"github.com/Abc-Arbitrage/infix/rules"
+	"github.com/Abc-Arbitrage/infix/storage"
+	"github.com/golang/snappy"
+	"github.com/influxdata/influxdb/tsdb/engine/tsm1"
+)
+
+func (e *engine) processWALFile(ctx context.Context, info storage.ShardInfo, shardRules []rules.Rule, walFilePath string, fields *storage.FieldTracker) error {
+	e.emit(Event{Type: WALFileStarted, Shard: info, Path: walFilePath})
+
+	rs := filterRules(shardRules, func(r rules.Rule) bool {
+		return r.StartWAL(walFilePath)
+	})
+
+	if len(rs) == 0 && !e.RepairWAL {
+		log.Printf("No candidate rule found for processing WAL file, skipping.")
+		return e.trackWALFile(info, walFilePath, fields)
+	}
+
+	f, err := os.Open(walFilePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	r, err := e.createWALReader(f)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	var w *tsm1.WALSegmentWriter
+	var output *os.File
+	var outputPath string
+
+	outPath := e.outPath(walFilePath)
+
+	defer func() {
+		if output != nil {
+			output.Close()
+		}
+	}()
+
+	// The segment is only rewritten from its first changed entry, previous entries are copied as is
+	writable := e.rewritesWAL(rs)
+	startWriter := func(prefix int64) error {
+		var err error
+		w, output, outputPath, err = e.createWALWriter(f, prefix, outPath)
+		return err
+	}
+
+	// Repaired segments are entirely re-encoded
+	if writable && e.RepairWAL {
+		if err := startWriter(0); err != nil {
+			return err
+		}
+	}
+
+	readRules := filterFlaggedRules(rs, rules.WALReadOnly)
+	writeRules := filterFlaggedRules(rs, rules.WALWriteOnly)
+
+	// Fields of the entries after rules, only accounted for if the file is not left untouched on interruption
+	written := storage.NewFieldTracker()
+
+	count := 0
+	changed := false
+
+	// offset is the position of the current entry in the segment
+	var offset int64
+
+	for ; r.Next(); offset = r.Count() {
+		if ctx.Err() != nil {
+			break
+		}
+
+		entry, err := r.Read()
+		if err != nil {
+			n := r.Count()
+			e.warn(info, walFilePath, "file %s corrupt at position %d: %v", walFilePath, n, err)
+			if w != nil {
+				e.warn(info, walFilePath, "entries after position %d will be discarded, use -repair-wal to salvage them", n)
+			} else {
+				fields.Invalidate()
+			}
+			break
+		}
+
+		keep, entryChanged, err := rules.ApplyWALEntry(entry, readRules, writeRules)
+		if err != nil {
+			return err
+		}
+
+		if entryChanged || !keep {
+			changed = true
+		}
+
+		if writable && changed && w == nil {
+			log.Printf("Rewriting WAL file from position %d", offset)
+			if err := startWriter(offset); err != nil {
+				return err
+			}
+		}
+
+		if !keep {
+			log.Printf("Dropping %T with no remaining key", entry)
+			continue
+		}
+
+		if write, ok := entry.(*tsm1.WriteWALEntry); ok {
+			for key, values := range write.Values {
+				written.AddValues([]byte(key), values)
+			}
+		}
+
+		if w != nil {
+			b, err := encodeWALEntry(entry)
+			if err != nil {
+				e.warn(info, walFilePath, "Failed to encode WAL entry: %v", err)
+				break
+			}
+			if err := w.Write(entry.Type(), b); err != nil {
+				return err
+			}
+		}
+		count++
+	}
+
+	if err := ctx.Err(); err != nil {
+		log.Printf("Interrupted, leaving '%s' untouched", walFilePath)
+		if output != nil {
+			output.Close()
+			if err := os.Remove(outputPath); err != nil {
+				return err
+			}
+		}
+
+		if err := e.trackWALFile(info, walFilePath, fields); err != nil {
+			return err
+		}
+		return err
+	}
+
+	log.Printf("%d entries", count)
+
+	fields.Merge(written)
+
+	if rr, ok := r.(*storage.WALRepairReader); ok {
+		if lost := rr.Lost(); len(lost) > 0 {
+			e.emit(Event{Type: WALRangesLost, Shard: info, Path: walFilePath, Lost: lost})
+			changed = true
+		}
+	}
+
+	if w != nil {
+		if !changed {
+			log.Printf("No change, leaving '%s' untouched", walFilePath)
+			output.Close()
+			if err := os.Remove(outputPath); err != nil {
+				return err
+			}
+			return e.keepFile(walFilePath)
+		}
+
+		if err := w.Flush(); err != nil {
+			return err
+		}
+
+		log.Printf("Renaming '%s' to '%s'", outputPath, outPath)
+		// Replace original file with new file.
+		return e.replaceFile(walFilePath, outPath, func() error { return os.Rename(outputPath, outPath) })
+	}
+
+	return e.keepFile(walFilePath)
+}
+
+// trackWALFile records the fields written by a WAL file left untouched
+func (e *engine) trackWALFile(info storage.ShardInfo, walFilePath string, fields *storage.FieldTracker) error {
+	if err := e.keepFile(walFilePath); err != nil {
+		return err
+	}
+
+	if fields == nil {
+		return nil
+	}
+
+	f, err := os.Open(walFilePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	r := tsm1.NewWALSegmentReader(f)
+	defer r.Close()
+
+	for r.Next() {
+		entry, err := r.Read()
+		if err != nil {
+			e.warn(info, walFilePath, "file %s corrupt at position %d: %v", walFilePath, r.Count(), err)
+			fields.Invalidate()
+			return nil
+		}
+
+		if write, ok := entry.(*tsm1.WriteWALEntry); ok {
+			for key, values := range write.Values {
+				fields.AddValues([]byte(key), values)
+			}
+		}
+	}
+
+	return nil
+}
+
+// walSegmentReader is implemented by both tsm1.WALSegmentReader and storage.WALRepairReader
+type walSegmentReader interface {
+	Next() bool
+	Read() (tsm1.WALEntry, error)
+	Count() int64
+	Close() error
+}
+
+func (e *engine) createWALReader(f *os.File) (walSegmentReader, error) {
+	if e.RepairWAL {
+		return storage.NewWALRepairReader(f)
+	}
+	return tsm1.NewWALSegmentReader(f), nil
+}
+
+// rewritesWAL returns true if WAL segments may be rewritten by the given rules
+func (e *engine) rewritesWAL(rs []rules.Rule) bool {
+	// If all rules are read-only, nothing is written. When repairing, we always need to write a clean segment
+	readRules := filterFlaggedRules(rs, rules.WALReadOnly)
+	readonly := len(readRules) == len(rs) && !e.RepairWAL
+
+	return !e.Check && !readonly
+}
+
+// createWALWriter creates a new segment, to be renamed to outPath, starting with the first prefix bytes of the source
+// segment
+func (e *engine) createWALWriter(source *os.File, prefix int64, outPath string) (*tsm1.WALSegmentWriter, *os.File, string, error) {
+	// Remove previous temporary files.
+	outputPath := outPath + ".rewriting.tmp"
+	if err := os.RemoveAll(outputPath); err != nil {
+		return nil, nil, "", err
+	}
+
+	// Create TSMWriter to temporary location.
+	output, err := os.Create(outputPath)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	if _, err := io.Copy(output, io.NewSectionReader(source, 0, prefix)); err != nil {
+		return nil, output, "", err
+	}
+
+	w := tsm1.NewWALSegmentWriter(output)
+
+	return w, output, outputPath, nil
+}
+
+func encodeWALEntry(entry tsm1.WALEntry) ([]byte, error) {
+	bytes := make([]byte, 1024<<2)
+
+	b, err := entry.Encode(bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return snappy.Encode(b, b), nil
+}
@@ -7,8 +7,6 @@ import (
 	"regexp"
 	"strings"
 
-	"github.com/influxdata/influxdb/models"
-	"github.com/influxdata/influxdb/tsdb/engine/tsm1"
 	"github.com/naoina/toml/ast"
 )
 
@@ -36,6 +34,17 @@ func (f *Set) Filter(key []byte) bool {
 	return false
 }
 
+// FilterKey implements KeyFilter interface
+func (f *Set) FilterKey(key *Key) bool {
+	for _, f := range f.filters {
+		if FilterKey(f, key) {
+			return true
+		}
+	}
+
+	return false
+}
+
 // PatternFilter is a Filter based on regexp
 type PatternFilter struct {
 	Pattern *regexp.Regexp
@@ -175,9 +184,16 @@ func NewMeasurementFilter(filter Filter) *MeasurementFilter {
 
 // Filter implements Filter interface
 func (f *MeasurementFilter) Filter(key []byte) bool {
-	seriesKey, _ := tsm1.SeriesAndFieldFromCompositeKey(key)
-	measurement, _ := models.ParseKeyBytes(seriesKey)
+	return f.FilterKey(NewKey(key))
+}
 
+// FilterKey implements KeyFilter interface
+func (f *MeasurementFilter) FilterKey(key *Key) bool {
+	return f.filter.Filter(key.Measurement())
+}
+
+// FilterMeasurement filters an already parsed measurement name
+func (f *MeasurementFilter) FilterMeasurement(measurement []byte) bool {
 	return f.filter.Filter(measurement)
 }
 
@@ -195,8 +211,12 @@ func NewRawSerieFilter(filter Filter) *RawSerieFilter {
 
 // Filter implements the Filter interface
 func (f *RawSerieFilter) Filter(key []byte) bool {
-	seriesKey, _ := tsm1.SeriesAndFieldFromCompositeKey(key)
-	return f.filter.Filter(seriesKey)
+	return f.FilterKey(NewKey(key))
+}
+
+// FilterKey implements KeyFilter interface
+func (f *RawSerieFilter) FilterKey(key *Key) bool {
+	return f.filter.Filter(key.SeriesKey())
 }
 
 // SerieFilter defines a filter restricted to the serie and field part of a key
@@ -224,14 +244,24 @@ type SerieFilterConfig struct {
 
 // Filter implements Filter interface
 func (f *SerieFilter) Filter(key []byte) bool {
-	seriesKey, field := tsm1.SeriesAndFieldFromCompositeKey(key)
-	measurement, _ := models.ParseKeyBytes(seriesKey)
+	return f.FilterKey(NewKey(key))
+}
 
-	if f.fieldFilter == nil {
-		return f.measurementFilter.Filter(measurement) && f.tagsFilter.Filter(seriesKey)
+// FilterKey implements KeyFilter interface. The tags filter receives the parsed key when it is a KeyFilter and the
+// series key otherwise
+func (f *SerieFilter) FilterKey(key *Key) bool {
+	if !f.measurementFilter.Filter(key.Measurement()) || !f.filterTags(key) {
+		return false
 	}
 
-	return f.measurementFilter.Filter(measurement) && f.tagsFilter.Filter(seriesKey) && f.fieldFilter.Filter(field)
+	return f.fieldFilter == nil || f.fieldFilter.Filter(key.Field())
+}
+
+func (f *SerieFilter) filterTags(key *Key) bool {
+	if kf, ok := f.tagsFilter.(KeyFilter); ok {
+		return kf.FilterKey(key)
+	}
+	return f.tagsFilter.Filter(key.SeriesKey())
 }
 
 // Sample implements Config interface
@@ -291,10 +321,12 @@ func NewWhereFilter(where map[string]string) (*WhereFilter, error) {
 
 // Filter implements Filter interface
 func (f *WhereFilter) Filter(key []byte) bool {
-	seriesKey, _ := tsm1.SeriesAndFieldFromCompositeKey(key)
-	_, tags := models.ParseKey(seriesKey)
+	return f.FilterKey(NewKey(key))
+}
 
-	for _, tag := range tags {
+// FilterKey implements KeyFilter interface
+func (f *WhereFilter) FilterKey(key *Key) bool {
+	for _, tag := range key.Tags() {
 		if val, ok := f.where[string(tag.Key)]; ok {
 			if val.Match(tag.Value) {
 				return true
@@ -0,0 +1,79 @@
+package filter
+
+import (
+	"github.com/influxdata/influxdb/models"
+	"github.com/influxdata/influxdb/tsdb/engine/tsm1"
+)
+
+// Key is a TSM or WAL composite key with its parsed parts. Each part is parsed at most once, the first time it is
+// requested, so that a key can be shared by all the filters and rules it goes through
+type Key struct {
+	Raw []byte
+
+	seriesKey []byte
+	field     []byte
+
+	measurement []byte
+	tags        models.Tags
+
+	seriesParsed bool
+	tagsParsed   bool
+}
+
+// NewKey creates a Key from a raw composite key
+func NewKey(raw []byte) *Key {
+	return &Key{Raw: raw}
+}
+
+// SeriesKey returns the series part of the key
+func (k *Key) SeriesKey() []byte {
+	k.parseSeries()
+	return k.seriesKey
+}
+
+// Field returns the field part of the key
+func (k *Key) Field() []byte {
+	k.parseSeries()
+	return k.field
+}
+
+// Measurement returns the unescaped measurement name of the key
+func (k *Key) Measurement() []byte {
+	k.parseTags()
+	return k.measurement
+}
+
+// Tags returns the tags of the key. They are shared and must be cloned before being modified
+func (k *Key) Tags() models.Tags {
+	k.parseTags()
+	return k.tags
+}
+
+func (k *Key) parseSeries() {
+	if !k.seriesParsed {
+		k.seriesKey, k.field = tsm1.SeriesAndFieldFromCompositeKey(k.Raw)
+		k.seriesParsed = true
+	}
+}
+
+func (k *Key) parseTags() {
+	if !k.tagsParsed {
+		k.measurement, k.tags = models.ParseKeyBytes(k.SeriesKey())
+		k.tagsParsed = true
+	}
+}
+
+// KeyFilter is implemented by filters applying to a whole key. They use its parsed parts instead of parsing the raw
+// key again
+type KeyFilter interface {
+	FilterKey(key *Key) bool
+}
+
+// FilterKey applies a filter to a key, through the KeyFilter interface if the filter implements it or to the raw
+// key otherwise
+func FilterKey(f Filter, key *Key) bool {
+	if kf, ok := f.(KeyFilter); ok {
+		return kf.FilterKey(key)
+	}
+	return f.Filter(key.Raw)
+}
@@ -0,0 +1,92 @@
+package filter
+
+import (
+	"testing"
+
+	"github.com/influxdata/influxdb/models"
+	"github.com/influxdata/influxdb/tsdb/engine/tsm1"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKey_ShouldParseKey(t *testing.T) {
+	key := NewKey(tsm1.SeriesFieldKeyBytes(`cpu\,linux,cpu=cpu0,host=my-host`, "idle"))
+
+	assert.Equal(t, []byte(`cpu\,linux,cpu=cpu0,host=my-host`), key.SeriesKey())
+	assert.Equal(t, []byte("idle"), key.Field())
+	assert.Equal(t, []byte("cpu,linux"), key.Measurement())
+	assert.Equal(t, models.NewTags(map[string]string{"host": "my-host", "cpu": "cpu0"}), key.Tags())
+}
+
+func TestKeyFilter_ShouldFilterLikeRawKey(t *testing.T) {
+	whereFilter, err := NewWhereFilter(map[string]string{"cpu": "^cpu[0-3]$"})
+	assert.NoError(t, err)
+
+	filters := []Filter{
+		NewMeasurementFilter(NewIncludeFilter([]string{"cpu"})),
+		NewRawSerieFilter(mustPatternFilter(t, "host=my-host")),
+		whereFilter,
+		NewSerieFilter(NewIncludeFilter([]string{"cpu"}), whereFilter, NewIncludeFilter([]string{"idle"})),
+		NewSerieFilter(NewIncludeFilter([]string{"cpu"}), mustPatternFilter(t, "cpu=cpu7"), nil),
+		&Set{filters: []Filter{NewMeasurementFilter(NewIncludeFilter([]string{"mem"})), whereFilter}},
+		mustPatternFilter(t, "^cpu"),
+	}
+
+	keys := [][]byte{
+		tsm1.SeriesFieldKeyBytes("cpu,host=my-host,cpu=cpu0", "idle"),
+		tsm1.SeriesFieldKeyBytes("cpu,host=my-host,cpu=cpu7", "idle"),
+		tsm1.SeriesFieldKeyBytes("cpu,host=other-host,cpu=cpu1", "active"),
+		tsm1.SeriesFieldKeyBytes("mem,host=my-host", "used"),
+	}
+
+	for i, f := range filters {
+		for _, key := range keys {
+			assert.Equal(t, f.Filter(key), FilterKey(f, NewKey(key)), "filter %d key %s", i, key)
+		}
+	}
+}
+
+func mustPatternFilter(t *testing.T, pattern string) *PatternFilter {
+	f, err := NewPatternFilter(pattern)
+	assert.NoError(t, err)
+	return f
+}
+
+func benchmarkFilters(b *testing.B) []Filter {
+	whereFilter, err := NewWhereFilter(map[string]string{"cpu": "^cpu[0-3]$"})
+	assert.NoError(b, err)
+
+	var filters []Filter
+	for i := 0; i < 10; i++ {
+		filters = append(filters, NewSerieFilter(NewIncludeFilter([]string{"cpu"}), whereFilter, NewIncludeFilter([]string{"idle"})))
+	}
+	return filters
+}
+
+var benchmarkKey = tsm1.SeriesFieldKeyBytes("cpu,host=my-host,region=eu-west,cpu=cpu0", "idle")
+
+func BenchmarkFilter_RawKey(b *testing.B) {
+	filters := benchmarkFilters(b)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		for _, f := range filters {
+			f.Filter(benchmarkKey)
+		}
+	}
+}
+
+func BenchmarkFilter_SharedKey(b *testing.B) {
+	filters := benchmarkFilters(b)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		key := NewKey(benchmarkKey)
+		for _, f := range filters {
+			FilterKey(f, key)
+		}
+	}
+}
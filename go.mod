@@ -18,5 +18,6 @@ require (
 	github.com/stretchr/testify v1.7.0
 	github.com/tinylib/msgp v1.1.2 // indirect
 	github.com/willf/bitset v1.1.10 // indirect
+	go.etcd.io/bbolt v1.3.3
 	go.uber.org/zap v1.21.0
 )
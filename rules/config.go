@@ -3,6 +3,7 @@ package rules
 import (
 	"fmt"
 	"io/ioutil"
+	"sort"
 
 	"github.com/Abc-Arbitrage/infix/filter"
 	"github.com/naoina/toml"
@@ -16,7 +17,13 @@ type Config interface {
 	Build() (Rule, error)
 }
 
-// LoadConfig will load rules from a TOML configuration file
+type ruleDeclaration struct {
+	name  string
+	table *ast.Table
+}
+
+// LoadConfig will load rules from a TOML configuration file. Rules are returned in their declaration order
+// in the file, regardless of their type
 func LoadConfig(path string) ([]Rule, error) {
 	data, err := ioutil.ReadFile(path)
 	if err != nil {
@@ -28,7 +35,7 @@ func LoadConfig(path string) ([]Rule, error) {
 		return nil, err
 	}
 
-	var rules []Rule
+	var declarations []ruleDeclaration
 
 	for name, val := range table.Fields {
 		subTable, ok := val.(*ast.Table)
@@ -45,11 +52,7 @@ func LoadConfig(path string) ([]Rule, error) {
 				}
 
 				for _, r := range ruleSubTable {
-					rule, err := loadRule(ruleName, r)
-					if err != nil {
-						return nil, fmt.Errorf("%s: %s: %s", path, ruleName, err)
-					}
-					rules = append(rules, rule)
+					declarations = append(declarations, ruleDeclaration{name: ruleName, table: r})
 				}
 			}
 		case "filters":
@@ -58,6 +61,20 @@ func LoadConfig(path string) ([]Rule, error) {
 		}
 	}
 
+	sort.SliceStable(declarations, func(i, j int) bool {
+		return declarations[i].table.Position.Begin < declarations[j].table.Position.Begin
+	})
+
+	var rules []Rule
+
+	for _, d := range declarations {
+		rule, err := loadRule(d.name, d.table)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s: %s", path, d.table.Line, d.name, err)
+		}
+		rules = append(rules, rule)
+	}
+
 	return rules, nil
 }
 
@@ -67,9 +84,23 @@ func loadRule(name string, table *ast.Table) (Rule, error) {
 		return nil, err
 	}
 
+	scope, err := unmarshalScope(table)
+	if err != nil {
+		return nil, err
+	}
+
 	if err := filter.UnmarshalConfig(table, config); err != nil {
 		return nil, err
 	}
 
-	return config.Build()
+	rule, err := config.Build()
+	if err != nil {
+		return nil, err
+	}
+
+	if scope != nil {
+		return NewScopedRule(rule, scope), nil
+	}
+
+	return rule, nil
 }
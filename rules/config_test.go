@@ -0,0 +1,71 @@
+package rules
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadConfig_ShouldPreserveDeclarationOrder(t *testing.T) {
+	config := `
+[[rules.rename-measurement]]
+    to="linux.cpu"
+    [rules.rename-measurement.from.strings]
+        equal="cpu"
+
+[[rules.drop-serie]]
+    [rules.drop-serie.dropFilter.serie]
+        [rules.drop-serie.dropFilter.serie.measurement.strings]
+            equal="linux.cpu"
+        [rules.drop-serie.dropFilter.serie.tag.where]
+            cpu="cpu0"
+
+[[rules.rename-measurement]]
+    to="linux.disk"
+    [rules.rename-measurement.from.strings]
+        equal="disk"
+
+[[rules.drop-measurement]]
+    [rules.drop-measurement.dropFilter.strings]
+        equal="mem"
+
+[[rules.update-field-type]]
+    fromType="float"
+    toType="integer"
+    [rules.update-field-type.measurement.strings]
+        equal="linux.cpu"
+    [rules.update-field-type.field.strings]
+        equal="idle"
+`
+
+	f, err := ioutil.TempFile("", "infix-config-*.toml")
+	assert.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	_, err = f.WriteString(config)
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+
+	expected := []reflect.Type{
+		reflect.TypeOf(&RenameMeasurementRule{}),
+		reflect.TypeOf(&DropSerieRule{}),
+		reflect.TypeOf(&RenameMeasurementRule{}),
+		reflect.TypeOf(&DropMeasurementRule{}),
+		reflect.TypeOf(&UpdateFieldTypeRule{}),
+	}
+
+	// Go maps iteration order is random, make sure the order is stable across loads
+	for i := 0; i < 20; i++ {
+		rs, err := LoadConfig(f.Name())
+		assert.NoError(t, err)
+
+		var types []reflect.Type
+		for _, r := range rs {
+			types = append(types, reflect.TypeOf(r))
+		}
+		assert.Equal(t, expected, types)
+	}
+}
@@ -1,27 +1,23 @@
 package rules
 
 import (
-	"fmt"
 	"log"
 
 	"github.com/Abc-Arbitrage/infix/logging"
 
 	"github.com/Abc-Arbitrage/infix/filter"
 	"github.com/Abc-Arbitrage/infix/storage"
-	"github.com/influxdata/influxdb/models"
 	"github.com/influxdata/influxdb/tsdb/engine/tsm1"
-	"github.com/influxdata/influxql"
 )
 
 type DropFieldRule struct {
 	check bool
 	shard storage.ShardInfo
 
-	measurementFilter filter.Filter
+	measurementFilter *filter.MeasurementFilter
 	fieldFilter       filter.Filter
 	typeFilter        filter.Filter
-
-	deleted map[string][]string
+	anyType           bool
 
 	logger *log.Logger
 }
@@ -33,11 +29,13 @@ type DropFieldRuleConfig struct {
 }
 
 func NewDropField(measurementFilter filter.Filter, fieldFilter filter.Filter, typeFilter filter.Filter) *DropFieldRule {
+	_, anyType := typeFilter.(*filter.AlwaysTrueFilter)
+
 	return &DropFieldRule{
 		measurementFilter: filter.NewMeasurementFilter(measurementFilter),
 		fieldFilter:       fieldFilter,
 		typeFilter:        typeFilter,
-		deleted:           make(map[string][]string),
+		anyType:           anyType,
 		logger:            logging.GetLogger("DropFieldRule"),
 	}
 }
@@ -54,8 +52,12 @@ func (r *DropFieldRule) WithLogger(logger *log.Logger) {
 	r.logger = logger
 }
 
-func (r *DropFieldRule) FilterKey(key []byte) bool {
-	return r.measurementFilter.Filter(key)
+func (r *DropFieldRule) FilterKey(key *filter.Key) bool {
+	return r.measurementFilter.FilterKey(key)
+}
+
+func (r *DropFieldRule) FilterMeasurement(measurement []byte) bool {
+	return r.measurementFilter.FilterMeasurement(measurement)
 }
 
 func (r *DropFieldRule) Start() {
@@ -66,60 +68,11 @@ func (r *DropFieldRule) End() {
 
 func (r *DropFieldRule) StartShard(info storage.ShardInfo) bool {
 	r.shard = info
-	r.deleted = make(map[string][]string)
 	return true
 }
 
 func (r *DropFieldRule) EndShard() error {
-	if r.check || len(r.deleted) == 0 {
-		return nil
-	}
-
-	shard := r.shard
-
-	if shard.FieldsIndex == nil {
-		return nil
-	}
-
-	for measurement, fields := range r.deleted {
-		oldFields := shard.FieldsIndex.FieldsByString(measurement)
-
-		if oldFields == nil {
-			return fmt.Errorf("Failed to find fields in index for measurement '%s'", measurement)
-		}
-
-		tmpFields := make(map[string]influxql.DataType)
-
-		oldFields.ForEachField(func(name string, fieldType influxql.DataType) bool {
-			found := false
-
-			for _, f := range fields {
-				if name == f {
-					found = true
-					break
-				}
-
-				if !found {
-					tmpFields[name] = fieldType
-				}
-			}
-			return true
-		})
-
-		shard.FieldsIndex.Delete(measurement)
-		newFields := shard.FieldsIndex.CreateFieldsIfNotExists([]byte(measurement))
-
-		for f, t := range tmpFields {
-			if err := newFields.CreateFieldIfNotExists([]byte(f), t); err != nil {
-				return err
-			}
-		}
-	}
-
-	if err := shard.FieldsIndex.Save(); err != nil {
-		return err
-	}
-
+	// The fields index is rebuilt from the remaining keys once the shard has been rewritten
 	return nil
 }
 
@@ -137,43 +90,31 @@ func (r *DropFieldRule) StartWAL(path string) bool {
 func (r *DropFieldRule) EndWAL() {
 }
 
-func (r *DropFieldRule) Apply(key []byte, values []tsm1.Value) ([]byte, []tsm1.Value, error) {
+func (r *DropFieldRule) Apply(key *filter.Key, values []tsm1.Value) ([]byte, []tsm1.Value, error) {
+	if len(values) == 0 {
+		// Keys without values come from WAL delete entries. Their type is unknown, so they can only be
+		// dropped when the rule applies to any type
+		if r.anyType && r.measurementFilter.FilterKey(key) && r.fieldFilter.Filter(key.Field()) {
+			return nil, nil, nil
+		}
+		return key.Raw, values, nil
+	}
+
 	dataType, err := tsm1.Values(values).InfluxQLType()
 	if err != nil {
 		return nil, nil, err
 	}
 
 	typeString := dataType.String()
-	seriesKey, field := tsm1.SeriesAndFieldFromCompositeKey(key)
 
 	log.Printf("type is %s", typeString)
 
-	if r.measurementFilter.Filter(key) && r.fieldFilter.Filter(field) && r.typeFilter.Filter([]byte(typeString)) {
-		measurement, _ := models.ParseKey(seriesKey)
-		r.logger.Printf("Dropping field '%s' from measurement '%s' (type '%s')", field, measurement, typeString)
-
-		fs := string(field)
-
-		if fields, ok := r.deleted[measurement]; ok {
-			found := false
-			for _, f := range fields {
-				if f == fs {
-					found = true
-					break
-				}
-			}
-
-			if !found {
-				fields = append(fields, fs)
-			}
-		} else {
-			r.deleted[measurement] = []string{fs}
-		}
-
+	if r.measurementFilter.FilterKey(key) && r.fieldFilter.Filter(key.Field()) && r.typeFilter.Filter([]byte(typeString)) {
+		r.logger.Printf("Dropping field '%s' from measurement '%s' (type '%s')", key.Field(), key.Measurement(), typeString)
 		return nil, nil, nil
 	}
 
-	return key, values, nil
+	return key.Raw, values, nil
 }
 
 func (c *DropFieldRuleConfig) Sample() string {
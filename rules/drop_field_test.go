@@ -4,7 +4,6 @@ import (
 	"testing"
 
 	"github.com/Abc-Arbitrage/infix/filter"
-	"github.com/influxdata/influxdb/models"
 	"github.com/influxdata/influxdb/tsdb/engine/tsm1"
 	"github.com/influxdata/influxql"
 	"github.com/stretchr/testify/assert"
@@ -84,33 +83,25 @@ func TestDropField_ShouldApplyAndDelete(t *testing.T) {
 	}
 
 	for _, d := range data {
-		key, _, err := rule.Apply(d.key, d.values)
+		key, _, err := rule.Apply(filter.NewKey(d.key), d.values)
 
 		assert.NoError(t, err)
 		assert.Equalf(t, key, d.expectedKey, "expected key '%s' but got '%s'", d.expectedKey, key)
 	}
 }
 
-func TestDropField_ShouldUpdateFieldsIndex(t *testing.T) {
-	measurementFilter := filter.NewIncludeFilter([]string{"mem"})
-	fieldFilter, err := filter.NewStringFilter(&filter.StringFilterConfig{
-		Contains:    "",
-		ContainsAny: "",
-		Equal:       "used",
-		EqualFold:   "",
-		HasPrefix:   "",
-		HasSuffix:   "",
-	})
-
-	assert.NoError(t, err)
+func TestDropField_ShouldLeaveFieldsIndexUntouched(t *testing.T) {
+	measurementFilter := filter.NewIncludeFilter([]string{"mem", "swap"})
+	fieldFilter := filter.NewIncludeFilter([]string{"used"})
+	typeFilter := filter.NewIncludeFilter([]string{"string"})
 
-	rule := NewDropField(measurementFilter, fieldFilter, &filter.AlwaysTrueFilter{})
+	rule := NewDropField(measurementFilter, fieldFilter, typeFilter)
 
 	key := func(serie string, field string) []byte {
 		return tsm1.SeriesFieldKeyBytes(serie, field)
 	}
 
-	measurements := []measurementFields{
+	shard := newTestShard(t, []measurementFields{
 		{
 			measurement: "mem",
 			fields: map[string]influxql.DataType{
@@ -119,77 +110,39 @@ func TestDropField_ShouldUpdateFieldsIndex(t *testing.T) {
 			},
 		},
 		{
-			measurement: "cpu",
+			measurement: "swap",
 			fields: map[string]influxql.DataType{
-				"idle": influxql.Float,
-				"used": influxql.Float,
+				"used": influxql.String,
 			},
 		},
-	}
-
-	shard := newTestShard(measurements)
+	})
 
 	var data = []struct {
 		key    []byte
 		values []tsm1.Value
-
-		expectedKey []byte
 	}{
-		{key("mem,host=my-host", "used"), []tsm1.Value{tsm1.NewFloatValue(0, 3.5)}, nil},
-		{key("mem,host=other-host", "used"), []tsm1.Value{tsm1.NewFloatValue(0, 3.5)}, nil},
-		{key("mem,host=my-host", "available"), []tsm1.Value{tsm1.NewFloatValue(0, 3.5)}, key("mem,host=my-host", "available")},
-		{key("cpu,host=my-host", "idle"), []tsm1.Value{tsm1.NewFloatValue(0, 3.5)}, key("cpu,host=my-host", "idle")},
-		{key("cpu,host=my-host", "used"), []tsm1.Value{tsm1.NewFloatValue(0, 3.5)}, key("cpu,host=my-host", "used")},
+		{key("mem,host=my-host", "used"), []tsm1.Value{tsm1.NewFloatValue(0, 3.5)}},
+		{key("mem,host=other-host", "used"), []tsm1.Value{tsm1.NewStringValue(0, "3.5")}},
+		{key("mem,host=my-host", "available"), []tsm1.Value{tsm1.NewFloatValue(0, 3.5)}},
+		{key("swap,host=my-host", "used"), []tsm1.Value{tsm1.NewStringValue(0, "3.5")}},
 	}
 
 	assert.True(t, rule.StartShard(shard))
 
-	remainingFields := make(map[string][]string)
-	deletedFields := make(map[string][]string)
-
-	addFieldTo := func(fieldsMap map[string][]string, measurement string, name string) {
-		if fields, ok := fieldsMap[measurement]; ok {
-			fieldsMap[measurement] = append(fields, name)
-		} else {
-			fieldsMap[measurement] = []string{name}
-		}
-	}
-
 	for _, d := range data {
-		key, _, err := rule.Apply(d.key, d.values)
-
+		_, _, err := rule.Apply(filter.NewKey(d.key), d.values)
 		assert.NoError(t, err)
-		assert.Equalf(t, key, d.expectedKey, "expected key '%s' but got '%s'", d.expectedKey, key)
-
-		_, field := tsm1.SeriesAndFieldFromCompositeKey(d.key)
-		measurement, _ := models.ParseKey(d.key)
-
-		if key == nil {
-			addFieldTo(deletedFields, measurement, string(field))
-		} else {
-			addFieldTo(remainingFields, measurement, string(field))
-		}
 	}
 
 	assert.NoError(t, rule.EndShard())
 
-	for m, fs := range remainingFields {
-		fields := shard.FieldsIndex.FieldsByString(m)
-		assert.NotNil(t, fields)
-
-		for _, f := range fs {
-			field := fields.Field(f)
-			assert.NotNil(t, field)
-		}
+	// The index is rebuilt by the engine from the remaining keys, the rule does not touch it
+	mem := shard.FieldsIndex.FieldsByString("mem")
+	if assert.NotNil(t, mem) {
+		assert.Equal(t, map[string]influxql.DataType{"used": influxql.Float, "available": influxql.Float}, mem.FieldSet())
 	}
-
-	for m, fs := range deletedFields {
-		fields := shard.FieldsIndex.FieldsByString(m)
-		assert.NotNil(t, fields)
-
-		for _, f := range fs {
-			field := fields.Field(f)
-			assert.Nil(t, field)
-		}
+	swap := shard.FieldsIndex.FieldsByString("swap")
+	if assert.NotNil(t, swap) {
+		assert.Equal(t, map[string]influxql.DataType{"used": influxql.String}, swap.FieldSet())
 	}
 }
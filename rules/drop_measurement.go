@@ -6,13 +6,12 @@ import (
 	"github.com/Abc-Arbitrage/infix/filter"
 	"github.com/Abc-Arbitrage/infix/logging"
 	"github.com/Abc-Arbitrage/infix/storage"
-	"github.com/influxdata/influxdb/models"
 	"github.com/influxdata/influxdb/tsdb/engine/tsm1"
 )
 
 // DropMeasurementRule is a rule to drop measurements
 type DropMeasurementRule struct {
-	filter filter.Filter
+	filter *filter.MeasurementFilter
 
 	check bool
 
@@ -70,8 +69,13 @@ func (r *DropMeasurementRule) WithLogger(logger *log.Logger) {
 }
 
 // FilterKey implements Rule interface
-func (r *DropMeasurementRule) FilterKey(key []byte) bool {
-	return r.filter.Filter(key)
+func (r *DropMeasurementRule) FilterKey(key *filter.Key) bool {
+	return r.filter.FilterKey(key)
+}
+
+// FilterMeasurement implements MeasurementRule interface
+func (r *DropMeasurementRule) FilterMeasurement(measurement []byte) bool {
+	return r.filter.FilterMeasurement(measurement)
 }
 
 // Start implements Rule interface
@@ -132,17 +136,16 @@ func (r *DropMeasurementRule) EndWAL() {
 }
 
 // Apply implements Rule interface
-func (r *DropMeasurementRule) Apply(key []byte, values []tsm1.Value) ([]byte, []tsm1.Value, error) {
-	if r.filter.Filter(key) {
-		seriesKey, _ := tsm1.SeriesAndFieldFromCompositeKey(key)
-		measurement, _ := models.ParseKey(seriesKey)
+func (r *DropMeasurementRule) Apply(key *filter.Key, values []tsm1.Value) ([]byte, []tsm1.Value, error) {
+	if r.filter.FilterKey(key) {
+		measurement := string(key.Measurement())
 
 		r.logger.Printf("Dropping '%s'", measurement)
 		r.dropped[measurement] = true
 		return nil, nil, nil
 	}
 
-	return key, values, nil
+	return key.Raw, values, nil
 }
 
 // Count returns the number of measurements dropped
@@ -3,6 +3,7 @@ package rules
 import (
 	"testing"
 
+	"github.com/Abc-Arbitrage/infix/filter"
 	"github.com/influxdata/influxdb/models"
 	"github.com/influxdata/influxdb/tsdb/engine/tsm1"
 	"github.com/stretchr/testify/assert"
@@ -30,7 +31,7 @@ func TestDropMeasurement_ShouldApply(t *testing.T) {
 	}
 
 	for _, d := range data {
-		newKey, _, err := rule.Apply([]byte(d.key), d.values)
+		newKey, _, err := rule.Apply(filter.NewKey([]byte(d.key)), d.values)
 		assert.NoError(t, err)
 		assert.Equal(t, newKey, d.newKey)
 	}
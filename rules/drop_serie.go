@@ -6,7 +6,6 @@ import (
 	"github.com/Abc-Arbitrage/infix/filter"
 	"github.com/Abc-Arbitrage/infix/logging"
 
-	"github.com/influxdata/influxdb/models"
 
 	"github.com/Abc-Arbitrage/infix/storage"
 	"github.com/influxdata/influxdb/tsdb/engine/tsm1"
@@ -55,8 +54,8 @@ func (r *DropSerieRule) WithLogger(logger *log.Logger) {
 }
 
 // FilterKey implements Rule interface
-func (r *DropSerieRule) FilterKey(key []byte) bool {
-	return r.dropFilter.Filter(key)
+func (r *DropSerieRule) FilterKey(key *filter.Key) bool {
+	return filter.FilterKey(r.dropFilter, key)
 }
 
 // Start implements Rule interface
@@ -113,18 +112,16 @@ func (r *DropSerieRule) EndWAL() {
 }
 
 // Apply implements Rule interface
-func (r *DropSerieRule) Apply(key []byte, values []tsm1.Value) ([]byte, []tsm1.Value, error) {
+func (r *DropSerieRule) Apply(key *filter.Key, values []tsm1.Value) ([]byte, []tsm1.Value, error) {
 	r.total++
 
-	if r.dropFilter.Filter(key) {
-		seriesKey, _ := tsm1.SeriesAndFieldFromCompositeKey(key)
-		measurement, _ := models.ParseKey(seriesKey)
-		r.logger.Printf("Dropping serie for measurement %s", measurement)
+	if filter.FilterKey(r.dropFilter, key) {
+		r.logger.Printf("Dropping serie for measurement %s", key.Measurement())
 		r.count++
 		return nil, nil, nil
 	}
 
-	return key, values, nil
+	return key.Raw, values, nil
 }
 
 // Sample implements the Config interface
@@ -21,8 +21,8 @@ func TestDropSerie_ShouldApplyAndDrop(t *testing.T) {
 
 	assert.NoError(t, err)
 
-	filter := filter.NewSerieFilter(measurementFilter, tagsFilter, nil)
-	rule := NewDropSerieRule(filter)
+	serieFilter := filter.NewSerieFilter(measurementFilter, tagsFilter, nil)
+	rule := NewDropSerieRule(serieFilter)
 
 	makeKey := func(serie string, field string) []byte {
 		return tsm1.SeriesFieldKeyBytes(serie, field)
@@ -49,7 +49,7 @@ func TestDropSerie_ShouldApplyAndDrop(t *testing.T) {
 	}
 
 	for _, d := range data {
-		newKey, newValues, err := rule.Apply(d.key, d.values)
+		newKey, newValues, err := rule.Apply(filter.NewKey(d.key), d.values)
 		assert.NoError(t, err)
 		assert.Equal(t, newKey, d.expectedKey)
 		assert.Equal(t, newValues, d.expectedValues)
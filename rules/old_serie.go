@@ -10,6 +10,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/Abc-Arbitrage/infix/filter"
 	"github.com/Abc-Arbitrage/infix/logging"
 
 	"github.com/Abc-Arbitrage/infix/storage"
@@ -93,9 +94,19 @@ type OldSerieRule struct {
 	logger *log.Logger
 }
 
+// DropOldSerieRule defines a rule to drop series that are oldest than a given timestamp. The last timestamp of each
+// serie is computed across the selected shards when they are scanned, before any of them is rewritten
+type DropOldSerieRule struct {
+	*OldSerieRule
+
+	check   bool
+	dropped map[string]bool
+}
+
 // OldSerieRuleConfig represents the toml configuration for OldSerieRule
 type OldSerieRuleConfig struct {
 	Time            string
+	Action          string
 	ByField         bool
 	Out             string
 	Format          string
@@ -135,6 +146,23 @@ func newOldSerieRule(t time.Time, byField bool, out io.Writer, formater formater
 	}
 }
 
+// NewDropOldSerieRule creates a new DropOldSerieRule, writing the dropped series to out
+func NewDropOldSerieRule(t time.Time, byField bool, out io.Writer, format string) (*DropOldSerieRule, error) {
+	formater, err := newFormater(format, false, "")
+	if err != nil {
+		return nil, err
+	}
+
+	return newDropOldSerieRule(t, byField, out, formater), nil
+}
+
+func newDropOldSerieRule(t time.Time, byField bool, out io.Writer, formater formater) *DropOldSerieRule {
+	return &DropOldSerieRule{
+		OldSerieRule: newOldSerieRule(t, byField, out, formater),
+		dropped:      make(map[string]bool),
+	}
+}
+
 // CheckMode sets the check mode on the rule
 func (r *OldSerieRule) CheckMode(check bool) {
 
@@ -142,7 +170,7 @@ func (r *OldSerieRule) CheckMode(check bool) {
 
 // Flags implements Rule interface
 func (r *OldSerieRule) Flags() int {
-	return TSMReadOnly
+	return ReadOnly
 }
 
 // WithLogger sets the logger on the rule
@@ -151,8 +179,8 @@ func (r *OldSerieRule) WithLogger(logger *log.Logger) {
 }
 
 // FilterKey implements Rule interface
-func (r *OldSerieRule) FilterKey(key []byte) bool {
-	return false
+func (r *OldSerieRule) FilterKey(key *filter.Key) bool {
+	return true
 }
 
 // Start implements Rule interface
@@ -211,40 +239,109 @@ func (r *OldSerieRule) EndWAL() {
 }
 
 // Apply implements Rule interface
-func (r *OldSerieRule) Apply(key []byte, values []tsm1.Value) ([]byte, []tsm1.Value, error) {
-	if len(values) > 0 {
-		maxTs := values[len(values)-1].UnixNano()
-		key := r.makeKey(key)
-		s := string(key)
-		if ts, ok := r.series[s]; ok {
-			if maxTs > ts {
-				r.series[s] = maxTs
-			}
-		} else {
-			r.series[s] = maxTs
+func (r *OldSerieRule) Apply(key *filter.Key, values []tsm1.Value) ([]byte, []tsm1.Value, error) {
+	r.track(key, values)
+	return nil, nil, nil
+}
+
+// track updates the last timestamp of the serie of a key
+func (r *OldSerieRule) track(key *filter.Key, values []tsm1.Value) {
+	if len(values) == 0 {
+		return
+	}
+
+	// Values of WAL entries are not sorted by time
+	maxTs := values[0].UnixNano()
+	for _, v := range values[1:] {
+		if v.UnixNano() > maxTs {
+			maxTs = v.UnixNano()
 		}
 	}
 
-	return nil, nil, nil
+	s := r.makeKey(key)
+	if ts, ok := r.series[s]; !ok || maxTs > ts {
+		r.series[s] = maxTs
+	}
+}
+
+// old returns true if the serie of a key has been tracked and its last timestamp is not after the configured time
+func (r *OldSerieRule) old(key *filter.Key) bool {
+	ts, ok := r.series[r.makeKey(key)]
+	return ok && ts <= r.unixNano
 }
 
 // Print will print the list of series detected as old
 func (r *OldSerieRule) Print(iow io.Writer) {
 }
 
-func (r *OldSerieRule) makeKey(key []byte) string {
+func (r *OldSerieRule) makeKey(key *filter.Key) string {
 	if !r.byField {
-		seriesKey, _ := tsm1.SeriesAndFieldFromCompositeKey(key)
-		return string(seriesKey)
+		return string(key.SeriesKey())
 	}
 
-	return string(key)
+	return string(key.Raw)
+}
+
+// CheckMode sets the check mode on the rule
+func (r *DropOldSerieRule) CheckMode(check bool) {
+	r.check = check
+}
+
+// Flags implements Rule interface
+func (r *DropOldSerieRule) Flags() int {
+	return Standard
+}
+
+// FilterKey implements Rule interface
+func (r *DropOldSerieRule) FilterKey(key *filter.Key) bool {
+	return r.old(key)
+}
+
+// End implements Rule interface
+func (r *DropOldSerieRule) End() {
+	var keys []string
+	for k := range r.dropped {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		r.formater.format(r.out, key, r.series[key])
+	}
+	if r.check {
+		r.logger.Printf("Would drop %d/%d series as old", len(keys), len(r.series))
+	} else {
+		r.logger.Printf("Dropped %d/%d series as old", len(keys), len(r.series))
+	}
+}
+
+// ScanShard implements ScanRule interface
+func (r *DropOldSerieRule) ScanShard(info storage.ShardInfo) bool {
+	return true
+}
+
+// Scan implements ScanRule interface
+func (r *DropOldSerieRule) Scan(key *filter.Key, values []tsm1.Value) error {
+	r.track(key, values)
+	return nil
+}
+
+// Apply implements Rule interface
+func (r *DropOldSerieRule) Apply(key *filter.Key, values []tsm1.Value) ([]byte, []tsm1.Value, error) {
+	if r.old(key) {
+		r.dropped[r.makeKey(key)] = true
+		return nil, nil, nil
+	}
+
+	return key.Raw, values, nil
 }
 
 // Sample implements Config interface
 func (c *OldSerieRuleConfig) Sample() string {
 	return `
     time="2020-01-01T00:08:00Z"
+    action="list"
+    #action="drop"
     out="stdout"
     #out="out_file.log"
     format="text"
@@ -284,5 +381,12 @@ func (c *OldSerieRuleConfig) Build() (Rule, error) {
 		return nil, err
 	}
 
-	return newOldSerieRule(t, c.ByField, out, formater), nil
+	switch c.Action {
+	case "", "list":
+		return newOldSerieRule(t, c.ByField, out, formater), nil
+	case "drop":
+		return newDropOldSerieRule(t, c.ByField, out, formater), nil
+	default:
+		return nil, fmt.Errorf("Unknown action %s", c.Action)
+	}
 }
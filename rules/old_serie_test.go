@@ -6,6 +6,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/Abc-Arbitrage/infix/filter"
 	"github.com/stretchr/testify/assert"
 
 	"github.com/influxdata/influxdb/tsdb/engine/tsm1"
@@ -59,7 +60,7 @@ func TestOldSerie_ShouldDetectAndWriteOldSerie(t *testing.T) {
 		if d.expectedOld {
 			totalExpectedOld++
 		}
-		key, values, err := rule.Apply(d.key, d.values)
+		key, values, err := rule.Apply(filter.NewKey(d.key), d.values)
 		assert.NoError(t, err)
 		assert.Nil(t, key)
 		assert.Nil(t, values)
@@ -112,7 +113,7 @@ func TestOldSerie_ShouldDetectAndWriteOldSerieByField(t *testing.T) {
 		if d.expectedOld {
 			totalExpectedOld++
 		}
-		key, values, err := rule.Apply(d.key, d.values)
+		key, values, err := rule.Apply(filter.NewKey(d.key), d.values)
 		assert.NoError(t, err)
 		assert.Nil(t, key)
 		assert.Nil(t, values)
@@ -130,6 +131,56 @@ func TestOldSerie_ShouldDetectAndWriteOldSerieByField(t *testing.T) {
 	}
 }
 
+func TestOldSerie_ShouldBuildDropAction(t *testing.T) {
+	config := &OldSerieRuleConfig{Time: "2020-01-01T00:08:00Z", Action: "drop"}
+	rule, err := config.Build()
+	assert.NoError(t, err)
+	assert.IsType(t, &DropOldSerieRule{}, rule)
+
+	config.Action = "unknown"
+	_, err = config.Build()
+	assert.Error(t, err)
+}
+
+func TestOldSerie_ShouldDropScannedOldSerie(t *testing.T) {
+	ts := time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+	w := &captureWriter{}
+	rule, err := NewDropOldSerieRule(ts, false, w, "text")
+	assert.NoError(t, err)
+
+	var tags = map[string]string{
+		"host": "my-host",
+	}
+
+	oldKey := filter.NewKey(makeKey("cpu", tags, "idle"))
+	recentKey := filter.NewKey(makeKey("mem", tags, "available"))
+
+	rule.Start()
+
+	// Series are old unless one of their values, possibly in another shard, is recent
+	assert.NoError(t, rule.Scan(oldKey, generateValuesBefore(ts, 10)))
+	assert.NoError(t, rule.Scan(recentKey, generateValuesBefore(ts, 10)))
+	assert.NoError(t, rule.Scan(recentKey, append(generateValuesAfter(ts, 1), generateValuesBefore(ts, 10)...)))
+
+	assert.True(t, rule.FilterKey(oldKey))
+	assert.False(t, rule.FilterKey(recentKey))
+
+	key, values, err := rule.Apply(oldKey, generateValuesBefore(ts, 10))
+	assert.NoError(t, err)
+	assert.Nil(t, key)
+	assert.Nil(t, values)
+
+	recentValues := generateValuesBefore(ts, 10)
+	key, values, err = rule.Apply(recentKey, recentValues)
+	assert.NoError(t, err)
+	assert.Equal(t, recentKey.Raw, key)
+	assert.Equal(t, recentValues, values)
+
+	rule.End()
+	assert.Equal(t, []string{"cpu,host=my-host\n"}, w.captured)
+}
+
 func generateValuesBefore(ts time.Time, count int) (values []tsm1.Value) {
 	for i := 0; i < count; i++ {
 		before := ts.Add(time.Duration(-1) * time.Hour)
@@ -8,7 +8,6 @@ import (
 
 	"github.com/Abc-Arbitrage/infix/filter"
 	"github.com/Abc-Arbitrage/infix/storage"
-	"github.com/influxdata/influxdb/models"
 	"github.com/influxdata/influxdb/tsdb/engine/tsm1"
 	"github.com/influxdata/influxql"
 )
@@ -23,7 +22,7 @@ type RenameFieldRule struct {
 	check bool
 	shard storage.ShardInfo
 
-	measurementFilter filter.Filter
+	measurementFilter *filter.MeasurementFilter
 	fieldFilter       filter.Filter
 
 	renamed  map[string][]fieldRename
@@ -66,8 +65,13 @@ func (r *RenameFieldRule) WithLogger(logger *log.Logger) {
 }
 
 // FilterKey implements Rule interface
-func (r *RenameFieldRule) FilterKey(key []byte) bool {
-	return r.measurementFilter.Filter(key)
+func (r *RenameFieldRule) FilterKey(key *filter.Key) bool {
+	return r.measurementFilter.FilterKey(key)
+}
+
+// FilterMeasurement implements MeasurementRule interface
+func (r *RenameFieldRule) FilterMeasurement(measurement []byte) bool {
+	return r.measurementFilter.FilterMeasurement(measurement)
 }
 
 // Start implements Rule interface
@@ -157,10 +161,10 @@ func (r *RenameFieldRule) EndWAL() {
 }
 
 // Apply implements Rule interface
-func (r *RenameFieldRule) Apply(key []byte, values []tsm1.Value) ([]byte, []tsm1.Value, error) {
-	seriesKey, field := tsm1.SeriesAndFieldFromCompositeKey(key)
-	if r.measurementFilter.Filter(key) && r.fieldFilter.Filter(field) {
-		measurement, _ := models.ParseKey(seriesKey)
+func (r *RenameFieldRule) Apply(key *filter.Key, values []tsm1.Value) ([]byte, []tsm1.Value, error) {
+	field := key.Field()
+	if r.measurementFilter.FilterKey(key) && r.fieldFilter.Filter(field) {
+		measurement := string(key.Measurement())
 
 		newField := r.renameFn(string(field))
 		r.logger.Printf("Renaming field '%s' to '%s' for measurement %s", field, newField, measurement)
@@ -181,11 +185,11 @@ func (r *RenameFieldRule) Apply(key []byte, values []tsm1.Value) ([]byte, []tsm1
 			}
 		}
 
-		newKey := tsm1.SeriesFieldKeyBytes(string(seriesKey), newField)
+		newKey := tsm1.SeriesFieldKeyBytes(string(key.SeriesKey()), newField)
 		return newKey, values, nil
 	}
 
-	return key, values, nil
+	return key.Raw, values, nil
 }
 
 // Sample implements Config interface
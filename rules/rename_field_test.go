@@ -90,7 +90,7 @@ func TestRenameField_ShouldApplyAndRename(t *testing.T) {
 	}
 
 	for _, d := range data {
-		key, values, err := rule.Apply(d.key, d.values)
+		key, values, err := rule.Apply(filter.NewKey(d.key), d.values)
 
 		assert.NoError(t, err)
 		assert.Equalf(t, key, d.expectedKey, "expected key '%s' but got '%s'", d.expectedKey, d.key)
@@ -123,7 +123,7 @@ func TestRenameField_ShouldUpdateFieldsIndex(t *testing.T) {
 		},
 	}
 
-	shard := newTestShard(measurements)
+	shard := newTestShard(t, measurements)
 
 	var data = []struct {
 		key    []byte
@@ -139,7 +139,7 @@ func TestRenameField_ShouldUpdateFieldsIndex(t *testing.T) {
 	rule.StartShard(shard)
 
 	for _, d := range data {
-		_, _, err := rule.Apply(d.key, d.values)
+		_, _, err := rule.Apply(filter.NewKey(d.key), d.values)
 		assert.NoError(t, err)
 	}
 
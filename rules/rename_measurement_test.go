@@ -5,6 +5,7 @@ import (
 
 	"github.com/influxdata/influxql"
 
+	"github.com/Abc-Arbitrage/infix/filter"
 	"github.com/influxdata/influxdb/models"
 	"github.com/influxdata/influxdb/tsdb/engine/tsm1"
 	"github.com/stretchr/testify/assert"
@@ -65,7 +66,7 @@ func TestRenameMeasurement_ShouldApplyAndRename(t *testing.T) {
 	}
 
 	for _, d := range data {
-		newKey, values, err := rule.Apply([]byte(d.key), d.values)
+		newKey, values, err := rule.Apply(filter.NewKey([]byte(d.key)), d.values)
 		assert.NoError(t, err)
 		assert.Equal(t, len(d.values), len(values))
 		assert.Equal(t, newKey, d.newKey)
@@ -93,7 +94,7 @@ func TestRenameMeasurement_ShouldApplyAndRenameWithPattern(t *testing.T) {
 	}
 
 	for _, d := range data {
-		newKey, values, err := rule.Apply([]byte(d.key), d.values)
+		newKey, values, err := rule.Apply(filter.NewKey([]byte(d.key)), d.values)
 		assert.NoError(t, err)
 		assert.Equal(t, len(d.values), len(values))
 		assert.Equal(t, newKey, d.newKey)
@@ -133,12 +134,12 @@ func TestRenameMeasurement_ShouldUpdateFieldsIndex(t *testing.T) {
 		{makeKey("disk", tags, "usage"), makeKey("linux.disk", tags, "usage"), []tsm1.Value{tsm1.NewValue(0, 20.0)}},
 	}
 
-	shard := newTestShard(measurements)
+	shard := newTestShard(t, measurements)
 
 	rule.StartShard(shard)
 
 	for _, d := range data {
-		_, _, err := rule.Apply([]byte(d.key), d.values)
+		_, _, err := rule.Apply(filter.NewKey([]byte(d.key)), d.values)
 		assert.NoError(t, err)
 	}
 
@@ -171,3 +172,14 @@ func TestRenameMeasurement_ShouldUpdateFieldsIndex(t *testing.T) {
 
 	assert.Equal(t, rule.Count(), 0)
 }
+
+func TestRenameMeasurement_ShouldFilterMeasurement(t *testing.T) {
+	rule, err := NewRenameMeasurementWithPattern("^cpu$", func(name string) string { return "linux." + name })
+	assert.NoError(t, err)
+
+	var measurementRule MeasurementRule = rule
+
+	assert.True(t, measurementRule.FilterMeasurement([]byte("cpu")))
+	assert.False(t, measurementRule.FilterMeasurement([]byte("cpu_usage")))
+	assert.False(t, measurementRule.FilterMeasurement([]byte("disk")))
+}
@@ -22,7 +22,7 @@ var ErrMissingRenameTo = errors.New("missing rename 'to'")
 
 // RenameMeasurementRule represents a rule to rename a measurement
 type RenameMeasurementRule struct {
-	filter filter.Filter
+	filter *filter.MeasurementFilter
 
 	renameFn RenameFn
 	renamed  map[string]string
@@ -85,8 +85,13 @@ func (r *RenameMeasurementRule) WithLogger(logger *log.Logger) {
 }
 
 // FilterKey implements Rule interface
-func (r *RenameMeasurementRule) FilterKey(key []byte) bool {
-	return r.filter.Filter(key)
+func (r *RenameMeasurementRule) FilterKey(key *filter.Key) bool {
+	return r.filter.FilterKey(key)
+}
+
+// FilterMeasurement implements MeasurementRule interface
+func (r *RenameMeasurementRule) FilterMeasurement(measurement []byte) bool {
+	return r.filter.FilterMeasurement(measurement)
 }
 
 // Start implements Rule interface
@@ -162,21 +167,20 @@ func (r *RenameMeasurementRule) EndWAL() {
 }
 
 // Apply implements Rule interface
-func (r *RenameMeasurementRule) Apply(key []byte, values []tsm1.Value) ([]byte, []tsm1.Value, error) {
-	if r.filter.Filter(key) {
-		seriesKey, field := tsm1.SeriesAndFieldFromCompositeKey(key)
-		measurement, tags := models.ParseKey(seriesKey)
+func (r *RenameMeasurementRule) Apply(key *filter.Key, values []tsm1.Value) ([]byte, []tsm1.Value, error) {
+	if r.filter.FilterKey(key) {
+		measurement := string(key.Measurement())
 
 		newName := r.renameFn(measurement)
 		r.logger.Printf("Renaming '%s' to '%s'", measurement, newName)
-		newSeriesKey := models.MakeKey([]byte(newName), tags)
-		newKey := tsm1.SeriesFieldKeyBytes(string(newSeriesKey), string(field))
+		newSeriesKey := models.MakeKey([]byte(newName), key.Tags())
+		newKey := tsm1.SeriesFieldKeyBytes(string(newSeriesKey), string(key.Field()))
 		r.renamed[measurement] = newName
 
 		return newKey, values, nil
 	}
 
-	return key, values, nil
+	return key.Raw, values, nil
 }
 
 // Count returns the number of measurements renamed
@@ -14,7 +14,7 @@ import (
 
 // RenameTagRule is a rule to rename a tag key
 type RenameTagRule struct {
-	measurementFilter filter.Filter
+	measurementFilter *filter.MeasurementFilter
 	tagFilter         filter.Filter
 
 	check    bool
@@ -57,8 +57,13 @@ func (r *RenameTagRule) WithLogger(logger *log.Logger) {
 }
 
 // FilterKey implements Rule interface
-func (r *RenameTagRule) FilterKey(key []byte) bool {
-	return r.measurementFilter.Filter(key)
+func (r *RenameTagRule) FilterKey(key *filter.Key) bool {
+	return r.measurementFilter.FilterKey(key)
+}
+
+// FilterMeasurement implements MeasurementRule interface
+func (r *RenameTagRule) FilterMeasurement(measurement []byte) bool {
+	return r.measurementFilter.FilterMeasurement(measurement)
 }
 
 // Start implements Rule interface
@@ -100,13 +105,13 @@ func (r *RenameTagRule) EndWAL() {
 }
 
 // Apply implements Rule interface
-func (r *RenameTagRule) Apply(key []byte, values []tsm1.Value) ([]byte, []tsm1.Value, error) {
-	if r.measurementFilter.Filter(key) {
-		seriesKey, field := tsm1.SeriesAndFieldFromCompositeKey(key)
-		measurement, tags := models.ParseKey(seriesKey)
+func (r *RenameTagRule) Apply(key *filter.Key, values []tsm1.Value) ([]byte, []tsm1.Value, error) {
+	if r.measurementFilter.FilterKey(key) {
+		measurement := key.Measurement()
 		var newTags models.Tags
 
-		for _, t := range tags {
+		// Tags are cloned as they are shared by the parsed key
+		for _, t := range key.Tags() {
 			newTag := t.Clone()
 			if r.tagFilter.Filter(t.Key) {
 				newTagKey := r.renameFn(string(t.Key))
@@ -116,12 +121,12 @@ func (r *RenameTagRule) Apply(key []byte, values []tsm1.Value) ([]byte, []tsm1.V
 			newTags = append(newTags, newTag)
 		}
 
-		newKey := models.MakeKey([]byte(measurement), newTags)
-		newSeriesKey := tsm1.SeriesFieldKeyBytes(string(newKey), string(field))
+		newKey := models.MakeKey(measurement, newTags)
+		newSeriesKey := tsm1.SeriesFieldKeyBytes(string(newKey), string(key.Field()))
 		return newSeriesKey, values, nil
 	}
 
-	return key, values, nil
+	return key.Raw, values, nil
 }
 
 // Sample implements Config interface
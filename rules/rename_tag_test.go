@@ -115,7 +115,7 @@ func TestRenameTag_ShouldApply(t *testing.T) {
 	}
 
 	for _, d := range data {
-		key, values, err := rule.Apply(d.key, d.values)
+		key, values, err := rule.Apply(filter.NewKey(d.key), d.values)
 
 		assert.NoError(t, err)
 		assert.Equal(t, values, d.values)
@@ -63,12 +63,13 @@ const (
 	Standard = TSMWriteOnly | WALWriteOnly
 )
 
-// Rule represents a rule to apply to a given TSM or WAL entry
+// Rule represents a rule to apply to a given TSM or WAL entry. Keys are given parsed so that they are only parsed
+// once whatever the number of rules
 type Rule interface {
 	CheckMode(check bool)
 	Flags() int
 
-	FilterKey(key []byte) bool
+	FilterKey(key *filter.Key) bool
 
 	Start()
 	End()
@@ -82,5 +83,28 @@ type Rule interface {
 	StartWAL(path string) bool
 	EndWAL()
 
-	Apply(key []byte, values []tsm1.Value) (newKey []byte, newValues []tsm1.Value, err error)
+	Apply(key *filter.Key, values []tsm1.Value) (newKey []byte, newValues []tsm1.Value, err error)
+}
+
+// MeasurementRule is implemented by rules that only apply to keys of some measurements. It allows skipping whole
+// ranges of keys of a TSM file without filtering each key
+type MeasurementRule interface {
+	FilterMeasurement(measurement []byte) bool
+}
+
+// ScanRule is implemented by rules that need to read the selected shards before any of them is processed. All the
+// keys of the TSM and WAL files of the shards for which ScanShard returns true are given to Scan first, then the
+// shards are processed as usual
+type ScanRule interface {
+	ScanShard(info storage.ShardInfo) bool
+	Scan(key *filter.Key, values []tsm1.Value) error
+}
+
+// Scans returns true if a rule, possibly scoped, needs the shards to be scanned before they are processed
+func Scans(r Rule) bool {
+	if sr, ok := r.(*ScopedRule); ok {
+		r = sr.Rule
+	}
+	_, ok := r.(ScanRule)
+	return ok
 }
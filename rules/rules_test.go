@@ -1,6 +1,7 @@
 package rules
 
 import (
+	"path/filepath"
 	"testing"
 
 	"github.com/Abc-Arbitrage/infix/filter"
@@ -35,8 +36,8 @@ func assertBuildFromStringCallback(t *testing.T, tomlConfig string, config Confi
 	callback(rule, err)
 }
 
-func newTestShard(measurements []measurementFields) storage.ShardInfo {
-	index, err := tsdb.NewMeasurementFieldSet("path")
+func newTestShard(t *testing.T, measurements []measurementFields) storage.ShardInfo {
+	index, err := tsdb.NewMeasurementFieldSet(filepath.Join(t.TempDir(), "fields.idx"))
 	if err != nil {
 		panic(err)
 	}
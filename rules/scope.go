@@ -0,0 +1,166 @@
+package rules
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/Abc-Arbitrage/infix/filter"
+	"github.com/Abc-Arbitrage/infix/storage"
+	"github.com/influxdata/influxdb/tsdb/engine/tsm1"
+	"github.com/naoina/toml/ast"
+)
+
+const (
+	_scopeDatabaseKey  = "database"
+	_scopeRetentionKey = "retention"
+	_scopeShardsKey    = "shards"
+)
+
+// Scope restricts a rule to a set of databases, retention policies and shards. A nil filter matches everything
+type Scope struct {
+	Database        filter.Filter
+	RetentionPolicy filter.Filter
+	Shard           filter.Filter
+
+	description []string
+}
+
+// Match returns true if the given shard is in the scope
+func (s *Scope) Match(info storage.ShardInfo) bool {
+	if s.Database != nil && !s.Database.Filter([]byte(info.Database)) {
+		return false
+	}
+	if s.RetentionPolicy != nil && !s.RetentionPolicy.Filter([]byte(info.RetentionPolicy)) {
+		return false
+	}
+	if s.Shard != nil && !s.Shard.Filter([]byte(strconv.FormatUint(info.ID, 10))) {
+		return false
+	}
+	return true
+}
+
+// String implements Stringer interface
+func (s *Scope) String() string {
+	return strings.Join(s.description, ", ")
+}
+
+// unmarshalScope extracts scope selectors from a rule's toml table. Selectors are removed from the table
+// so that the rule configuration can be unmarshaled. A nil scope is returned if the table has no selector
+func unmarshalScope(table *ast.Table) (*Scope, error) {
+	scope := &Scope{}
+	found := false
+
+	for _, s := range []struct {
+		key    string
+		filter *filter.Filter
+	}{
+		{_scopeDatabaseKey, &scope.Database},
+		{_scopeRetentionKey, &scope.RetentionPolicy},
+		{_scopeShardsKey, &scope.Shard},
+	} {
+		val, ok := table.Fields[s.key]
+		if !ok {
+			continue
+		}
+
+		kv, ok := val.(*ast.KeyValue)
+		if !ok {
+			return nil, fmt.Errorf("%s: invalid scope. Expected a pattern or a list", s.key)
+		}
+
+		f, desc, err := newScopeFilter(kv)
+		if err != nil {
+			return nil, err
+		}
+
+		*s.filter = f
+		scope.description = append(scope.description, fmt.Sprintf("%s %s", s.key, desc))
+		delete(table.Fields, s.key)
+		found = true
+	}
+
+	if !found {
+		return nil, nil
+	}
+
+	return scope, nil
+}
+
+// newScopeFilter creates a PatternFilter from a string value or an IncludeFilter from a list of strings or integers
+func newScopeFilter(kv *ast.KeyValue) (filter.Filter, string, error) {
+	switch v := kv.Value.(type) {
+	case *ast.String:
+		f, err := filter.NewPatternFilter(v.Value)
+		if err != nil {
+			return nil, "", fmt.Errorf("%s:%d invalid pattern: %v", kv.Key, kv.Line, err)
+		}
+		return f, fmt.Sprintf("=~ /%s/", v.Value), nil
+	case *ast.Integer:
+		return filter.NewIncludeFilter([]string{v.Value}), fmt.Sprintf("in [%s]", v.Value), nil
+	case *ast.Array:
+		var values []string
+		for _, item := range v.Value {
+			switch i := item.(type) {
+			case *ast.String:
+				values = append(values, i.Value)
+			case *ast.Integer:
+				values = append(values, i.Value)
+			default:
+				return nil, "", fmt.Errorf("%s:%d invalid configuration. Expected string or integer values", kv.Key, kv.Line)
+			}
+		}
+		return filter.NewIncludeFilter(values), fmt.Sprintf("in [%s]", strings.Join(values, ", ")), nil
+	default:
+		return nil, "", fmt.Errorf("%s:%d invalid configuration. Expected a pattern or a list", kv.Key, kv.Line)
+	}
+}
+
+// ScopedRule is a Rule that only applies to shards matching a Scope
+type ScopedRule struct {
+	Rule
+	scope *Scope
+}
+
+// NewScopedRule creates a new ScopedRule
+func NewScopedRule(rule Rule, scope *Scope) *ScopedRule {
+	return &ScopedRule{
+		Rule:  rule,
+		scope: scope,
+	}
+}
+
+// Scope returns the scope of the rule
+func (r *ScopedRule) Scope() *Scope {
+	return r.scope
+}
+
+// StartShard implements Rule interface
+func (r *ScopedRule) StartShard(info storage.ShardInfo) bool {
+	if !r.scope.Match(info) {
+		return false
+	}
+	return r.Rule.StartShard(info)
+}
+
+// FilterMeasurement implements MeasurementRule interface
+func (r *ScopedRule) FilterMeasurement(measurement []byte) bool {
+	if mr, ok := r.Rule.(MeasurementRule); ok {
+		return mr.FilterMeasurement(measurement)
+	}
+	return true
+}
+
+// ScanShard implements ScanRule interface
+func (r *ScopedRule) ScanShard(info storage.ShardInfo) bool {
+	sr, ok := r.Rule.(ScanRule)
+	return ok && r.scope.Match(info) && sr.ScanShard(info)
+}
+
+// Scan implements ScanRule interface
+func (r *ScopedRule) Scan(key *filter.Key, values []tsm1.Value) error {
+	if sr, ok := r.Rule.(ScanRule); ok {
+		return sr.Scan(key, values)
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package rules
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Abc-Arbitrage/infix/filter"
+	"github.com/Abc-Arbitrage/infix/storage"
+	"github.com/influxdata/influxdb/tsdb/engine/tsm1"
+	"github.com/naoina/toml"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScope_ShouldUnmarshalAndMatch(t *testing.T) {
+	data := []struct {
+		name string
+
+		config   string
+		expected map[uint64]bool
+	}{
+		{
+			"database pattern",
+			`database="^telegraf$"`,
+			map[uint64]bool{1: true, 2: true, 3: false},
+		},
+		{
+			"database list and retention",
+			`
+			database=["telegraf", "app_metrics"]
+			retention="^autogen$"
+			`,
+			map[uint64]bool{1: true, 2: false, 3: true},
+		},
+		{
+			"shards list",
+			`shards=[2, 3]`,
+			map[uint64]bool{1: false, 2: true, 3: true},
+		},
+	}
+
+	shards := []storage.ShardInfo{
+		{ID: 1, Database: "telegraf", RetentionPolicy: "autogen"},
+		{ID: 2, Database: "telegraf", RetentionPolicy: "one_year"},
+		{ID: 3, Database: "app_metrics", RetentionPolicy: "autogen"},
+	}
+
+	for _, d := range data {
+		t.Run(d.name, func(t *testing.T) {
+			table, err := toml.Parse([]byte(d.config))
+			assert.NoError(t, err)
+
+			scope, err := unmarshalScope(table)
+			assert.NoError(t, err)
+			assert.NotNil(t, scope)
+			assert.Empty(t, table.Fields)
+
+			for _, sh := range shards {
+				assert.Equal(t, d.expected[sh.ID], scope.Match(sh), "shard %d", sh.ID)
+			}
+		})
+	}
+}
+
+func TestScope_ShouldBeNilWithoutSelector(t *testing.T) {
+	table, err := toml.Parse([]byte(`to="linux.cpu"`))
+	assert.NoError(t, err)
+
+	scope, err := unmarshalScope(table)
+	assert.NoError(t, err)
+	assert.Nil(t, scope)
+	assert.Len(t, table.Fields, 1)
+}
+
+func TestScopedRule_ShouldNotStartOutOfScopeShard(t *testing.T) {
+	table, err := toml.Parse([]byte(`
+	database="telegraf"
+	to="linux.cpu"
+	[from.strings]
+		equal="cpu"
+	`))
+	assert.NoError(t, err)
+
+	rule, err := loadRule("rename-measurement", table)
+	assert.NoError(t, err)
+
+	scopedRule, ok := rule.(*ScopedRule)
+	assert.True(t, ok)
+	assert.IsType(t, &RenameMeasurementRule{}, scopedRule.Rule)
+
+	assert.True(t, rule.StartShard(storage.ShardInfo{ID: 1, Database: "telegraf"}))
+	assert.False(t, rule.StartShard(storage.ShardInfo{ID: 2, Database: "app_metrics"}))
+}
+
+func TestScopedRule_ShouldOnlyScanShardsInScope(t *testing.T) {
+	drop, err := NewDropOldSerieRule(time.Unix(0, 50), false, &captureWriter{}, "text")
+	assert.NoError(t, err)
+
+	rule := NewScopedRule(drop, &Scope{Database: filter.NewIncludeFilter([]string{"telegraf"})})
+	assert.True(t, Scans(rule))
+	assert.True(t, rule.ScanShard(storage.ShardInfo{Database: "telegraf"}))
+	assert.False(t, rule.ScanShard(storage.ShardInfo{Database: "other"}))
+
+	key := filter.NewKey([]byte("cpu,host=a#!~#idle"))
+	assert.NoError(t, rule.Scan(key, []tsm1.Value{tsm1.NewFloatValue(10, 1.0)}))
+	assert.True(t, rule.FilterKey(key))
+
+	// Rules that do not scan shards are not scanned once scoped
+	list := NewScopedRule(newOldSerieRule(time.Unix(0, 50), false, &captureWriter{}, &textFormater{}), &Scope{})
+	assert.False(t, Scans(list))
+	assert.False(t, list.ScanShard(storage.ShardInfo{Database: "telegraf"}))
+}
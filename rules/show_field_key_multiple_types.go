@@ -8,7 +8,6 @@ import (
 	"github.com/Abc-Arbitrage/infix/filter"
 	"github.com/Abc-Arbitrage/infix/logging"
 	"github.com/Abc-Arbitrage/infix/storage"
-	"github.com/influxdata/influxdb/models"
 	"github.com/influxdata/influxdb/tsdb/engine/tsm1"
 	"github.com/influxdata/influxql"
 )
@@ -31,7 +30,7 @@ type ShowFieldKeyMultipleTypesRule struct {
 	check bool
 	shard storage.ShardInfo
 
-	measurementFilter filter.Filter
+	measurementFilter *filter.MeasurementFilter
 	fieldFilter       filter.Filter
 
 	measurements map[string]measurementInfo
@@ -71,9 +70,13 @@ func (r *ShowFieldKeyMultipleTypesRule) WithLogger(logger *log.Logger) {
 }
 
 // FilterKey implements Rule interface
-func (r *ShowFieldKeyMultipleTypesRule) FilterKey(key []byte) bool {
-	_, fieldKey := tsm1.SeriesAndFieldFromCompositeKey(key)
-	return r.measurementFilter.Filter(key) && r.fieldFilter.Filter(fieldKey)
+func (r *ShowFieldKeyMultipleTypesRule) FilterKey(key *filter.Key) bool {
+	return r.measurementFilter.FilterKey(key) && r.fieldFilter.Filter(key.Field())
+}
+
+// FilterMeasurement implements MeasurementRule interface
+func (r *ShowFieldKeyMultipleTypesRule) FilterMeasurement(measurement []byte) bool {
+	return r.measurementFilter.FilterMeasurement(measurement)
 }
 
 // Start implements Rule interface
@@ -176,10 +179,9 @@ func (r *ShowFieldKeyMultipleTypesRule) EndWAL() {
 }
 
 // Apply implements Rule interface
-func (r *ShowFieldKeyMultipleTypesRule) Apply(key []byte, values []tsm1.Value) ([]byte, []tsm1.Value, error) {
-	seriesKey, fieldKey := tsm1.SeriesAndFieldFromCompositeKey(key)
-	if r.measurementFilter.Filter(key) && r.fieldFilter.Filter(fieldKey) {
-		measurement, _ := models.ParseKey(seriesKey)
+func (r *ShowFieldKeyMultipleTypesRule) Apply(key *filter.Key, values []tsm1.Value) ([]byte, []tsm1.Value, error) {
+	if r.measurementFilter.FilterKey(key) && r.fieldFilter.Filter(key.Field()) {
+		measurement := string(key.Measurement())
 		if _, ok := r.measurements[measurement]; !ok {
 			r.measurements[measurement] = measurementInfo{
 				name:   measurement,
@@ -6,7 +6,6 @@ import (
 	"log"
 	"strconv"
 
-	"github.com/influxdata/influxdb/models"
 	"github.com/influxdata/influxdb/tsdb/engine/tsm1"
 	"github.com/influxdata/influxql"
 
@@ -23,7 +22,7 @@ type UpdateFieldTypeRule struct {
 	check bool
 	shard storage.ShardInfo
 
-	measurementFilter filter.Filter
+	measurementFilter *filter.MeasurementFilter
 	fieldFilter       filter.Filter
 
 	fromType influxql.DataType
@@ -71,8 +70,13 @@ func (r *UpdateFieldTypeRule) WithLogger(logger *log.Logger) {
 }
 
 // FilterKey implements Rule interface
-func (r *UpdateFieldTypeRule) FilterKey(key []byte) bool {
-	return r.measurementFilter.Filter(key)
+func (r *UpdateFieldTypeRule) FilterKey(key *filter.Key) bool {
+	return r.measurementFilter.FilterKey(key)
+}
+
+// FilterMeasurement implements MeasurementRule interface
+func (r *UpdateFieldTypeRule) FilterMeasurement(measurement []byte) bool {
+	return r.measurementFilter.FilterMeasurement(measurement)
 }
 
 // Start implements Rule interface
@@ -147,10 +151,15 @@ func (r *UpdateFieldTypeRule) EndWAL() {
 }
 
 // Apply implements Rule interface
-func (r *UpdateFieldTypeRule) Apply(key []byte, values []tsm1.Value) ([]byte, []tsm1.Value, error) {
-	series, field := tsm1.SeriesAndFieldFromCompositeKey(key)
-	if r.measurementFilter.Filter(key) && r.fieldFilter.Filter(field) {
-		measurement, _ := models.ParseKey(series)
+func (r *UpdateFieldTypeRule) Apply(key *filter.Key, values []tsm1.Value) ([]byte, []tsm1.Value, error) {
+	// Keys without values come from WAL delete entries, there is nothing to convert
+	if len(values) == 0 {
+		return key.Raw, values, nil
+	}
+
+	field := key.Field()
+	if r.measurementFilter.FilterKey(key) && r.fieldFilter.Filter(field) {
+		measurement := string(key.Measurement())
 		var newValues []tsm1.Value
 
 		if influxType, err := tsm1.Values(values).InfluxQLType(); err != nil {
@@ -188,10 +197,10 @@ func (r *UpdateFieldTypeRule) Apply(key []byte, values []tsm1.Value) ([]byte, []
 			}
 		}
 
-		return key, newValues, nil
+		return key.Raw, newValues, nil
 	}
 
-	return key, values, nil
+	return key.Raw, values, nil
 }
 
 // Sample implements Config interface
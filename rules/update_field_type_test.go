@@ -402,7 +402,7 @@ func TestUpdateFieldType_ShouldApply(t *testing.T) {
 			rule := NewUpdateFieldType(measurementFilter, fieldFilter, test.fromType, test.toType)
 			for _, d := range test.data {
 				t.Run(d.name, func(t *testing.T) {
-					key, values, err := rule.Apply(d.key, d.values)
+					key, values, err := rule.Apply(filter.NewKey(d.key), d.values)
 					assert.Equal(t, d.expectedKey, key)
 					assert.Equal(t, d.expectedValues, values)
 					if d.expectedError != nil {
@@ -439,7 +439,7 @@ func TestUpdateFieldType_ShouldUpdateFieldsIndex(t *testing.T) {
 		},
 	}
 
-	shard := newTestShard(measurements)
+	shard := newTestShard(t, measurements)
 
 	measurementFilter, err := filter.NewStringFilter(&filter.StringFilterConfig{HasSuffix: "gauge"})
 	assert.NoError(t, err)
@@ -509,7 +509,7 @@ func TestUpdateFieldType_ShouldUpdateFieldsIndex(t *testing.T) {
 	rule.StartShard(shard)
 
 	for _, d := range data {
-		_, values, err := rule.Apply(d.key, d.values)
+		_, values, err := rule.Apply(filter.NewKey(d.key), d.values)
 		assert.NoError(t, err)
 		assert.Equal(t, values, d.expectedValues)
 	}
@@ -64,7 +64,7 @@ func (r *UpdateTagValueRule) WithLogger(logger *log.Logger) {
 }
 
 // FilterKey implements Rule interface
-func (r *UpdateTagValueRule) FilterKey(key []byte) bool {
+func (r *UpdateTagValueRule) FilterKey(key *filter.Key) bool {
 	return false
 }
 
@@ -107,13 +107,13 @@ func (r *UpdateTagValueRule) EndWAL() {
 }
 
 // Apply implements Rule interface
-func (r *UpdateTagValueRule) Apply(key []byte, values []tsm1.Value) ([]byte, []tsm1.Value, error) {
-	if r.measurementFilter.Filter(key) {
-		seriesKey, field := tsm1.SeriesAndFieldFromCompositeKey(key)
-		measurement, tags := models.ParseKey(seriesKey)
+func (r *UpdateTagValueRule) Apply(key *filter.Key, values []tsm1.Value) ([]byte, []tsm1.Value, error) {
+	if filter.FilterKey(r.measurementFilter, key) {
+		measurement := key.Measurement()
 
+		// Tags are cloned as they are shared by the parsed key
 		var newTags models.Tags
-		for _, tag := range tags {
+		for _, tag := range key.Tags() {
 			newTag := tag.Clone()
 			if r.keyFilter.Filter(tag.Key) && r.valueFilter.Filter(tag.Value) {
 				newTagValue := r.renameFn(string(tag.Value))
@@ -124,12 +124,12 @@ func (r *UpdateTagValueRule) Apply(key []byte, values []tsm1.Value) ([]byte, []t
 			newTags = append(newTags, newTag)
 		}
 
-		newKey := models.MakeKey([]byte(measurement), newTags)
-		newSeriesKey := tsm1.SeriesFieldKeyBytes(string(newKey), string(field))
+		newKey := models.MakeKey(measurement, newTags)
+		newSeriesKey := tsm1.SeriesFieldKeyBytes(string(newKey), string(key.Field()))
 		return newSeriesKey, values, nil
 	}
 
-	return key, values, nil
+	return key.Raw, values, nil
 }
 
 // Sample implements Config interface
@@ -125,7 +125,7 @@ func TestUpdateTagValue_ShouldApply(t *testing.T) {
 	}
 
 	for _, d := range data {
-		key, values, err := rule.Apply(d.key, d.values)
+		key, values, err := rule.Apply(filter.NewKey(d.key), d.values)
 
 		assert.NoError(t, err)
 		assert.Equal(t, string(key), string(d.expectedKey))
@@ -0,0 +1,139 @@
+package rules
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/Abc-Arbitrage/infix/filter"
+	"github.com/influxdata/influxdb/tsdb"
+	"github.com/influxdata/influxdb/tsdb/engine/tsm1"
+)
+
+// ApplyChain applies rules in chain, each rule receiving the key and values produced by the previous one.
+// It stops as soon as a rule drops the key, in which case a nil key is returned. The key is only parsed again
+// when a rule changes it
+func ApplyChain(rs []Rule, key *filter.Key, values []tsm1.Value) ([]byte, []tsm1.Value, error) {
+	for _, r := range rs {
+		newKey, newValues, err := r.Apply(key, values)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if newKey == nil {
+			return nil, nil, nil
+		}
+
+		if !bytes.Equal(newKey, key.Raw) {
+			key = filter.NewKey(newKey)
+		}
+		values = newValues
+	}
+
+	return key.Raw, values, nil
+}
+
+// Unchanged returns true if rules returned the key and values they were given, the same values slice being returned
+// by rules that do not modify values
+func Unchanged(key []byte, values []tsm1.Value, newKey []byte, newValues []tsm1.Value) bool {
+	if !bytes.Equal(key, newKey) || len(values) != len(newValues) {
+		return false
+	}
+	return len(values) == 0 || &values[0] == &newValues[0]
+}
+
+// ApplyWALEntry applies read and write rules to a WAL entry and rewrites it in place. Keys of delete and delete-range
+// entries go through the same write rules than written keys, without values. It returns false if all the keys
+// of the entry have been dropped and the entry should not be written anymore, and whether the entry has been changed
+func ApplyWALEntry(entry tsm1.WALEntry, readRules []Rule, writeRules []Rule) (keep bool, changed bool, err error) {
+	switch t := entry.(type) {
+	case *tsm1.WriteWALEntry:
+		values := make(map[string][]tsm1.Value, len(t.Values))
+
+		for key, vs := range t.Values {
+			parsed := filter.NewKey([]byte(key))
+
+			for _, r := range readRules {
+				if _, _, err := r.Apply(parsed, vs); err != nil {
+					return false, false, err
+				}
+			}
+
+			newKey, newValues, err := ApplyChain(writeRules, parsed, vs)
+			if err != nil {
+				return false, false, err
+			}
+
+			if !Unchanged(parsed.Raw, vs, newKey, newValues) {
+				changed = true
+			}
+
+			if newKey == nil {
+				continue
+			}
+
+			// Values of different types cannot be written to the same key
+			if existing := values[string(newKey)]; len(existing) > 0 && len(newValues) > 0 {
+				existingType, _ := tsm1.Values(existing).InfluxQLType()
+				newType, _ := tsm1.Values(newValues).InfluxQLType()
+				if existingType != newType {
+					return false, false, fmt.Errorf("unable to merge %s values of key %q with %s values: %v", newType, string(newKey), existingType, tsdb.ErrFieldTypeConflict)
+				}
+			}
+
+			values[string(newKey)] = append(values[string(newKey)], newValues...)
+		}
+
+		// Keys renamed to an existing key are merged
+		if len(values) != len(t.Values) {
+			changed = true
+		}
+
+		t.Values = values
+		return len(t.Values) > 0, changed, nil
+	case *tsm1.DeleteWALEntry:
+		keys, changed, err := applyDeleteKeys(t.Keys, writeRules)
+		if err != nil {
+			return false, false, err
+		}
+
+		t.Keys = keys
+		return len(t.Keys) > 0, changed, nil
+	case *tsm1.DeleteRangeWALEntry:
+		keys, changed, err := applyDeleteKeys(t.Keys, writeRules)
+		if err != nil {
+			return false, false, err
+		}
+
+		t.Keys = keys
+		return len(t.Keys) > 0, changed, nil
+	}
+
+	return true, false, nil
+}
+
+func applyDeleteKeys(keys [][]byte, writeRules []Rule) ([][]byte, bool, error) {
+	var newKeys [][]byte
+	seen := make(map[string]bool, len(keys))
+	changed := false
+
+	for _, key := range keys {
+		newKey, _, err := ApplyChain(writeRules, filter.NewKey(key), nil)
+		if err != nil {
+			return nil, false, err
+		}
+
+		if !bytes.Equal(key, newKey) {
+			changed = true
+		}
+
+		if newKey == nil || seen[string(newKey)] {
+			changed = true
+			continue
+		}
+
+		seen[string(newKey)] = true
+		newKeys = append(newKeys, newKey)
+	}
+
+	return newKeys, changed, nil
+}
@@ -0,0 +1,221 @@
+package rules
+
+import (
+	"testing"
+
+	"github.com/Abc-Arbitrage/infix/filter"
+	"github.com/influxdata/influxdb/tsdb/engine/tsm1"
+	"github.com/influxdata/influxql"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestWALRules(t *testing.T) []Rule {
+	renameRule := NewRenameMeasurement("cpu", "linux.cpu")
+
+	tagsFilter, err := filter.NewWhereFilter(map[string]string{
+		"host": "^old-host$",
+	})
+	assert.NoError(t, err)
+
+	dropSerieRule := NewDropSerieRule(filter.NewSerieFilter(filter.NewIncludeFilter([]string{"linux.cpu"}), tagsFilter, nil))
+
+	return []Rule{renameRule, dropSerieRule}
+}
+
+func makeTestKey(serie string, field string) []byte {
+	return tsm1.SeriesFieldKeyBytes(serie, field)
+}
+
+func TestApplyWALEntry_ShouldRewriteWriteEntry(t *testing.T) {
+	values := []tsm1.Value{tsm1.NewFloatValue(0, 1.0)}
+
+	entry := &tsm1.WriteWALEntry{
+		Values: map[string][]tsm1.Value{
+			string(makeTestKey("cpu,host=my-host", "idle")):  values,
+			string(makeTestKey("cpu,host=old-host", "idle")): values,
+			string(makeTestKey("mem,host=my-host", "used")):  values,
+		},
+	}
+
+	keep, changed, err := ApplyWALEntry(entry, nil, newTestWALRules(t))
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.True(t, keep)
+
+	assert.Equal(t, map[string][]tsm1.Value{
+		string(makeTestKey("linux.cpu,host=my-host", "idle")): values,
+		string(makeTestKey("mem,host=my-host", "used")):       values,
+	}, entry.Values)
+}
+
+func TestApplyWALEntry_ShouldRewriteDeleteEntry(t *testing.T) {
+	entry := &tsm1.DeleteWALEntry{
+		Keys: [][]byte{
+			makeTestKey("cpu,host=my-host", "idle"),
+			makeTestKey("cpu,host=old-host", "idle"),
+			makeTestKey("mem,host=my-host", "used"),
+		},
+	}
+
+	keep, changed, err := ApplyWALEntry(entry, nil, newTestWALRules(t))
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.True(t, keep)
+
+	assert.Equal(t, [][]byte{
+		makeTestKey("linux.cpu,host=my-host", "idle"),
+		makeTestKey("mem,host=my-host", "used"),
+	}, entry.Keys)
+}
+
+func TestApplyWALEntry_ShouldRewriteDeleteRangeEntry(t *testing.T) {
+	entry := &tsm1.DeleteRangeWALEntry{
+		Keys: [][]byte{
+			makeTestKey("cpu,host=my-host", "idle"),
+			makeTestKey("linux.cpu,host=my-host", "idle"),
+		},
+		Min: 10,
+		Max: 20,
+	}
+
+	keep, changed, err := ApplyWALEntry(entry, nil, newTestWALRules(t))
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.True(t, keep)
+
+	assert.Equal(t, [][]byte{makeTestKey("linux.cpu,host=my-host", "idle")}, entry.Keys)
+	assert.Equal(t, int64(10), entry.Min)
+	assert.Equal(t, int64(20), entry.Max)
+}
+
+func TestApplyWALEntry_ShouldDropDeleteEntryWithoutKeys(t *testing.T) {
+	entry := &tsm1.DeleteWALEntry{
+		Keys: [][]byte{makeTestKey("cpu,host=old-host", "idle")},
+	}
+
+	keep, changed, err := ApplyWALEntry(entry, nil, newTestWALRules(t))
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.False(t, keep)
+	assert.Empty(t, entry.Keys)
+}
+
+func TestApplyWALEntry_ShouldKeepDeleteKeysOfTypedDropField(t *testing.T) {
+	rules := []Rule{
+		NewDropField(filter.NewIncludeFilter([]string{"cpu"}), filter.NewIncludeFilter([]string{"idle"}), filter.NewIncludeFilter([]string{"float"})),
+		NewUpdateFieldType(filter.NewIncludeFilter([]string{"cpu"}), filter.NewIncludeFilter([]string{"idle"}), influxql.Float, influxql.Integer),
+	}
+
+	entry := &tsm1.DeleteWALEntry{
+		Keys: [][]byte{makeTestKey("cpu,host=my-host", "idle")},
+	}
+
+	keep, changed, err := ApplyWALEntry(entry, nil, rules)
+	assert.NoError(t, err)
+	assert.True(t, keep)
+	assert.False(t, changed)
+	assert.Equal(t, [][]byte{makeTestKey("cpu,host=my-host", "idle")}, entry.Keys)
+
+	rules[0] = NewDropField(filter.NewIncludeFilter([]string{"cpu"}), filter.NewIncludeFilter([]string{"idle"}), &filter.AlwaysTrueFilter{})
+
+	keep, changed, err = ApplyWALEntry(entry, nil, rules)
+	assert.NoError(t, err)
+	assert.False(t, keep)
+	assert.True(t, changed)
+}
+
+func TestApplyWALEntry_ShouldReportUnchangedWriteEntry(t *testing.T) {
+	values := []tsm1.Value{tsm1.NewFloatValue(0, 1.0)}
+
+	entry := &tsm1.WriteWALEntry{
+		Values: map[string][]tsm1.Value{
+			string(makeTestKey("mem,host=my-host", "used")):       values,
+			string(makeTestKey("linux.cpu,host=my-host", "idle")): values,
+		},
+	}
+
+	keep, changed, err := ApplyWALEntry(entry, nil, newTestWALRules(t))
+	assert.NoError(t, err)
+	assert.True(t, keep)
+	assert.False(t, changed)
+
+	// Renaming cpu merges its values with the existing linux.cpu key
+	entry.Values[string(makeTestKey("cpu,host=my-host", "idle"))] = []tsm1.Value{tsm1.NewFloatValue(1, 1.0)}
+
+	keep, changed, err = ApplyWALEntry(entry, nil, newTestWALRules(t))
+	assert.NoError(t, err)
+	assert.True(t, keep)
+	assert.True(t, changed)
+	assert.Len(t, entry.Values, 2)
+}
+
+func TestUnchanged(t *testing.T) {
+	key := makeTestKey("cpu,host=my-host", "idle")
+	values := []tsm1.Value{tsm1.NewFloatValue(0, 1.0)}
+
+	assert.True(t, Unchanged(key, values, key, values))
+	assert.True(t, Unchanged(key, nil, key, nil))
+	assert.False(t, Unchanged(key, values, nil, nil))
+	assert.False(t, Unchanged(key, values, makeTestKey("cpu,host=my-host", "user"), values))
+	assert.False(t, Unchanged(key, values, key, []tsm1.Value{tsm1.NewFloatValue(0, 1.0)}))
+}
+
+func newBenchmarkRules(b *testing.B) []Rule {
+	tagsFilter, err := filter.NewWhereFilter(map[string]string{"cpu": "^cpu7$"})
+	assert.NoError(b, err)
+
+	var rs []Rule
+	for i := 0; i < 5; i++ {
+		rs = append(rs, NewRenameField(filter.NewIncludeFilter([]string{"disk"}), filter.NewIncludeFilter([]string{"free"}), func(string) string { return "available" }))
+		rs = append(rs, NewDropSerieRule(filter.NewSerieFilter(filter.NewIncludeFilter([]string{"mem"}), tagsFilter, nil)))
+	}
+	return rs
+}
+
+var benchmarkValues = []tsm1.Value{tsm1.NewFloatValue(0, 1.0)}
+
+func BenchmarkApplyChain_ParsedPerRule(b *testing.B) {
+	rs := newBenchmarkRules(b)
+	key := makeTestKey("cpu,cpu=cpu0,host=my-host,region=eu-west", "idle")
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		for _, r := range rs {
+			r.FilterKey(filter.NewKey(key))
+			r.Apply(filter.NewKey(key), benchmarkValues)
+		}
+	}
+}
+
+func BenchmarkApplyChain_SharedKey(b *testing.B) {
+	rs := newBenchmarkRules(b)
+	key := makeTestKey("cpu,cpu=cpu0,host=my-host,region=eu-west", "idle")
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		parsed := filter.NewKey(key)
+		for _, r := range rs {
+			r.FilterKey(parsed)
+		}
+		ApplyChain(rs, parsed, benchmarkValues)
+	}
+}
+
+func TestApplyWALEntry_ShouldNotMergeConflictingTypes(t *testing.T) {
+	entry := &tsm1.WriteWALEntry{
+		Values: map[string][]tsm1.Value{
+			string(makeTestKey("cpu,host=my-host", "idle")): {tsm1.NewFloatValue(0, 1.0)},
+			string(makeTestKey("cpu,host=my-host", "user")): {tsm1.NewIntegerValue(0, 1)},
+		},
+	}
+
+	// The float idle field is renamed to the existing integer user field
+	renameRule := NewRenameField(filter.NewIncludeFilter([]string{"cpu"}), filter.NewIncludeFilter([]string{"idle"}), func(string) string { return "user" })
+
+	_, _, err := ApplyWALEntry(entry, nil, []Rule{renameRule})
+	assert.Error(t, err)
+}
@@ -0,0 +1,205 @@
+package storage
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/influxdata/influxdb/cmd/influxd/backup_util"
+)
+
+// BackupManifestExtension is the extension of the manifest files of portable backups
+const BackupManifestExtension = ".manifest"
+
+// Backup is a portable backup set, as written by influxd backup -portable. Incremental backups written to the same
+// directory are merged, keeping the most recent archive of each shard
+type Backup struct {
+	Dir string
+
+	// Manifest is the most recent manifest of the backup set, telling whether the backup is limited to a database,
+	// retention policy or shard
+	Manifest backup_util.Manifest
+
+	Meta backup_util.MetaEntry
+	// Files are the shard archives of the backup, sorted by shard ID
+	Files []backup_util.Entry
+}
+
+// LoadBackup reads the manifests of the portable backup set in dir
+func LoadBackup(dir string) (*Backup, error) {
+	meta, shards, err := backup_util.LoadIncremental(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	if meta == nil {
+		return nil, fmt.Errorf("no manifest found in backup directory '%s'", dir)
+	}
+
+	b := &Backup{Dir: dir, Meta: *meta}
+
+	// Manifests are named after the time of the backup
+	manifests, err := filepath.Glob(filepath.Join(dir, "*"+BackupManifestExtension))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(manifests)
+
+	data, err := ioutil.ReadFile(manifests[len(manifests)-1])
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &b.Manifest); err != nil {
+		return nil, fmt.Errorf("read manifest: %v", err)
+	}
+	for _, e := range shards {
+		b.Files = append(b.Files, *e)
+	}
+
+	sort.Slice(b.Files, func(i, j int) bool {
+		return b.Files[i].ShardID < b.Files[j].ShardID
+	})
+
+	return b, nil
+}
+
+// ShardPath returns the path of a shard of the backup relative to a data directory, which is also the prefix of the
+// files in its archive
+func ShardPath(e backup_util.Entry) string {
+	return filepath.Join(e.Database, e.Policy, fmt.Sprintf("%d", e.ShardID))
+}
+
+// ExtractShardArchive extracts a .tar.gz shard archive of a portable backup into dataDir
+func ExtractShardArchive(path string, dataDir string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		return fmt.Errorf("invalid shard archive '%s': %v", path, err)
+	}
+	defer gr.Close()
+
+	tr := tar.NewReader(gr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("invalid shard archive '%s': %v", path, err)
+		}
+
+		name := filepath.FromSlash(hdr.Name)
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("invalid file '%s' in shard archive '%s'", hdr.Name, path)
+		}
+		target := filepath.Join(dataDir, name)
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			if err := extractFile(tr, target, os.FileMode(hdr.Mode).Perm()); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func extractFile(r io.Reader, path string, mode os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// WriteShardArchive writes the files of the shard at shardPath, relative to dataDir, to a .tar.gz archive at path,
+// in the layout of influxd backups. The fields index is not part of backups and is skipped. It returns the size of the
+// uncompressed archive, as recorded in manifests
+func WriteShardArchive(dataDir string, shardPath string, path string) (int64, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	gw := gzip.NewWriter(f)
+	gw.Name = strings.TrimSuffix(filepath.Base(path), ".gz")
+
+	cw := backup_util.CountingWriter{Writer: gw}
+	tw := tar.NewWriter(&cw)
+
+	dir := filepath.Join(dataDir, shardPath)
+	err = filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == dir || fi.Name() == FieldsIndexFileName {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dataDir, p)
+		if err != nil {
+			return err
+		}
+
+		h, err := tar.FileInfoHeader(fi, "")
+		if err != nil {
+			return err
+		}
+		h.Name = filepath.ToSlash(rel)
+
+		if err := tw.WriteHeader(h); err != nil {
+			return err
+		}
+
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+
+		in, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+
+		_, err = io.Copy(tw, in)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if err := tw.Close(); err != nil {
+		return 0, err
+	}
+	if err := gw.Close(); err != nil {
+		return 0, err
+	}
+	if err := f.Sync(); err != nil {
+		return 0, err
+	}
+
+	return cw.BytesWritten(), f.Close()
+}
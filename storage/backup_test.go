@@ -0,0 +1,78 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/influxdata/influxdb/cmd/influxd/backup_util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShardArchive_ShouldRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "infix-backup")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	entry := backup_util.Entry{Database: "telegraf", Policy: "autogen", ShardID: 1}
+	shardPath := filepath.Join(dir, "data", ShardPath(entry))
+	assert.NoError(t, os.MkdirAll(shardPath, 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(shardPath, "000000001-000000001.tsm"), []byte("tsm"), 0644))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(shardPath, FieldsIndexFileName), []byte("idx"), 0644))
+
+	archive := filepath.Join(dir, "20210301T000000Z.s1.tar.gz")
+	size, err := WriteShardArchive(filepath.Join(dir, "data"), ShardPath(entry), archive)
+	assert.NoError(t, err)
+	assert.NotZero(t, size)
+
+	assert.NoError(t, ExtractShardArchive(archive, filepath.Join(dir, "extracted")))
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "extracted", "telegraf", "autogen", "1", "000000001-000000001.tsm"))
+	assert.NoError(t, err)
+	assert.Equal(t, "tsm", string(b))
+
+	// The fields index is not part of backups
+	_, err = os.Stat(filepath.Join(dir, "extracted", "telegraf", "autogen", "1", FieldsIndexFileName))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestLoadBackup_ShouldMergeIncrementalBackups(t *testing.T) {
+	dir, err := ioutil.TempDir("", "infix-backup")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	_, err = LoadBackup(dir)
+	assert.Error(t, err)
+
+	for _, name := range []string{"20210301T000000Z.s1.tar.gz", "20210302T000000Z.s1.tar.gz", "20210302T000000Z.s2.tar.gz"} {
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), nil, 0644))
+	}
+
+	first := backup_util.Manifest{
+		Meta:  backup_util.MetaEntry{FileName: "20210301T000000Z.meta"},
+		Files: []backup_util.Entry{{Database: "telegraf", Policy: "autogen", ShardID: 1, FileName: "20210301T000000Z.s1.tar.gz"}},
+	}
+	assert.NoError(t, first.Save(filepath.Join(dir, "20210301T000000Z.manifest")))
+
+	second := backup_util.Manifest{
+		Meta:     backup_util.MetaEntry{FileName: "20210302T000000Z.meta"},
+		Limited:  true,
+		Database: "telegraf",
+		Files: []backup_util.Entry{
+			{Database: "telegraf", Policy: "autogen", ShardID: 2, FileName: "20210302T000000Z.s2.tar.gz"},
+			{Database: "telegraf", Policy: "autogen", ShardID: 1, FileName: "20210302T000000Z.s1.tar.gz", LastModified: 1},
+		},
+	}
+	assert.NoError(t, second.Save(filepath.Join(dir, "20210302T000000Z.manifest")))
+
+	b, err := LoadBackup(dir)
+	assert.NoError(t, err)
+
+	assert.Equal(t, "20210302T000000Z.meta", b.Meta.FileName)
+	assert.True(t, b.Manifest.Limited)
+	if assert.Len(t, b.Files, 2) {
+		assert.Equal(t, "20210302T000000Z.s1.tar.gz", b.Files[0].FileName)
+		assert.Equal(t, "20210302T000000Z.s2.tar.gz", b.Files[1].FileName)
+	}
+}
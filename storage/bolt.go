@@ -0,0 +1,60 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// DefaultBoltFileName is the name of the InfluxDB 2.x metadata store, located next to the engine directory
+	DefaultBoltFileName = "influxd.bolt"
+
+	_boltBucketsIndex = "bucketsv1"
+	_boltOpenTimeout  = 5 * time.Second
+)
+
+type boltBucket struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// LoadBucketNames reads an InfluxDB 2.x bolt metadata store and returns bucket names indexed by bucket ID
+func LoadBucketNames(path string) (map[string]string, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{ReadOnly: true, Timeout: _boltOpenTimeout})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open bolt file '%s': %v", path, err)
+	}
+	defer db.Close()
+
+	names := make(map[string]string)
+
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(_boltBucketsIndex))
+		if b == nil {
+			return fmt.Errorf("could not find '%s' in bolt file '%s'", _boltBucketsIndex, path)
+		}
+
+		return b.ForEach(func(k, v []byte) error {
+			var bucket boltBucket
+			if err := json.Unmarshal(v, &bucket); err != nil {
+				return fmt.Errorf("invalid bucket '%s' in bolt file '%s': %v", k, path, err)
+			}
+
+			id := bucket.ID
+			if id == "" {
+				id = string(k)
+			}
+			names[id] = bucket.Name
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return names, nil
+}
@@ -0,0 +1,93 @@
+package storage
+
+import (
+	"context"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/influxdata/influxdb/pkg/limiter"
+	"github.com/influxdata/influxdb/tsdb/engine/tsm1"
+	"go.uber.org/zap"
+)
+
+// TombstonePath returns the path of the tombstone file of a TSM file
+func TombstonePath(tsmPath string) string {
+	return strings.TrimSuffix(tsmPath, "."+tsm1.TSMFileExtension) + "." + tsm1.TombstoneFileExtension
+}
+
+// CompactTSMFiles fully compacts all the TSM files of a shard directory, as influxd does for cold shards, and returns
+// the new files. Tombstones are applied and the compacted files are removed along with their tombstones. Writes are
+// limited to throughput bytes per second with bursts of burst bytes, unless throughput is 0. When the context is
+// canceled, the compaction is aborted and the files are left untouched
+func CompactTSMFiles(ctx context.Context, dir string, throughput int, burst int) ([]string, error) {
+	fs := tsm1.NewFileStore(dir)
+	if err := fs.Open(); err != nil {
+		return nil, err
+	}
+	defer fs.Close()
+
+	var tsmFiles []string
+	for _, f := range fs.Files() {
+		tsmFiles = append(tsmFiles, f.Path())
+	}
+
+	compactor := tsm1.NewCompactor()
+	compactor.Dir = dir
+	compactor.FileStore = fs
+	if throughput > 0 {
+		compactor.RateLimit = limiter.NewRate(throughput, burst)
+	}
+	compactor.Open()
+	defer compactor.Close()
+
+	// Closing the compactor interrupts the running compaction
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			compactor.Close()
+		case <-done:
+		}
+	}()
+
+	files, err := compactor.CompactFull(tsmFiles, zap.NewNop())
+	if err := ctx.Err(); err != nil {
+		for _, f := range files {
+			os.RemoveAll(f)
+		}
+		return nil, err
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Readers must be closed before removing compacted files
+	if err := fs.Close(); err != nil {
+		return nil, err
+	}
+
+	// New files are renamed first so that data is duplicated rather than lost if interrupted
+	var newFiles []string
+	for _, f := range files {
+		path := strings.TrimSuffix(f, "."+tsm1.CompactionTempExtension)
+		log.Printf("Renaming '%s' to '%s'", f, path)
+		if err := os.Rename(f, path); err != nil {
+			return nil, err
+		}
+		newFiles = append(newFiles, path)
+	}
+
+	for _, f := range tsmFiles {
+		log.Printf("Removing compacted file '%s'", f)
+		if err := os.Remove(f); err != nil {
+			return nil, err
+		}
+		if err := os.RemoveAll(TombstonePath(f)); err != nil {
+			return nil, err
+		}
+	}
+
+	return newFiles, nil
+}
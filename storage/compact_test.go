@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/influxdata/influxdb/tsdb/engine/tsm1"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeCompactTestFile(t *testing.T, path string, keys ...string) {
+	f, err := os.Create(path)
+	assert.NoError(t, err)
+
+	w, err := tsm1.NewTSMWriter(f)
+	assert.NoError(t, err)
+
+	for _, key := range keys {
+		assert.NoError(t, w.Write([]byte(key), []tsm1.Value{tsm1.NewFloatValue(0, 1.0)}))
+	}
+	assert.NoError(t, w.WriteIndex())
+	assert.NoError(t, w.Close())
+}
+
+func TestCompactTSMFiles_ShouldCompactAllFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "infix-compact")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	first := filepath.Join(dir, "000000001-000000001.tsm")
+	second := filepath.Join(dir, "000000002-000000001.tsm")
+	writeCompactTestFile(t, first, "cpu,host=a#!~#idle", "disk,host=a#!~#free")
+	writeCompactTestFile(t, second, "cpu,host=b#!~#idle", "mem,host=b#!~#used")
+
+	f, err := os.Open(second)
+	assert.NoError(t, err)
+	r, err := tsm1.NewTSMReader(f)
+	assert.NoError(t, err)
+	assert.NoError(t, r.Delete([][]byte{[]byte("mem,host=b#!~#used")}))
+	assert.NoError(t, r.Close())
+
+	files, err := CompactTSMFiles(context.Background(), dir, DefaultCompactThroughput, DefaultCompactThroughputBurst)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{filepath.Join(dir, "000000002-000000002.tsm")}, files)
+
+	f, err = os.Open(files[0])
+	assert.NoError(t, err)
+	r, err = tsm1.NewTSMReader(f)
+	assert.NoError(t, err)
+	defer r.Close()
+
+	var keys []string
+	for i := 0; i < r.KeyCount(); i++ {
+		key, _ := r.KeyAt(i)
+		keys = append(keys, string(key))
+	}
+	assert.Equal(t, []string{"cpu,host=a#!~#idle", "cpu,host=b#!~#idle", "disk,host=a#!~#free"}, keys)
+
+	entries, err := ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestCompactTSMFiles_ShouldLeaveFilesUntouchedWhenCanceled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "infix-compact")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	writeCompactTestFile(t, filepath.Join(dir, "000000001-000000001.tsm"), "cpu,host=a#!~#idle")
+	writeCompactTestFile(t, filepath.Join(dir, "000000002-000000001.tsm"), "cpu,host=b#!~#idle")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = CompactTSMFiles(ctx, dir, 0, 0)
+	assert.Equal(t, context.Canceled, err)
+
+	entries, err := ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+}
@@ -10,5 +10,5 @@ const (
 	// DefaultCompactThroughputBurst is the rate limit in bytes per second that we
 	// will allow TSM compactions to write to disk. If this is not set, the burst value
 	// will be set to equal the normal throughput
-	DefaultCompactThroughputBurst = 48 * 1024 * 102
+	DefaultCompactThroughputBurst = 48 * 1024 * 1024
 )
@@ -0,0 +1,146 @@
+package storage
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// CopyFile copies the file at src to dst, replacing dst and keeping the mode of src. With link, dst is a hard link
+// to src when both are on the same filesystem. Only immutable files, like TSM files, should be linked as changing
+// one changes the other
+func CopyFile(src string, dst string, link bool) error {
+	// Writing to a previous link would change the source file
+	if err := os.Remove(dst); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if link {
+		if err := os.Link(src, dst); err == nil {
+			return nil
+		}
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// CopyDir copies the directory at src and its content to dst, replacing existing files. With preserveOwnership,
+// copies get the ownership of their source
+func CopyDir(src string, dst string, preserveOwnership bool) error {
+	return filepath.Walk(src, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		if fi.IsDir() {
+			if err := os.MkdirAll(target, fi.Mode().Perm()); err != nil {
+				return err
+			}
+		} else if err := CopyFile(path, target, false); err != nil {
+			return err
+		}
+
+		if preserveOwnership {
+			o, err := ReadOwnership(path)
+			if err != nil {
+				return err
+			}
+			return o.Apply(target)
+		}
+		return nil
+	})
+}
+
+// MirrorDir creates the directory dst and its missing parents, each with the mode of the matching ancestor of src if
+// it exists. With preserveOwnership, they also get its ownership
+func MirrorDir(src string, dst string, preserveOwnership bool) error {
+	if _, err := os.Stat(dst); err == nil {
+		return nil
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	if parent := filepath.Dir(dst); parent != dst {
+		if err := MirrorDir(filepath.Dir(src), parent, preserveOwnership); err != nil {
+			return err
+		}
+	}
+
+	o, err := ReadOwnership(src)
+	if os.IsNotExist(err) {
+		return os.Mkdir(dst, 0755)
+	} else if err != nil {
+		return err
+	}
+
+	if err := os.Mkdir(dst, o.Mode); err != nil {
+		return err
+	}
+
+	if preserveOwnership {
+		return o.Apply(dst)
+	}
+	return nil
+}
+
+// MkdirAllLike creates the directory path and its missing parents, each with the mode of its parent. With
+// preserveOwnership, they also get the ownership of the closest existing ancestor
+func MkdirAllLike(path string, preserveOwnership bool) error {
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	parent := filepath.Dir(path)
+	if parent != path {
+		if err := MkdirAllLike(parent, preserveOwnership); err != nil {
+			return err
+		}
+	}
+
+	o, err := ReadOwnership(parent)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Mkdir(path, o.Mode); err != nil {
+		return err
+	}
+
+	if preserveOwnership {
+		return o.Apply(path)
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCopyFile_ShouldNotChangeLinkedSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "infix-copy")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "000000001-000000001.tsm")
+	dst := filepath.Join(dir, "copy.tsm")
+	assert.NoError(t, ioutil.WriteFile(src, []byte("source"), 0640))
+
+	assert.NoError(t, CopyFile(src, dst, true))
+	fsrc, _ := os.Stat(src)
+	fdst, _ := os.Stat(dst)
+	assert.True(t, os.SameFile(fsrc, fdst))
+
+	// Copying over the link replaces it instead of writing through it
+	other := filepath.Join(dir, "other.tsm")
+	assert.NoError(t, ioutil.WriteFile(other, []byte("other"), 0600))
+	assert.NoError(t, CopyFile(other, dst, false))
+
+	b, err := ioutil.ReadFile(src)
+	assert.NoError(t, err)
+	assert.Equal(t, "source", string(b))
+
+	b, err = ioutil.ReadFile(dst)
+	assert.NoError(t, err)
+	assert.Equal(t, "other", string(b))
+
+	fdst, _ = os.Stat(dst)
+	assert.Equal(t, os.FileMode(0600), fdst.Mode().Perm())
+}
+
+func TestMirrorDir_ShouldCreateParents(t *testing.T) {
+	dir, err := ioutil.TempDir("", "infix-copy")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "data", "telegraf", "autogen", "1")
+	assert.NoError(t, os.MkdirAll(src, 0750))
+
+	dst := filepath.Join(dir, "out", "telegraf", "autogen", "1")
+	assert.NoError(t, MirrorDir(src, dst, false))
+
+	fi, err := os.Stat(dst)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0750), fi.Mode().Perm())
+}
+
+func TestMkdirAllLike_ShouldCreateParentsLikeAncestor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "infix-copy")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	data := filepath.Join(dir, "data")
+	assert.NoError(t, os.Mkdir(data, 0750))
+	assert.NoError(t, os.Chmod(data, 0750))
+
+	path := filepath.Join(data, "telegraf", "autogen", "1")
+	assert.NoError(t, MkdirAllLike(path, true))
+
+	expected, err := ReadOwnership(data)
+	assert.NoError(t, err)
+
+	for _, p := range []string{filepath.Dir(filepath.Dir(path)), filepath.Dir(path), path} {
+		o, err := ReadOwnership(p)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, o)
+	}
+}
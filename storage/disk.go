@@ -0,0 +1,29 @@
+package storage
+
+import (
+	"errors"
+	"os"
+)
+
+// ErrFreeSpaceUnsupported is returned by FreeSpace on platforms where free space cannot be read
+var ErrFreeSpaceUnsupported = errors.New("reading free disk space is not supported on this platform")
+
+// FreeSpace returns the space in bytes available to the current user on the filesystem holding path
+func FreeSpace(path string) (uint64, error) {
+	return freeSpace(path)
+}
+
+// SameFilesystem returns true if the files at a and b are on the same filesystem, so that they can be hard linked
+func SameFilesystem(a string, b string) (bool, error) {
+	fa, err := os.Stat(a)
+	if err != nil {
+		return false, err
+	}
+
+	fb, err := os.Stat(b)
+	if err != nil {
+		return false, err
+	}
+
+	return sameDevice(fa, fb), nil
+}
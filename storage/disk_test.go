@@ -0,0 +1,27 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFreeSpace_ShouldReadFilesystem(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("free space is not supported on windows")
+	}
+
+	dir, err := ioutil.TempDir("", "infix-disk")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	free, err := FreeSpace(dir)
+	assert.NoError(t, err)
+	assert.NotZero(t, free)
+
+	_, err = FreeSpace(dir + "/missing")
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,14 @@
+package storage
+
+import (
+	"os"
+)
+
+func freeSpace(path string) (uint64, error) {
+	return 0, ErrFreeSpaceUnsupported
+}
+
+// Filesystems are not compared on Windows, files are assumed to be copied
+func sameDevice(a os.FileInfo, b os.FileInfo) bool {
+	return false
+}
@@ -0,0 +1,428 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"github.com/influxdata/influxdb/models"
+	"github.com/influxdata/influxdb/tsdb"
+	"github.com/influxdata/influxdb/tsdb/engine/tsm1"
+	"github.com/influxdata/influxql"
+)
+
+// ErrInvalidFieldsIndex is returned when a fields index file cannot be decoded
+var ErrInvalidFieldsIndex = errors.New("invalid fields index")
+
+var _fieldsIndexMagicNumber = []byte{0, 6, 1, 3}
+
+// FieldTracker records the (measurement, field, type) tuples of the keys remaining in a shard so that its
+// fields index can be rebuilt from the actual data. A nil FieldTracker ignores all calls
+type FieldTracker struct {
+	fields  map[string]map[string][]influxql.DataType
+	invalid bool
+}
+
+// NewFieldTracker creates an empty FieldTracker
+func NewFieldTracker() *FieldTracker {
+	return &FieldTracker{
+		fields: make(map[string]map[string][]influxql.DataType),
+	}
+}
+
+// Add records the field of a composite key with the given type
+func (t *FieldTracker) Add(key []byte, typ influxql.DataType) {
+	if t == nil || typ == influxql.Unknown {
+		return
+	}
+
+	seriesKey, field := tsm1.SeriesAndFieldFromCompositeKey(key)
+	measurement, _ := models.ParseKeyBytes(seriesKey)
+	t.addField(string(measurement), string(field), typ)
+}
+
+func (t *FieldTracker) addField(measurement string, field string, typ influxql.DataType) {
+	fields, ok := t.fields[measurement]
+	if !ok {
+		fields = make(map[string][]influxql.DataType)
+		t.fields[measurement] = fields
+	}
+
+	types := fields[field]
+	for _, existing := range types {
+		if existing == typ {
+			return
+		}
+	}
+	fields[field] = append(types, typ)
+}
+
+// AddBlockType records the field of a composite key with the type of a TSM block
+func (t *FieldTracker) AddBlockType(key []byte, blockType byte) {
+	typ := tsm1.BlockTypeToInfluxQLDataType(blockType)
+	if typ == influxql.Unknown {
+		t.Invalidate()
+		return
+	}
+	t.Add(key, typ)
+}
+
+// AddValues records the field of a composite key with the type of its values
+func (t *FieldTracker) AddValues(key []byte, values []tsm1.Value) {
+	if len(values) == 0 {
+		return
+	}
+
+	typ, err := tsm1.Values(values).InfluxQLType()
+	if err != nil {
+		t.Invalidate()
+		return
+	}
+	t.Add(key, typ)
+}
+
+// AddTSMKeys records the fields of all the keys of a TSM file
+func (t *FieldTracker) AddTSMKeys(r *tsm1.TSMReader) {
+	if t == nil {
+		return
+	}
+
+	for i := 0; i < r.KeyCount(); i++ {
+		t.AddBlockType(r.KeyAt(i))
+	}
+}
+
+// Merge records all the fields of another tracker
+func (t *FieldTracker) Merge(other *FieldTracker) {
+	if t == nil || other == nil {
+		return
+	}
+
+	if other.invalid {
+		t.invalid = true
+	}
+
+	for measurement, fields := range other.fields {
+		for field, types := range fields {
+			for _, typ := range types {
+				t.addField(measurement, field, typ)
+			}
+		}
+	}
+}
+
+// Invalidate marks the tracker as incomplete, for instance when some data could not be read
+func (t *FieldTracker) Invalidate() {
+	if t != nil {
+		t.invalid = true
+	}
+}
+
+// Valid returns true if all the data of the shard has been tracked
+func (t *FieldTracker) Valid() bool {
+	return t != nil && !t.invalid
+}
+
+// Rebuild writes a new fields index at path with the tracked fields, replacing any existing file. When a field
+// has been seen with several types, the type of the previous index is kept if possible, otherwise the first seen
+func (t *FieldTracker) Rebuild(path string, previous *tsdb.MeasurementFieldSet) error {
+	tmpPath := path + ".rebuilding"
+	if err := os.RemoveAll(tmpPath); err != nil {
+		return err
+	}
+
+	fs, err := tsdb.NewMeasurementFieldSet(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer fs.Close()
+
+	fields := t.resolve(func(measurement string, field string) influxql.DataType {
+		if previous == nil {
+			return influxql.Unknown
+		}
+		if mf := previous.FieldsByString(measurement); mf != nil {
+			if f := mf.Field(field); f != nil {
+				return f.Type
+			}
+		}
+		return influxql.Unknown
+	})
+
+	for measurement, types := range fields {
+		mf := fs.CreateFieldsIfNotExists([]byte(measurement))
+		for field, typ := range types {
+			if err := mf.CreateFieldIfNotExists([]byte(field), typ); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := fs.Save(); err != nil {
+		return err
+	}
+
+	// An empty set is not written at all
+	if _, err := os.Stat(tmpPath); os.IsNotExist(err) {
+		return os.RemoveAll(path)
+	}
+
+	return os.Rename(tmpPath, path)
+}
+
+// Conflicts returns the tracked fields none of the types of which matches the type of the same field in a fields
+// index, which may be nil
+func (t *FieldTracker) Conflicts(fs *tsdb.MeasurementFieldSet) []FieldsIndexChange {
+	var conflicts []FieldsIndexChange
+	if fs == nil {
+		return nil
+	}
+
+	for measurement, fields := range t.fields {
+		mf := fs.FieldsByString(measurement)
+		if mf == nil {
+			continue
+		}
+
+		for field, types := range fields {
+			f := mf.Field(field)
+			if f == nil {
+				continue
+			}
+
+			conflict := true
+			for _, typ := range types {
+				if typ == f.Type {
+					conflict = false
+				}
+			}
+			if conflict {
+				conflicts = append(conflicts, FieldsIndexChange{Measurement: measurement, Field: field, OldType: f.Type, NewType: types[0]})
+			}
+		}
+	}
+
+	sort.Slice(conflicts, func(i, j int) bool {
+		if conflicts[i].Measurement != conflicts[j].Measurement {
+			return conflicts[i].Measurement < conflicts[j].Measurement
+		}
+		return conflicts[i].Field < conflicts[j].Field
+	})
+
+	return conflicts
+}
+
+// AddTo adds the tracked fields missing from a fields index, existing fields keeping their type
+func (t *FieldTracker) AddTo(fs *tsdb.MeasurementFieldSet) error {
+	fields := t.resolve(func(measurement string, field string) influxql.DataType {
+		if mf := fs.FieldsByString(measurement); mf != nil {
+			if f := mf.Field(field); f != nil {
+				return f.Type
+			}
+		}
+		return influxql.Unknown
+	})
+
+	for measurement, types := range fields {
+		mf := fs.CreateFieldsIfNotExists([]byte(measurement))
+		for field, typ := range types {
+			if mf.Field(field) != nil {
+				continue
+			}
+			if err := mf.CreateFieldIfNotExists([]byte(field), typ); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Diff returns the changes between a previous fields index, as returned by ReadFieldsIndex, and the tracked fields
+func (t *FieldTracker) Diff(previous map[string]map[string]influxql.DataType) []FieldsIndexChange {
+	fields := t.resolve(func(measurement string, field string) influxql.DataType {
+		return previous[measurement][field]
+	})
+
+	var changes []FieldsIndexChange
+
+	for measurement, types := range fields {
+		for field, typ := range types {
+			if old := previous[measurement][field]; old != typ {
+				changes = append(changes, FieldsIndexChange{Measurement: measurement, Field: field, OldType: old, NewType: typ})
+			}
+		}
+	}
+
+	for measurement, types := range previous {
+		for field, typ := range types {
+			if _, ok := fields[measurement][field]; !ok {
+				changes = append(changes, FieldsIndexChange{Measurement: measurement, Field: field, OldType: typ, NewType: influxql.Unknown})
+			}
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].Measurement != changes[j].Measurement {
+			return changes[i].Measurement < changes[j].Measurement
+		}
+		return changes[i].Field < changes[j].Field
+	})
+
+	return changes
+}
+
+// resolve picks a single type for each tracked field, preferring the type returned by previousType
+func (t *FieldTracker) resolve(previousType func(measurement string, field string) influxql.DataType) map[string]map[string]influxql.DataType {
+	resolved := make(map[string]map[string]influxql.DataType, len(t.fields))
+
+	for measurement, fields := range t.fields {
+		types := make(map[string]influxql.DataType, len(fields))
+
+		for field, candidates := range fields {
+			typ := candidates[0]
+			if previous := previousType(measurement, field); previous != influxql.Unknown {
+				for _, candidate := range candidates {
+					if candidate == previous {
+						typ = candidate
+						break
+					}
+				}
+			}
+			types[field] = typ
+		}
+
+		resolved[measurement] = types
+	}
+
+	return resolved
+}
+
+// FieldsIndexChange describes a field added, removed or whose type changed in a fields index. OldType is
+// influxql.Unknown for an added field and NewType is influxql.Unknown for a removed field
+type FieldsIndexChange struct {
+	Measurement string
+	Field       string
+	OldType     influxql.DataType
+	NewType     influxql.DataType
+}
+
+// String implements Stringer interface
+func (c FieldsIndexChange) String() string {
+	switch {
+	case c.OldType == influxql.Unknown:
+		return fmt.Sprintf("+ measurement '%s' field '%s' (%s)", c.Measurement, c.Field, c.NewType)
+	case c.NewType == influxql.Unknown:
+		return fmt.Sprintf("- measurement '%s' field '%s' (%s)", c.Measurement, c.Field, c.OldType)
+	default:
+		return fmt.Sprintf("~ measurement '%s' field '%s' (%s -> %s)", c.Measurement, c.Field, c.OldType, c.NewType)
+	}
+}
+
+// ReadFieldsIndex decodes a fields index file into a map of measurement to field types. Unlike
+// tsdb.MeasurementFieldSet, it gives access to all the measurements of the index
+func ReadFieldsIndex(path string) (map[string]map[string]influxql.DataType, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.HasPrefix(b, _fieldsIndexMagicNumber) {
+		return nil, tsdb.ErrUnknownFieldsFormat
+	}
+
+	index := make(map[string]map[string]influxql.DataType)
+
+	// The index is a tsdb.MeasurementFieldSet protobuf message
+	err = decodeProtoFields(b[len(_fieldsIndexMagicNumber):], func(num uint64, measurement []byte) error {
+		if num != 1 {
+			return nil
+		}
+
+		var name []byte
+		fields := make(map[string]influxql.DataType)
+
+		err := decodeProtoFields(measurement, func(num uint64, b []byte) error {
+			switch num {
+			case 1:
+				name = b
+			case 2:
+				var fieldName []byte
+				var fieldType influxql.DataType
+
+				err := decodeProtoFields(b, func(num uint64, b []byte) error {
+					switch num {
+					case 1:
+						fieldName = b
+					case 2:
+						v, n := binary.Uvarint(b)
+						if n <= 0 {
+							return ErrInvalidFieldsIndex
+						}
+						fieldType = influxql.DataType(v)
+					}
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+
+				fields[string(fieldName)] = fieldType
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		index[string(name)] = fields
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return index, nil
+}
+
+// decodeProtoFields walks the fields of a protobuf message. fn receives the raw varint bytes for varint fields and
+// the content for length-delimited fields
+func decodeProtoFields(b []byte, fn func(num uint64, b []byte) error) error {
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return ErrInvalidFieldsIndex
+		}
+		b = b[n:]
+
+		var value []byte
+
+		switch tag & 7 {
+		case 0: // varint
+			_, n := binary.Uvarint(b)
+			if n <= 0 {
+				return ErrInvalidFieldsIndex
+			}
+			value, b = b[:n], b[n:]
+		case 2: // length-delimited
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				return ErrInvalidFieldsIndex
+			}
+			value, b = b[n:n+int(l)], b[n+int(l):]
+		default:
+			return ErrInvalidFieldsIndex
+		}
+
+		if err := fn(tag>>3, value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
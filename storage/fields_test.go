@@ -0,0 +1,211 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/influxdata/influxdb/tsdb"
+	"github.com/influxdata/influxdb/tsdb/engine/tsm1"
+	"github.com/influxdata/influxql"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFieldTracker_ShouldRebuildFieldsIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "infix-fields")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, FieldsIndexFileName)
+
+	previous, err := tsdb.NewMeasurementFieldSet(path)
+	assert.NoError(t, err)
+	defer previous.Close()
+
+	cpu := previous.CreateFieldsIfNotExists([]byte("cpu"))
+	assert.NoError(t, cpu.CreateFieldIfNotExists([]byte("idle"), influxql.Integer))
+	assert.NoError(t, cpu.CreateFieldIfNotExists([]byte("user"), influxql.Float))
+	disk := previous.CreateFieldsIfNotExists([]byte("disk"))
+	assert.NoError(t, disk.CreateFieldIfNotExists([]byte("free"), influxql.Integer))
+	assert.NoError(t, previous.Save())
+
+	fields := NewFieldTracker()
+	fields.AddValues([]byte("cpu,host=a#!~#idle"), []tsm1.Value{tsm1.NewFloatValue(0, 1.0)})
+
+	written := NewFieldTracker()
+	written.AddValues([]byte("cpu,host=b#!~#idle"), []tsm1.Value{tsm1.NewIntegerValue(0, 1)})
+	written.AddValues([]byte(`mem\,swap,host=b#!~#used`), []tsm1.Value{tsm1.NewStringValue(0, "1")})
+	written.AddValues([]byte("mem#!~#free"), nil)
+	fields.Merge(written)
+
+	assert.True(t, fields.Valid())
+	assert.NoError(t, fields.Rebuild(path, previous))
+
+	_, err = os.Stat(path + ".rebuilding")
+	assert.True(t, os.IsNotExist(err))
+
+	index, err := tsdb.NewMeasurementFieldSet(path)
+	assert.NoError(t, err)
+	defer index.Close()
+
+	// idle has been seen as float and integer, the type of the previous index is kept
+	assert.Equal(t, map[string]influxql.DataType{"idle": influxql.Integer}, index.FieldsByString("cpu").FieldSet())
+	assert.Equal(t, map[string]influxql.DataType{"used": influxql.String}, index.FieldsByString("mem,swap").FieldSet())
+	assert.Nil(t, index.FieldsByString("disk"))
+	assert.Nil(t, index.FieldsByString("mem"))
+}
+
+func TestFieldTracker_ShouldRemoveEmptyFieldsIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "infix-fields")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, FieldsIndexFileName)
+	assert.NoError(t, ioutil.WriteFile(path, []byte("stale"), 0644))
+
+	assert.NoError(t, NewFieldTracker().Rebuild(path, nil))
+
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestFieldTracker_ShouldRebuildFieldsIndexWithoutDroppedFields(t *testing.T) {
+	dir, err := ioutil.TempDir("", "infix-fields")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, FieldsIndexFileName)
+
+	previous, err := tsdb.NewMeasurementFieldSet(path)
+	assert.NoError(t, err)
+	defer previous.Close()
+
+	mem := previous.CreateFieldsIfNotExists([]byte("mem"))
+	assert.NoError(t, mem.CreateFieldIfNotExists([]byte("used"), influxql.Float))
+	assert.NoError(t, mem.CreateFieldIfNotExists([]byte("available"), influxql.Float))
+	swap := previous.CreateFieldsIfNotExists([]byte("swap"))
+	assert.NoError(t, swap.CreateFieldIfNotExists([]byte("used"), influxql.String))
+	assert.NoError(t, previous.Save())
+
+	// Only the keys remaining once the string "used" fields have been dropped are tracked
+	fields := NewFieldTracker()
+	fields.AddValues([]byte("mem,host=my-host#!~#used"), []tsm1.Value{tsm1.NewFloatValue(0, 3.5)})
+	fields.AddValues([]byte("mem,host=my-host#!~#available"), []tsm1.Value{tsm1.NewFloatValue(0, 3.5)})
+
+	assert.NoError(t, fields.Rebuild(path, previous))
+
+	index, err := tsdb.NewMeasurementFieldSet(path)
+	assert.NoError(t, err)
+	defer index.Close()
+
+	// "used" remains for the series holding floats, "swap" has lost its only field
+	assert.Equal(t, map[string]influxql.DataType{"used": influxql.Float, "available": influxql.Float}, index.FieldsByString("mem").FieldSet())
+	assert.Nil(t, index.FieldsByString("swap"))
+}
+
+func TestFieldTracker_ShouldBeInvalidated(t *testing.T) {
+	var nilTracker *FieldTracker
+	nilTracker.AddValues([]byte("cpu#!~#idle"), []tsm1.Value{tsm1.NewFloatValue(0, 1.0)})
+	nilTracker.Invalidate()
+	assert.False(t, nilTracker.Valid())
+
+	fields := NewFieldTracker()
+	other := NewFieldTracker()
+	other.AddBlockType([]byte("cpu#!~#idle"), 0xff)
+	assert.False(t, other.Valid())
+
+	fields.Merge(other)
+	assert.False(t, fields.Valid())
+}
+
+func TestReadFieldsIndex_ShouldDecodeFieldsIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "infix-fields")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, FieldsIndexFileName)
+
+	_, err = ReadFieldsIndex(path)
+	assert.True(t, os.IsNotExist(err))
+
+	fs, err := tsdb.NewMeasurementFieldSet(path)
+	assert.NoError(t, err)
+	defer fs.Close()
+
+	cpu := fs.CreateFieldsIfNotExists([]byte("cpu"))
+	assert.NoError(t, cpu.CreateFieldIfNotExists([]byte("idle"), influxql.Float))
+	assert.NoError(t, cpu.CreateFieldIfNotExists([]byte("count"), influxql.Unsigned))
+	mem := fs.CreateFieldsIfNotExists([]byte("mem"))
+	assert.NoError(t, mem.CreateFieldIfNotExists([]byte("used"), influxql.Integer))
+	assert.NoError(t, fs.Save())
+
+	index, err := ReadFieldsIndex(path)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]map[string]influxql.DataType{
+		"cpu": {"idle": influxql.Float, "count": influxql.Unsigned},
+		"mem": {"used": influxql.Integer},
+	}, index)
+
+	b, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(path, b[:len(b)-1], 0644))
+
+	_, err = ReadFieldsIndex(path)
+	assert.Equal(t, ErrInvalidFieldsIndex, err)
+
+	assert.NoError(t, ioutil.WriteFile(path, []byte("corrupt"), 0644))
+
+	_, err = ReadFieldsIndex(path)
+	assert.Equal(t, tsdb.ErrUnknownFieldsFormat, err)
+}
+
+func TestFieldTracker_ShouldDiffFieldsIndex(t *testing.T) {
+	fields := NewFieldTracker()
+	fields.Add([]byte("cpu,host=a#!~#idle"), influxql.Integer)
+	fields.Add([]byte("cpu,host=a#!~#user"), influxql.Float)
+	fields.Add([]byte("cpu,host=a#!~#system"), influxql.Float)
+	fields.Add([]byte("mem,host=a#!~#used"), influxql.Float)
+
+	previous := map[string]map[string]influxql.DataType{
+		"cpu":  {"idle": influxql.Float, "user": influxql.Float},
+		"disk": {"free": influxql.Integer},
+	}
+
+	assert.Equal(t, []FieldsIndexChange{
+		{Measurement: "cpu", Field: "idle", OldType: influxql.Float, NewType: influxql.Integer},
+		{Measurement: "cpu", Field: "system", OldType: influxql.Unknown, NewType: influxql.Float},
+		{Measurement: "disk", Field: "free", OldType: influxql.Integer, NewType: influxql.Unknown},
+		{Measurement: "mem", Field: "used", OldType: influxql.Unknown, NewType: influxql.Float},
+	}, fields.Diff(previous))
+
+	assert.Len(t, fields.Diff(nil), 4)
+}
+
+func TestFieldTracker_ShouldAddToFieldsIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "infix-fields")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	fs, err := tsdb.NewMeasurementFieldSet(filepath.Join(dir, FieldsIndexFileName))
+	assert.NoError(t, err)
+	defer fs.Close()
+
+	cpu := fs.CreateFieldsIfNotExists([]byte("cpu"))
+	assert.NoError(t, cpu.CreateFieldIfNotExists([]byte("idle"), influxql.Integer))
+	assert.NoError(t, cpu.CreateFieldIfNotExists([]byte("user"), influxql.Float))
+
+	fields := NewFieldTracker()
+	fields.AddValues([]byte("cpu,host=a#!~#idle"), []tsm1.Value{tsm1.NewIntegerValue(0, 1)})
+	fields.AddValues([]byte("cpu,host=a#!~#system"), []tsm1.Value{tsm1.NewFloatValue(0, 1.0)})
+	fields.AddValues([]byte("mem,host=a#!~#used"), []tsm1.Value{tsm1.NewIntegerValue(0, 1)})
+
+	assert.Empty(t, fields.Conflicts(fs))
+	assert.NoError(t, fields.AddTo(fs))
+
+	assert.Equal(t, map[string]influxql.DataType{"idle": influxql.Integer, "user": influxql.Float, "system": influxql.Float}, fs.FieldsByString("cpu").FieldSet())
+	assert.Equal(t, map[string]influxql.DataType{"used": influxql.Integer}, fs.FieldsByString("mem").FieldSet())
+
+	fields.AddValues([]byte("cpu,host=b#!~#user"), []tsm1.Value{tsm1.NewStringValue(0, "1")})
+	assert.Equal(t, []FieldsIndexChange{{Measurement: "cpu", Field: "user", OldType: influxql.Float, NewType: influxql.String}}, fields.Conflicts(fs))
+}
@@ -0,0 +1,90 @@
+package storage
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Process is a running process holding a file of the storage open
+type Process struct {
+	PID  int
+	Name string
+	Path string
+}
+
+func (p Process) String() string {
+	return fmt.Sprintf("%s (PID %d) has '%s' open", p.Name, p.PID, p.Path)
+}
+
+// FindProcesses returns the processes, other than the current one, holding a file under one of the given directories
+// open. It is only supported on Linux, through /proc, and returns nothing on other platforms. Processes of other users
+// are only visible when running as root
+func FindProcesses(dirs ...string) ([]Process, error) {
+	var prefixes []string
+	for _, dir := range dirs {
+		if dir == "" {
+			continue
+		}
+
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return nil, err
+		}
+
+		// Open files are reported with their resolved path
+		if resolved, err := filepath.EvalSymlinks(abs); err == nil {
+			abs = resolved
+		}
+		prefixes = append(prefixes, abs)
+	}
+
+	if len(prefixes) == 0 {
+		return nil, nil
+	}
+
+	return findProcesses(func(path string) bool {
+		for _, prefix := range prefixes {
+			if path == prefix || strings.HasPrefix(path, prefix+string(filepath.Separator)) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// RunningPID returns the PID read from pidFile if that process is running, 0 if the file does not exist or the
+// process has exited
+func RunningPID(pidFile string) (int, error) {
+	b, err := ioutil.ReadFile(pidFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return 0, fmt.Errorf("invalid PID file '%s': %v", pidFile, err)
+	}
+
+	if pid <= 0 || !processExists(pid) {
+		return 0, nil
+	}
+	return pid, nil
+}
+
+// BoltLocked returns true if the bolt file at path is locked for writing by another process, like a running influxd
+func BoltLocked(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	return fileLocked(f)
+}
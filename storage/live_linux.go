@@ -0,0 +1,49 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+func findProcesses(match func(path string) bool) ([]Process, error) {
+	entries, err := ioutil.ReadDir("/proc")
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	self := os.Getpid()
+
+	var ret []Process
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || pid == self {
+			continue
+		}
+
+		fdDir := filepath.Join("/proc", entry.Name(), "fd")
+
+		// Processes may exit while scanning, and file descriptors of other users are not readable
+		fds, err := ioutil.ReadDir(fdDir)
+		if err != nil {
+			continue
+		}
+
+		for _, fd := range fds {
+			path, err := os.Readlink(filepath.Join(fdDir, fd.Name()))
+			if err != nil || !match(path) {
+				continue
+			}
+
+			name, _ := ioutil.ReadFile(filepath.Join("/proc", entry.Name(), "comm"))
+			ret = append(ret, Process{PID: pid, Name: strings.TrimSpace(string(name)), Path: path})
+			break
+		}
+	}
+
+	return ret, nil
+}
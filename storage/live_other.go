@@ -0,0 +1,8 @@
+//go:build !linux
+// +build !linux
+
+package storage
+
+func findProcesses(match func(path string) bool) ([]Process, error) {
+	return nil, nil
+}
@@ -0,0 +1,95 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestRunningPID_ShouldReadPIDFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "infix-live")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	pidFile := filepath.Join(dir, "influxd.pid")
+
+	pid, err := RunningPID(pidFile)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, pid)
+
+	assert.NoError(t, ioutil.WriteFile(pidFile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644))
+	pid, err = RunningPID(pidFile)
+	assert.NoError(t, err)
+	assert.Equal(t, os.Getpid(), pid)
+
+	assert.NoError(t, ioutil.WriteFile(pidFile, []byte("influxd"), 0644))
+	_, err = RunningPID(pidFile)
+	assert.Error(t, err)
+}
+
+func TestBoltLocked_ShouldDetectOpenStore(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("lock detection is not supported on windows")
+	}
+
+	dir, err := ioutil.TempDir("", "infix-live")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, DefaultBoltFileName)
+
+	db, err := bolt.Open(path, 0600, nil)
+	assert.NoError(t, err)
+
+	locked, err := BoltLocked(path)
+	assert.NoError(t, err)
+	assert.True(t, locked)
+
+	assert.NoError(t, db.Close())
+
+	locked, err = BoltLocked(path)
+	assert.NoError(t, err)
+	assert.False(t, locked)
+}
+
+func TestFindProcesses_ShouldFindOpenFiles(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("open files are only found on linux")
+	}
+
+	dir, err := ioutil.TempDir("", "infix-live")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "000000001-000000001.tsm")
+	assert.NoError(t, ioutil.WriteFile(path, nil, 0644))
+
+	processes, err := FindProcesses(dir)
+	assert.NoError(t, err)
+	assert.Empty(t, processes)
+
+	cmd := exec.Command("tail", "-f", path)
+	assert.NoError(t, cmd.Start())
+	defer cmd.Process.Kill()
+
+	// Wait for tail to open the file
+	for i := 0; i < 100 && len(processes) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		processes, err = FindProcesses(dir)
+		assert.NoError(t, err)
+	}
+
+	if assert.Len(t, processes, 1) {
+		assert.Equal(t, cmd.Process.Pid, processes[0].PID)
+		assert.Equal(t, "tail", processes[0].Name)
+		assert.Equal(t, path, processes[0].Path)
+	}
+}
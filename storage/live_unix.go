@@ -0,0 +1,27 @@
+//go:build !windows
+// +build !windows
+
+package storage
+
+import (
+	"os"
+	"syscall"
+)
+
+func processExists(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// fileLocked tries to take a shared lock on f, which fails if another process holds the exclusive lock bolt takes
+// on the files it writes to
+func fileLocked(f *os.File) (bool, error) {
+	err := syscall.Flock(int(f.Fd()), syscall.LOCK_SH|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return false, syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
@@ -0,0 +1,19 @@
+package storage
+
+import (
+	"os"
+)
+
+func processExists(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	p.Release()
+	return true
+}
+
+// Lock detection is not supported on Windows
+func fileLocked(f *os.File) (bool, error) {
+	return false, nil
+}
@@ -0,0 +1,138 @@
+package storage
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/influxdata/influxdb/services/meta"
+)
+
+// MetaFileName is the name of the meta store snapshot file in the InfluxDB 1.x meta directory
+const MetaFileName = "meta.db"
+
+// ShardMeta gives information about a shard read from the meta store
+type ShardMeta struct {
+	GroupID   uint64
+	StartTime time.Time
+	EndTime   time.Time
+
+	RetentionDuration  time.Duration
+	ShardGroupDuration time.Duration
+
+	Owners []uint64
+}
+
+// Overlaps returns true if the shard group time range overlaps the given time range
+func (m *ShardMeta) Overlaps(timeRange TimeRange) bool {
+	if !timeRange.Start.IsZero() && !m.EndTime.After(timeRange.Start) {
+		return false
+	}
+	if !timeRange.End.IsZero() && !m.StartTime.Before(timeRange.End) {
+		return false
+	}
+	return true
+}
+
+// LoadMeta reads the meta store snapshot from an InfluxDB 1.x meta directory
+func LoadMeta(metaDir string) (*meta.Data, error) {
+	path := filepath.Join(metaDir, MetaFileName)
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	data := &meta.Data{}
+	if err := data.UnmarshalBinary(b); err != nil {
+		return nil, fmt.Errorf("failed to read meta store '%s': %v", path, err)
+	}
+
+	return data, nil
+}
+
+// SaveMeta writes the meta store snapshot of an InfluxDB 1.x meta directory, keeping the previous one, if any, with a
+// .bak extension
+func SaveMeta(metaDir string, data *meta.Data) error {
+	path := filepath.Join(metaDir, MetaFileName)
+
+	b, err := data.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	if err := CopyFile(path, path+".bak", false); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	tmpPath := path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, b, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
+
+// AttachMeta sets meta information on shards found in the meta store. Shards that are unknown to the meta
+// store are left without meta information
+func AttachMeta(shards []ShardInfo, data *meta.Data) {
+	for i := range shards {
+		sh := &shards[i]
+
+		m := findShardMeta(data, sh.Database, sh.RetentionPolicy, sh.ID)
+		if m == nil {
+			log.Printf("shard %d not found in meta store", sh.ID)
+			continue
+		}
+
+		sh.Meta = m
+	}
+}
+
+func findShardMeta(data *meta.Data, database string, retentionPolicy string, id uint64) *ShardMeta {
+	db := data.Database(database)
+	if db == nil {
+		return nil
+	}
+
+	rp := db.RetentionPolicy(retentionPolicy)
+	if rp == nil {
+		return nil
+	}
+
+	for _, sg := range rp.ShardGroups {
+		if sg.Deleted() {
+			continue
+		}
+
+		for _, sh := range sg.Shards {
+			if sh.ID != id {
+				continue
+			}
+
+			endTime := sg.EndTime
+			if sg.Truncated() {
+				endTime = sg.TruncatedAt
+			}
+
+			var owners []uint64
+			for _, o := range sh.Owners {
+				owners = append(owners, o.NodeID)
+			}
+
+			return &ShardMeta{
+				GroupID:            sg.ID,
+				StartTime:          sg.StartTime,
+				EndTime:            endTime,
+				RetentionDuration:  rp.Duration,
+				ShardGroupDuration: rp.ShardGroupDuration,
+				Owners:             owners,
+			}
+		}
+	}
+
+	return nil
+}
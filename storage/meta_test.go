@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb/services/meta"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAttachMeta_ShouldSetShardGroupInformation(t *testing.T) {
+	start := time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)
+	end := start.Add(7 * 24 * time.Hour)
+
+	data := &meta.Data{
+		Databases: []meta.DatabaseInfo{
+			{
+				Name: "telegraf",
+				RetentionPolicies: []meta.RetentionPolicyInfo{
+					{
+						Name:               "autogen",
+						Duration:           30 * 24 * time.Hour,
+						ShardGroupDuration: 7 * 24 * time.Hour,
+						ShardGroups: []meta.ShardGroupInfo{
+							{
+								ID:        3,
+								StartTime: start,
+								EndTime:   end,
+								Shards:    []meta.ShardInfo{{ID: 12, Owners: []meta.ShardOwner{{NodeID: 1}}}},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	shards := []ShardInfo{
+		{ID: 12, Database: "telegraf", RetentionPolicy: "autogen"},
+		{ID: 13, Database: "telegraf", RetentionPolicy: "autogen"},
+	}
+
+	AttachMeta(shards, data)
+
+	assert.NotNil(t, shards[0].Meta)
+	assert.Nil(t, shards[1].Meta)
+
+	m := shards[0].Meta
+	assert.Equal(t, uint64(3), m.GroupID)
+	assert.Equal(t, []uint64{1}, m.Owners)
+	assert.Equal(t, 30*24*time.Hour, m.RetentionDuration)
+
+	assert.True(t, m.Overlaps(TimeRange{}))
+	assert.True(t, m.Overlaps(TimeRange{Start: start.Add(time.Hour)}))
+	assert.True(t, m.Overlaps(TimeRange{End: start.Add(time.Hour)}))
+	assert.False(t, m.Overlaps(TimeRange{Start: end}))
+	assert.False(t, m.Overlaps(TimeRange{End: start}))
+}
+
+func TestSaveMeta_ShouldKeepPreviousSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "infix-meta")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	data := &meta.Data{Databases: []meta.DatabaseInfo{{Name: "telegraf"}}}
+	b, err := data.MarshalBinary()
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, MetaFileName), b, 0600))
+
+	data.Databases = append(data.Databases, meta.DatabaseInfo{Name: "_internal"})
+	assert.NoError(t, SaveMeta(dir, data))
+
+	saved, err := LoadMeta(dir)
+	assert.NoError(t, err)
+	assert.Len(t, saved.Databases, 2)
+
+	previous, err := ioutil.ReadFile(filepath.Join(dir, MetaFileName+".bak"))
+	assert.NoError(t, err)
+	assert.Equal(t, b, previous)
+}
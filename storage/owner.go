@@ -0,0 +1,31 @@
+package storage
+
+import (
+	"os"
+)
+
+// Ownership is the owner, group and permission bits of a file
+type Ownership struct {
+	UID  int
+	GID  int
+	Mode os.FileMode
+}
+
+// ReadOwnership returns the ownership of the file at path
+func ReadOwnership(path string) (Ownership, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return Ownership{}, err
+	}
+
+	uid, gid := fileOwner(fi)
+	return Ownership{UID: uid, GID: gid, Mode: fi.Mode().Perm()}, nil
+}
+
+// Apply changes the owner, group and permission bits of the file at path
+func (o Ownership) Apply(path string) error {
+	if err := chown(path, o.UID, o.GID); err != nil {
+		return err
+	}
+	return os.Chmod(path, o.Mode)
+}
@@ -0,0 +1,32 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOwnership_ShouldRestoreMode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "infix-owner")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "000000001-000000001.tsm")
+	assert.NoError(t, ioutil.WriteFile(path, []byte("original"), 0600))
+
+	o, err := ReadOwnership(path)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), o.Mode)
+
+	tmpPath := path + ".tmp"
+	assert.NoError(t, ioutil.WriteFile(tmpPath, []byte("rewritten"), 0644))
+	assert.NoError(t, os.Rename(tmpPath, path))
+	assert.NoError(t, o.Apply(path))
+
+	restored, err := ReadOwnership(path)
+	assert.NoError(t, err)
+	assert.Equal(t, o, restored)
+}
@@ -0,0 +1,14 @@
+package storage
+
+import (
+	"os"
+)
+
+// Files have no owner or group to restore on Windows
+func fileOwner(fi os.FileInfo) (int, int) {
+	return -1, -1
+}
+
+func chown(path string, uid int, gid int) error {
+	return nil
+}
@@ -1,10 +1,14 @@
 package storage
 
 import (
+	"bytes"
+	"fmt"
 	"log"
 	"os"
+	"path/filepath"
 
 	"github.com/influxdata/influxdb/pkg/limiter"
+	"github.com/influxdata/influxdb/tsdb"
 	"github.com/influxdata/influxdb/tsdb/engine/tsm1"
     "go.uber.org/zap"
 )
@@ -50,6 +54,15 @@ func NewCachedTSMRewriter(maxSize uint64, flushSizeThrehsold uint64, path string
 	}
 }
 
+// SetCompactThroughput limits the files written by the rewriter to throughput bytes per second with bursts of burst
+// bytes. A throughput of 0 disables rate limiting
+func (w *CachedTSMRewriter) SetCompactThroughput(throughput int, burst int) {
+	w.compactor.RateLimit = nil
+	if throughput > 0 {
+		w.compactor.RateLimit = limiter.NewRate(throughput, burst)
+	}
+}
+
 // Write implements the Rewriter interface
 func (w *CachedTSMRewriter) Write(key []byte, values []tsm1.Value) error {
 	if err := w.cache.Write(key, values); err != nil {
@@ -64,6 +77,13 @@ func (w *CachedTSMRewriter) Write(key []byte, values []tsm1.Value) error {
 	return nil
 }
 
+// DeleteRange removes the values written so far for keys between timestamps min and max, from the cache and from the
+// snapshots already written
+func (w *CachedTSMRewriter) DeleteRange(keys [][]byte, min int64, max int64) error {
+	w.cache.DeleteRange(keys, min, max)
+	return w.fileStore.DeleteRange(keys, min, max)
+}
+
 // WriteSnapshot will snapshot the cache and write a new TSM file with its content
 func (w *CachedTSMRewriter) WriteSnapshot() error {
 	log.Printf("snapshoting cache")
@@ -175,3 +195,236 @@ func (w *NoopTSMRewriter) CompactFull() ([]string, error) {
 func (w *NoopTSMRewriter) Close() error {
 	return nil
 }
+
+// BlockTSMRewriter defines a TSMRewriter able to copy the blocks of unchanged keys from the rewritten file
+type BlockTSMRewriter interface {
+	TSMRewriter
+
+	// CopyBlocks copies the blocks of a key of the source file as is. Keys must be given in the source file order
+	CopyBlocks(key []byte) error
+}
+
+// PassthroughTSMRewriter rewrites a TSM file by copying the raw blocks of unchanged keys and only re-encoding
+// changed keys, which go through a CachedTSMRewriter. Both are merged in a single file by CompactFull
+type PassthroughTSMRewriter struct {
+	source  *tsm1.TSMReader
+	changed *CachedTSMRewriter
+
+	path string
+	keys [][]byte
+}
+
+// NewPassthroughTSMRewriter creates a new PassthroughTSMRewriter for the source file, writing to path
+func NewPassthroughTSMRewriter(source *tsm1.TSMReader, maxSize uint64, flushSizeThreshold uint64, path string) *PassthroughTSMRewriter {
+	return &PassthroughTSMRewriter{
+		source:  source,
+		changed: NewCachedTSMRewriter(maxSize, flushSizeThreshold, path),
+		path:    path,
+	}
+}
+
+// SetCompactThroughput limits the files written by the rewriter to throughput bytes per second with bursts of burst
+// bytes. A throughput of 0 disables rate limiting
+func (w *PassthroughTSMRewriter) SetCompactThroughput(throughput int, burst int) {
+	w.changed.SetCompactThroughput(throughput, burst)
+}
+
+// Write implements the Rewriter interface
+func (w *PassthroughTSMRewriter) Write(key []byte, values []tsm1.Value) error {
+	return w.changed.Write(key, values)
+}
+
+// CopyBlocks implements BlockTSMRewriter interface
+func (w *PassthroughTSMRewriter) CopyBlocks(key []byte) error {
+	w.keys = append(w.keys, key)
+	return nil
+}
+
+// WriteSnapshot implements Rewriter interface
+func (w *PassthroughTSMRewriter) WriteSnapshot() error {
+	return w.changed.WriteSnapshot()
+}
+
+// CompactFull implements Rewriter interface. Copied keys and changed keys are merged in key order, values of a
+// key both copied and changed are merged with changed values taking precedence
+func (w *PassthroughTSMRewriter) CompactFull() ([]string, error) {
+	changedFiles, err := w.changed.CompactFull()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(changedFiles) == 0 && len(w.keys) == 0 {
+		log.Println("skipping full compaction. No key has been written")
+		return nil, nil
+	}
+
+	if len(changedFiles) > 1 {
+		return nil, fmt.Errorf("full compaction yielded more than one file %v", changedFiles)
+	}
+
+	var changed *tsm1.TSMReader
+	if len(changedFiles) == 1 {
+		f, err := os.Open(changedFiles[0])
+		if err != nil {
+			return nil, err
+		}
+
+		changed, err = tsm1.NewTSMReader(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		defer changed.Close()
+	}
+
+	path := filepath.Join(w.path, "rewritten."+tsm1.TSMFileExtension)
+	tmpPath := path + "." + tsm1.CompactionTempExtension
+
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_RDWR|os.O_EXCL, 0666)
+	if err != nil {
+		return nil, err
+	}
+
+	tw, err := tsm1.NewTSMWriterWithDiskBuffer(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	// Remove closes the writer, closing it beforehand would remove the index buffer and fail the removal
+	if err := w.merge(tw, changed); err != nil {
+		tw.Remove()
+		return nil, err
+	}
+
+	if err := tw.WriteIndex(); err != nil {
+		tw.Remove()
+		return nil, err
+	}
+
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+
+	log.Printf("wrote new TSM file '%s' with %d copied key(s)\n", path, len(w.keys))
+	if err := os.Rename(tmpPath, path); err != nil {
+		return nil, err
+	}
+
+	return []string{path}, nil
+}
+
+func (w *PassthroughTSMRewriter) merge(tw tsm1.TSMWriter, changed *tsm1.TSMReader) error {
+	changedCount := 0
+	if changed != nil {
+		changedCount = changed.KeyCount()
+	}
+
+	for i, j := 0, 0; i < len(w.keys) || j < changedCount; {
+		var changedKey []byte
+		var changedType byte
+		if j < changedCount {
+			changedKey, changedType = changed.KeyAt(j)
+		}
+
+		var err error
+
+		switch {
+		case j >= changedCount || (i < len(w.keys) && bytes.Compare(w.keys[i], changedKey) < 0):
+			err = copyBlocks(tw, w.source, w.keys[i])
+			i++
+		case i >= len(w.keys) || bytes.Compare(w.keys[i], changedKey) > 0:
+			err = copyBlocks(tw, changed, changedKey)
+			j++
+		default:
+			err = mergeValues(tw, changedKey, w.source, changed, changedType)
+			i++
+			j++
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Close implements Rewriter interface
+func (w *PassthroughTSMRewriter) Close() error {
+	return w.changed.Close()
+}
+
+// CopyBlocks implements BlockTSMRewriter interface
+func (w *NoopTSMRewriter) CopyBlocks(key []byte) error {
+	return nil
+}
+
+// copyBlocks writes the blocks of a key without decoding them. Keys with tombstones are decoded so that deleted
+// values are not written back
+func copyBlocks(tw tsm1.TSMWriter, r *tsm1.TSMReader, key []byte) error {
+	if len(r.TombstoneRange(key)) > 0 {
+		values, err := r.ReadAll(key)
+		if err != nil {
+			return err
+		}
+		return writeValues(tw, key, values)
+	}
+
+	entries := r.Entries(key)
+	for i := range entries {
+		_, block, err := r.ReadBytes(&entries[i], nil)
+		if err != nil {
+			return err
+		}
+
+		if err := tw.WriteBlock(key, entries[i].MinTime, entries[i].MaxTime, block); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// mergeValues writes the values of a key both copied and changed, changed values taking precedence. Values of
+// different types cannot be written to the same key, such a conflict is returned as an error
+func mergeValues(tw tsm1.TSMWriter, key []byte, source *tsm1.TSMReader, changed *tsm1.TSMReader, changedType byte) error {
+	sourceType, err := source.Type(key)
+	if err != nil {
+		return err
+	}
+
+	if sourceType != changedType {
+		return fmt.Errorf("unable to merge %s values of key %q with %s values: %v", tsm1.BlockTypeToInfluxQLDataType(changedType),
+			string(key), tsm1.BlockTypeToInfluxQLDataType(sourceType), tsdb.ErrFieldTypeConflict)
+	}
+
+	values, err := source.ReadAll(key)
+	if err != nil {
+		return err
+	}
+
+	changedValues, err := changed.ReadAll(key)
+	if err != nil {
+		return err
+	}
+
+	return writeValues(tw, key, tsm1.Values(values).Merge(changedValues))
+}
+
+// writeValues encodes values in blocks of at most tsdb.DefaultMaxPointsPerBlock values
+func writeValues(tw tsm1.TSMWriter, key []byte, values []tsm1.Value) error {
+	for len(values) > 0 {
+		n := len(values)
+		if n > tsdb.DefaultMaxPointsPerBlock {
+			n = tsdb.DefaultMaxPointsPerBlock
+		}
+
+		if err := tw.Write(key, values[:n]); err != nil {
+			return err
+		}
+		values = values[n:]
+	}
+
+	return nil
+}
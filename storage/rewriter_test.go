@@ -0,0 +1,171 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/influxdata/influxdb/tsdb/engine/tsm1"
+	"github.com/stretchr/testify/assert"
+)
+
+func openTestTSMFile(t *testing.T, path string) *tsm1.TSMReader {
+	f, err := os.Open(path)
+	assert.NoError(t, err)
+
+	r, err := tsm1.NewTSMReader(f)
+	assert.NoError(t, err)
+	return r
+}
+
+func TestPassthroughTSMRewriter_ShouldMergeCopiedAndChangedKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "infix-rewriter")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "000000001-000000001.tsm")
+
+	f, err := os.Create(path)
+	assert.NoError(t, err)
+
+	w, err := tsm1.NewTSMWriter(f)
+	assert.NoError(t, err)
+
+	values := map[string][]tsm1.Value{
+		"cpu#!~#idle":   {tsm1.NewFloatValue(0, 1.0), tsm1.NewFloatValue(1, 2.0)},
+		"cpu#!~#user":   {tsm1.NewIntegerValue(0, 1), tsm1.NewIntegerValue(1, 2)},
+		"disk#!~#free":  {tsm1.NewFloatValue(0, 1.0), tsm1.NewFloatValue(1, 2.0)},
+		"mem#!~#used":   {tsm1.NewStringValue(0, "a"), tsm1.NewStringValue(1, "b")},
+		"swap#!~#total": {tsm1.NewFloatValue(0, 1.0)},
+	}
+	for _, key := range []string{"cpu#!~#idle", "cpu#!~#user", "disk#!~#free", "mem#!~#used", "swap#!~#total"} {
+		assert.NoError(t, w.Write([]byte(key), values[key]))
+	}
+	assert.NoError(t, w.WriteIndex())
+	assert.NoError(t, w.Close())
+
+	source := openTestTSMFile(t, path)
+	defer source.Close()
+
+	// Deleted values must not be copied back
+	assert.NoError(t, source.DeleteRange([][]byte{[]byte("disk#!~#free")}, 1, 1))
+
+	rw := NewPassthroughTSMRewriter(source, 1024*1024, 1024*1024, path+".rewriting")
+	assert.NoError(t, os.Mkdir(path+".rewriting", 0755))
+	defer rw.Close()
+
+	assert.NoError(t, rw.CopyBlocks([]byte("cpu#!~#idle")))
+	assert.NoError(t, rw.Write([]byte("cpu#!~#user"), []tsm1.Value{tsm1.NewFloatValue(0, 1.0), tsm1.NewFloatValue(1, 2.0)}))
+	assert.NoError(t, rw.CopyBlocks([]byte("disk#!~#free")))
+	assert.NoError(t, rw.CopyBlocks([]byte("mem#!~#used")))
+	// Values of swap renamed to mem are merged with the copied ones, changed values taking precedence
+	assert.NoError(t, rw.Write([]byte("mem#!~#used"), []tsm1.Value{tsm1.NewStringValue(1, "c"), tsm1.NewStringValue(2, "d")}))
+	assert.NoError(t, rw.WriteSnapshot())
+
+	files, err := rw.CompactFull()
+	assert.NoError(t, err)
+	assert.Len(t, files, 1)
+
+	r := openTestTSMFile(t, files[0])
+	defer r.Close()
+
+	expected := map[string][]tsm1.Value{
+		"cpu#!~#idle":  values["cpu#!~#idle"],
+		"cpu#!~#user":  {tsm1.NewFloatValue(0, 1.0), tsm1.NewFloatValue(1, 2.0)},
+		"disk#!~#free": {tsm1.NewFloatValue(0, 1.0)},
+		"mem#!~#used":  {tsm1.NewStringValue(0, "a"), tsm1.NewStringValue(1, "c"), tsm1.NewStringValue(2, "d")},
+	}
+
+	assert.Equal(t, len(expected), r.KeyCount())
+	for key, vs := range expected {
+		actual, err := r.ReadAll([]byte(key))
+		assert.NoError(t, err)
+		assert.Equal(t, vs, actual, key)
+	}
+}
+
+func TestPassthroughTSMRewriter_ShouldNotWriteEmptyFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "infix-rewriter")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "000000001-000000001.tsm")
+	writeTestTSMFile(t, path, "cpu#!~#idle", 0)
+
+	source := openTestTSMFile(t, path)
+	defer source.Close()
+
+	rw := NewPassthroughTSMRewriter(source, 1024*1024, 1024*1024, dir)
+	assert.NoError(t, rw.WriteSnapshot())
+
+	files, err := rw.CompactFull()
+	assert.NoError(t, err)
+	assert.Nil(t, files)
+}
+
+func TestCachedTSMRewriter_ShouldDeleteWrittenValues(t *testing.T) {
+	dir, err := ioutil.TempDir("", "infix-rewriter")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	rw := NewCachedTSMRewriter(1024*1024, 1024*1024, dir)
+	defer rw.Close()
+
+	assert.NoError(t, rw.Write([]byte("cpu#!~#idle"), []tsm1.Value{tsm1.NewFloatValue(0, 1.0), tsm1.NewFloatValue(10, 2.0)}))
+	assert.NoError(t, rw.WriteSnapshot())
+	assert.NoError(t, rw.Write([]byte("cpu#!~#idle"), []tsm1.Value{tsm1.NewFloatValue(5, 3.0)}))
+
+	// Both the snapshot and the cache are affected
+	assert.NoError(t, rw.DeleteRange([][]byte{[]byte("cpu#!~#idle")}, 0, 5))
+
+	files, err := rw.CompactFull()
+	assert.NoError(t, err)
+	if !assert.Len(t, files, 1) {
+		return
+	}
+
+	r := openTestTSMFile(t, files[0])
+	defer r.Close()
+
+	values, err := r.ReadAll([]byte("cpu#!~#idle"))
+	assert.NoError(t, err)
+	assert.Equal(t, []tsm1.Value{tsm1.NewFloatValue(10, 2.0)}, values)
+}
+
+func TestPassthroughTSMRewriter_ShouldNotMergeConflictingTypes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "infix-rewriter")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "000000001-000000001.tsm")
+
+	f, err := os.Create(path)
+	assert.NoError(t, err)
+
+	w, err := tsm1.NewTSMWriter(f)
+	assert.NoError(t, err)
+	assert.NoError(t, w.Write([]byte("cpu#!~#idle"), []tsm1.Value{tsm1.NewFloatValue(0, 1.0)}))
+	assert.NoError(t, w.Write([]byte("cpu#!~#user"), []tsm1.Value{tsm1.NewIntegerValue(0, 1)}))
+	assert.NoError(t, w.WriteIndex())
+	assert.NoError(t, w.Close())
+
+	source := openTestTSMFile(t, path)
+	defer source.Close()
+
+	rw := NewPassthroughTSMRewriter(source, 1024*1024, 1024*1024, path+".rewriting")
+	assert.NoError(t, os.Mkdir(path+".rewriting", 0755))
+	defer rw.Close()
+
+	// The float idle field is renamed to the existing integer user field
+	assert.NoError(t, rw.CopyBlocks([]byte("cpu#!~#user")))
+	assert.NoError(t, rw.Write([]byte("cpu#!~#user"), []tsm1.Value{tsm1.NewFloatValue(0, 1.0)}))
+	assert.NoError(t, rw.WriteSnapshot())
+
+	files, err := rw.CompactFull()
+	assert.Error(t, err)
+	assert.Nil(t, files)
+
+	_, err = os.Stat(filepath.Join(path+".rewriting", "rewritten.tsm."+tsm1.CompactionTempExtension))
+	assert.True(t, os.IsNotExist(err))
+}
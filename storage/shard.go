@@ -4,18 +4,28 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"os"
 	"path/filepath"
+	"regexp"
 	"strconv"
+	"time"
 
 	"github.com/influxdata/influxdb/tsdb"
 	"github.com/influxdata/influxdb/tsdb/engine/tsm1"
 )
 
+// FieldsIndexFileName is the name of the fields index file of a shard
+const FieldsIndexFileName = "fields.idx"
+
 const (
-	_fieldIndexFileName  = "fields.idx"
 	_seriesFileDirectory = "_series"
+
+	_engineDataDirectory = "data"
+	_engineWalDirectory  = "wal"
 )
 
+var _bucketIDPattern = regexp.MustCompile("^[0-9a-f]{16}$")
+
 // ShardInfo gives information about a shard
 type ShardInfo struct {
 	Path            string
@@ -23,13 +33,155 @@ type ShardInfo struct {
 	Database        string
 	RetentionPolicy string
 
+	// BucketID is the ID of the bucket for shards of an InfluxDB 2.x engine, empty for 1.x shards
+	BucketID string
+
 	TsmFiles    []string
 	FieldsIndex *tsdb.MeasurementFieldSet
 	WalFiles    []string
+
+	// WALPath is the WAL directory of the shard, which may not exist
+	WALPath string
+
+	// FieldsIndexErr is set when the fields index could not be loaded, FieldsIndex is then empty
+	FieldsIndexErr error
+
+	// Meta holds information from the meta store if it has been loaded, nil otherwise
+	Meta *ShardMeta
+}
+
+// TimeRange represents a time range [Start, End). A zero Start or End is unbounded
+type TimeRange struct {
+	Start time.Time
+	End   time.Time
+}
+
+// IsZero returns true if the time range is unbounded
+func (r TimeRange) IsZero() bool {
+	return r.Start.IsZero() && r.End.IsZero()
+}
+
+// Overlaps returns true if the time range overlaps the inclusive range [min, max] in unix nanoseconds
+func (r TimeRange) Overlaps(min int64, max int64) bool {
+	if !r.Start.IsZero() && max < r.Start.UnixNano() {
+		return false
+	}
+	if !r.End.IsZero() && min >= r.End.UnixNano() {
+		return false
+	}
+	return true
+}
+
+// TSMTimeRange returns the minimum and maximum timestamps of a TSM file read from its index
+func TSMTimeRange(path string) (int64, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	r, err := tsm1.NewTSMReader(f)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer r.Close()
+
+	min, max := r.TimeRange()
+	return min, max, nil
+}
+
+// LoadShards load all shards in a data directory. If the time range is not zero, only shards with TSM files
+// overlapping the time range or with WAL files are loaded
+func LoadShards(dataDir string, walDir string, database string, retentionPolicy string, shardFilter string, timeRange TimeRange) ([]ShardInfo, error) {
+	return loadShards(dataDir, walDir, func(name string) (string, bool) {
+		return name, database == "" || database == name
+	}, retentionPolicy, shardFilter, timeRange, false)
+}
+
+// SeriesFilePath returns the path of the series file directory of the database of the shard
+func (s ShardInfo) SeriesFilePath() string {
+	return filepath.Join(filepath.Dir(filepath.Dir(s.Path)), _seriesFileDirectory)
+}
+
+// EngineDirs returns the data and WAL directories of an InfluxDB 2.x engine directory
+func EngineDirs(engineDir string) (string, string) {
+	return filepath.Join(engineDir, _engineDataDirectory), filepath.Join(engineDir, _engineWalDirectory)
+}
+
+// IsEngineDir returns true if the given directory looks like an InfluxDB 2.x engine directory,
+// that is a directory with a data sub-directory only containing bucket IDs
+func IsEngineDir(engineDir string) bool {
+	dirs, err := ioutil.ReadDir(filepath.Join(engineDir, _engineDataDirectory))
+	if err != nil {
+		return false
+	}
+
+	found := false
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+		if !_bucketIDPattern.MatchString(d.Name()) {
+			return false
+		}
+		found = true
+	}
+
+	return found
 }
 
-// LoadShards load all shards in a data directory
-func LoadShards(dataDir string, walDir string, database string, retentionPolicy string, shardFilter string) ([]ShardInfo, error) {
+// LoadEngineShards load all shards in an InfluxDB 2.x engine directory. Bucket names are resolved from
+// the bolt metadata store if it exists. The bucket filter matches either the bucket name or its ID
+func LoadEngineShards(engineDir string, boltPath string, bucket string, retentionPolicy string, shardFilter string, timeRange TimeRange) ([]ShardInfo, error) {
+	if !IsEngineDir(engineDir) {
+		return nil, fmt.Errorf("'%s' is not an InfluxDB 2.x engine directory", engineDir)
+	}
+
+	bucketNames := make(map[string]string)
+	if _, err := os.Stat(boltPath); err == nil {
+		names, err := LoadBucketNames(boltPath)
+		if err != nil {
+			return nil, err
+		}
+		bucketNames = names
+	} else if os.IsNotExist(err) {
+		log.Printf("bolt file '%s' not found, buckets will be referenced by ID", boltPath)
+	} else {
+		return nil, err
+	}
+
+	dataDir, walDir := EngineDirs(engineDir)
+
+	return loadShards(dataDir, walDir, func(id string) (string, bool) {
+		name, ok := bucketNames[id]
+		if !ok {
+			name = id
+		}
+		return name, bucket == "" || bucket == name || bucket == id
+	}, retentionPolicy, shardFilter, timeRange, true)
+}
+
+func overlapsTSMFiles(tsmFiles []string, timeRange TimeRange) bool {
+	for _, path := range tsmFiles {
+		min, max, err := TSMTimeRange(path)
+		if err != nil {
+			// Keep the shard, unreadable files will be reported when processing it
+			log.Printf("unable to read time range of '%s': %v", path, err)
+			return true
+		}
+
+		if timeRange.Overlaps(min, max) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// resolveDatabaseFn returns the database name for a database directory and whether it should be loaded
+type resolveDatabaseFn func(dirName string) (string, bool)
+
+func loadShards(dataDir string, walDir string, resolveDatabase resolveDatabaseFn, retentionPolicy string, shardFilter string, timeRange TimeRange, buckets bool) ([]ShardInfo, error) {
 	dbDirs, err := ioutil.ReadDir(dataDir)
 	var shards []ShardInfo
 	if err != nil {
@@ -43,10 +195,15 @@ func LoadShards(dataDir string, walDir string, database string, retentionPolicy
 			continue
 		}
 
-		if database != "" && database != db.Name() {
+		database, ok := resolveDatabase(db.Name())
+		if !ok {
 			continue
 		}
 
+		var bucketID string
+		if buckets {
+			bucketID = db.Name()
+		}
 		rpDirs, err := ioutil.ReadDir(dbPath)
 		if err != nil {
 			return nil, err
@@ -90,10 +247,10 @@ func LoadShards(dataDir string, walDir string, database string, retentionPolicy
 
 				log.Printf("Found shard '%s' (%d) with WAL '%s'\n", shPath, shardID, walPath)
 
-				fieldsIndexPath := filepath.Join(shPath, _fieldIndexFileName)
-				fieldsIndex, err := tsdb.NewMeasurementFieldSet(fieldsIndexPath)
-				if err != nil {
-					return nil, err
+				fieldsIndexPath := filepath.Join(shPath, FieldsIndexFileName)
+				fieldsIndex, fieldsIndexErr := tsdb.NewMeasurementFieldSet(fieldsIndexPath)
+				if fieldsIndexErr != nil {
+					log.Printf("shard %d: unable to load fields index '%s': %v", shardID, fieldsIndexPath, fieldsIndexErr)
 				}
 
 				tsmFiles, err := filepath.Glob(filepath.Join(shPath, fmt.Sprintf("*.%s", tsm1.TSMFileExtension)))
@@ -106,14 +263,22 @@ func LoadShards(dataDir string, walDir string, database string, retentionPolicy
 					return nil, err
 				}
 
+				if !timeRange.IsZero() && len(walFiles) == 0 && !overlapsTSMFiles(tsmFiles, timeRange) {
+					log.Printf("shard %d: no TSM file overlapping time range, skipping", shardID)
+					continue
+				}
+
 				shardInfo := ShardInfo{
 					Path:            shPath,
 					ID:              shardID,
-					Database:        db.Name(),
+					Database:        database,
 					RetentionPolicy: rp.Name(),
+					BucketID:        bucketID,
 					TsmFiles:        tsmFiles,
 					FieldsIndex:     fieldsIndex,
 					WalFiles:        walFiles,
+					WALPath:         walPath,
+					FieldsIndexErr:  fieldsIndexErr,
 				}
 
 				shards = append(shards, shardInfo)
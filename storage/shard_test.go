@@ -0,0 +1,160 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb/tsdb/engine/tsm1"
+	"github.com/stretchr/testify/assert"
+	bolt "go.etcd.io/bbolt"
+)
+
+func newTestEngineDir(t *testing.T, buckets map[string]string) string {
+	dir, err := ioutil.TempDir("", "infix-engine")
+	assert.NoError(t, err)
+
+	engineDir := filepath.Join(dir, "engine")
+
+	for id := range buckets {
+		assert.NoError(t, os.MkdirAll(filepath.Join(engineDir, "data", id, "autogen", "1"), 0755))
+		assert.NoError(t, os.MkdirAll(filepath.Join(engineDir, "wal", id, "autogen", "1"), 0755))
+	}
+
+	db, err := bolt.Open(filepath.Join(dir, DefaultBoltFileName), 0600, nil)
+	assert.NoError(t, err)
+	defer db.Close()
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(_boltBucketsIndex))
+		if err != nil {
+			return err
+		}
+		for id, name := range buckets {
+			if err := b.Put([]byte(id), []byte(`{"id":"`+id+`","orgID":"0000000000000001","name":"`+name+`"}`)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+
+	return engineDir
+}
+
+func TestLoadEngineShards_ShouldResolveBucketNames(t *testing.T) {
+	engineDir := newTestEngineDir(t, map[string]string{
+		"0a1b2c3d4e5f6071": "telegraf",
+		"1a1b2c3d4e5f6071": "app_metrics",
+	})
+	defer os.RemoveAll(filepath.Dir(engineDir))
+
+	assert.True(t, IsEngineDir(engineDir))
+
+	boltPath := filepath.Join(filepath.Dir(engineDir), DefaultBoltFileName)
+
+	shards, err := LoadEngineShards(engineDir, boltPath, "telegraf", "", "", TimeRange{})
+	assert.NoError(t, err)
+	assert.Len(t, shards, 1)
+	assert.Equal(t, "telegraf", shards[0].Database)
+	assert.Equal(t, "0a1b2c3d4e5f6071", shards[0].BucketID)
+	assert.Equal(t, "autogen", shards[0].RetentionPolicy)
+	assert.Equal(t, uint64(1), shards[0].ID)
+
+	shards, err = LoadEngineShards(engineDir, boltPath, "1a1b2c3d4e5f6071", "", "", TimeRange{})
+	assert.NoError(t, err)
+	assert.Len(t, shards, 1)
+	assert.Equal(t, "app_metrics", shards[0].Database)
+
+	shards, err = LoadEngineShards(engineDir, boltPath, "", "", "", TimeRange{})
+	assert.NoError(t, err)
+	assert.Len(t, shards, 2)
+}
+
+func TestIsEngineDir_ShouldNotDetect1xDataDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "infix-data")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "data", "telegraf", "autogen", "1"), 0755))
+
+	assert.False(t, IsEngineDir(dir))
+	assert.False(t, IsEngineDir(filepath.Join(dir, "data")))
+}
+
+func writeTestTSMFile(t *testing.T, path string, key string, timestamps ...int64) {
+	f, err := os.Create(path)
+	assert.NoError(t, err)
+
+	w, err := tsm1.NewTSMWriter(f)
+	assert.NoError(t, err)
+
+	var values []tsm1.Value
+	for _, ts := range timestamps {
+		values = append(values, tsm1.NewFloatValue(ts, 1.0))
+	}
+
+	assert.NoError(t, w.Write([]byte(key), values))
+	assert.NoError(t, w.WriteIndex())
+	assert.NoError(t, w.Close())
+}
+
+func TestLoadShards_ShouldFilterByTimeRange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "infix-data")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	dataDir := filepath.Join(dir, "data")
+	walDir := filepath.Join(dir, "wal")
+
+	march := time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)
+	april := time.Date(2021, 4, 1, 0, 0, 0, 0, time.UTC)
+
+	for id, ts := range map[string]time.Time{"1": march.Add(-24 * time.Hour), "2": march.Add(time.Hour), "3": april} {
+		shPath := filepath.Join(dataDir, "telegraf", "autogen", id)
+		assert.NoError(t, os.MkdirAll(shPath, 0755))
+		writeTestTSMFile(t, filepath.Join(shPath, "000000001-000000001.tsm"), "cpu#!~#idle", ts.UnixNano())
+	}
+
+	shards, err := LoadShards(dataDir, walDir, "", "", "", TimeRange{})
+	assert.NoError(t, err)
+	assert.Len(t, shards, 3)
+
+	shards, err = LoadShards(dataDir, walDir, "", "", "", TimeRange{Start: march, End: april})
+	assert.NoError(t, err)
+	assert.Len(t, shards, 1)
+	assert.Equal(t, uint64(2), shards[0].ID)
+}
+
+func TestLoadShards_ShouldLoadShardWithCorruptFieldsIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "infix-data")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	dataDir := filepath.Join(dir, "data")
+	walDir := filepath.Join(dir, "wal")
+
+	shPath := filepath.Join(dataDir, "telegraf", "autogen", "1")
+	assert.NoError(t, os.MkdirAll(shPath, 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(shPath, FieldsIndexFileName), []byte("corrupt"), 0644))
+
+	shards, err := LoadShards(dataDir, walDir, "", "", "", TimeRange{})
+	assert.NoError(t, err)
+	if assert.Len(t, shards, 1) {
+		assert.Error(t, shards[0].FieldsIndexErr)
+		assert.NotNil(t, shards[0].FieldsIndex)
+	}
+}
+
+func TestTimeRange_Overlaps(t *testing.T) {
+	tr := TimeRange{Start: time.Unix(0, 10), End: time.Unix(0, 20)}
+
+	assert.True(t, TimeRange{}.Overlaps(0, 5))
+	assert.True(t, tr.Overlaps(5, 10))
+	assert.True(t, tr.Overlaps(19, 30))
+	assert.True(t, tr.Overlaps(0, 30))
+	assert.False(t, tr.Overlaps(0, 9))
+	assert.False(t, tr.Overlaps(20, 30))
+}
@@ -0,0 +1,55 @@
+package storage
+
+import (
+	"github.com/influxdata/influxdb/models"
+	"github.com/influxdata/influxdb/tsdb/engine/tsm1"
+)
+
+// ScanMeasurements walks the distinct measurements of a TSM file by seeking over its sorted index instead of
+// reading every key. fn is called with each measurement name and the walk stops as soon as fn returns false.
+// A measurement may be reported more than once if its keys are not contiguous in the index
+func ScanMeasurements(r *tsm1.TSMReader, fn func(measurement []byte) bool) {
+	keyCount := r.KeyCount()
+
+	for i := 0; i < keyCount; {
+		key, _ := r.KeyAt(i)
+		seriesKey, _ := tsm1.SeriesAndFieldFromCompositeKey(key)
+		measurement, _ := models.ParseKeyBytes(seriesKey)
+
+		if !fn(measurement) {
+			return
+		}
+
+		end := measurementEnd(seriesKey)
+		if end >= len(key) {
+			i++
+			continue
+		}
+
+		// Keys sharing the measurement and the following separator (either the tags or the field separator)
+		// are contiguous in the index, seek right after them
+		next := make([]byte, end+1)
+		copy(next, key[:end+1])
+		next[end]++
+
+		if n := r.Seek(next); n > i {
+			i = n
+		} else {
+			i++
+		}
+	}
+}
+
+// measurementEnd returns the position of the first unescaped comma in a series key or the length of the key if
+// there is no tag
+func measurementEnd(seriesKey []byte) int {
+	for i := 0; i < len(seriesKey); i++ {
+		switch seriesKey[i] {
+		case '\\':
+			i++
+		case ',':
+			return i
+		}
+	}
+	return len(seriesKey)
+}
@@ -0,0 +1,65 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/influxdata/influxdb/tsdb/engine/tsm1"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScanMeasurements_ShouldSeekOverMeasurements(t *testing.T) {
+	dir, err := ioutil.TempDir("", "infix-tsm")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "000000001-000000001.tsm")
+
+	f, err := os.Create(path)
+	assert.NoError(t, err)
+
+	w, err := tsm1.NewTSMWriter(f)
+	assert.NoError(t, err)
+
+	keys := []string{
+		"cpu#!~#value",
+		"cpu,cpu=cpu0,host=a#!~#idle",
+		"cpu,cpu=cpu0,host=a#!~#user",
+		"cpu,cpu=cpu1,host=a#!~#idle",
+		"cpu_usage,host=a#!~#idle",
+		"disk,host=a#!~#free",
+		"disk,host=b#!~#free",
+		`mem\,swap,host=a#!~#used`,
+	}
+
+	for _, key := range keys {
+		assert.NoError(t, w.Write([]byte(key), []tsm1.Value{tsm1.NewFloatValue(0, 1.0)}))
+	}
+	assert.NoError(t, w.WriteIndex())
+	assert.NoError(t, w.Close())
+
+	f, err = os.Open(path)
+	assert.NoError(t, err)
+
+	r, err := tsm1.NewTSMReader(f)
+	assert.NoError(t, err)
+	defer r.Close()
+
+	var measurements []string
+	ScanMeasurements(r, func(measurement []byte) bool {
+		measurements = append(measurements, string(measurement))
+		return true
+	})
+
+	assert.Equal(t, []string{"cpu", "cpu", "cpu_usage", "disk", "mem,swap"}, measurements)
+
+	measurements = nil
+	ScanMeasurements(r, func(measurement []byte) bool {
+		measurements = append(measurements, string(measurement))
+		return string(measurement) != "cpu_usage"
+	})
+
+	assert.Equal(t, []string{"cpu", "cpu", "cpu_usage"}, measurements)
+}
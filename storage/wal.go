@@ -0,0 +1,176 @@
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/golang/snappy"
+	"github.com/influxdata/influxdb/tsdb/engine/tsm1"
+)
+
+const _walEntryHeaderSize = 5
+
+// _walMaxSnappyRatio bounds the decoded length of an entry relative to its compressed length. A snappy copy element
+// of 3 bytes expands to at most 64 bytes, so valid entries stay well below it, while corrupt headers may announce up
+// to 4 GiB
+const _walMaxSnappyRatio = 32
+
+// WALByteRange represents a range of bytes [Start, End) in a WAL segment
+type WALByteRange struct {
+	Start int64
+	End   int64
+}
+
+// Size returns the number of bytes in the range
+func (r WALByteRange) Size() int64 {
+	return r.End - r.Start
+}
+
+// String implements Stringer interface
+func (r WALByteRange) String() string {
+	return fmt.Sprintf("[%d, %d) (%d bytes)", r.Start, r.End, r.Size())
+}
+
+// WALRepairReader reads entries from a WAL segment and resyncs on the next valid entry boundary
+// when encountering a corrupt entry instead of stopping
+type WALRepairReader struct {
+	data  []byte
+	pos   int64
+	n     int64
+	entry tsm1.WALEntry
+
+	lost []WALByteRange
+}
+
+// NewWALRepairReader creates a new WALRepairReader. The whole segment is read in memory
+func NewWALRepairReader(r io.Reader) (*WALRepairReader, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return &WALRepairReader{
+		data: data,
+	}, nil
+}
+
+// Next indicates if there is an entry to read
+func (r *WALRepairReader) Next() bool {
+	size := int64(len(r.data))
+
+	for r.pos < size {
+		entry, n, err := decodeWALEntry(r.data[r.pos:])
+		if err == nil {
+			r.entry = entry
+			r.pos += n
+			r.n += n
+			return true
+		}
+
+		start := r.pos
+		r.pos = r.resync(start + 1)
+		r.lost = append(r.lost, WALByteRange{Start: start, End: r.pos})
+	}
+
+	return false
+}
+
+// Read returns the current entry
+func (r *WALRepairReader) Read() (tsm1.WALEntry, error) {
+	return r.entry, nil
+}
+
+// Count returns the total number of bytes successfully read from the segment
+func (r *WALRepairReader) Count() int64 {
+	return r.n
+}
+
+// Lost returns the byte ranges that could not be decoded and have been skipped
+func (r *WALRepairReader) Lost() []WALByteRange {
+	return r.lost
+}
+
+// Close implements io.Closer interface
+func (r *WALRepairReader) Close() error {
+	return nil
+}
+
+// resync returns the offset of the next valid entry starting from offset, or the size of the segment
+// if no valid entry could be found. A candidate entry is only considered valid when it is either the last
+// entry of the segment or is followed by a plausible entry header, to avoid resyncing in the middle of
+// entry data that happens to decode.
+func (r *WALRepairReader) resync(offset int64) int64 {
+	size := int64(len(r.data))
+
+	for ; offset < size; offset++ {
+		_, n, err := decodeWALEntry(r.data[offset:])
+		if err != nil {
+			continue
+		}
+
+		next := offset + n
+		if next == size || isWALEntryHeader(r.data[next:]) {
+			return offset
+		}
+	}
+
+	return size
+}
+
+func isWALEntryHeader(b []byte) bool {
+	if len(b) < _walEntryHeaderSize {
+		return false
+	}
+
+	switch tsm1.WalEntryType(b[0]) {
+	case tsm1.WriteWALEntryType, tsm1.DeleteWALEntryType, tsm1.DeleteRangeWALEntryType:
+	default:
+		return false
+	}
+
+	length := binary.BigEndian.Uint32(b[1:_walEntryHeaderSize])
+	return uint64(length) <= uint64(len(b)-_walEntryHeaderSize)
+}
+
+func decodeWALEntry(b []byte) (tsm1.WALEntry, int64, error) {
+	if !isWALEntryHeader(b) {
+		return nil, 0, tsm1.ErrWALCorrupt
+	}
+
+	length := int64(binary.BigEndian.Uint32(b[1:_walEntryHeaderSize]))
+	compressed := b[_walEntryHeaderSize : _walEntryHeaderSize+length]
+
+	// Reject implausible lengths before allocating the decoded entry
+	decodedLen, err := snappy.DecodedLen(compressed)
+	if err != nil {
+		return nil, 0, err
+	}
+	if int64(decodedLen) > _walMaxSnappyRatio*length {
+		return nil, 0, tsm1.ErrWALCorrupt
+	}
+
+	data, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var entry tsm1.WALEntry
+	switch tsm1.WalEntryType(b[0]) {
+	case tsm1.WriteWALEntryType:
+		entry = &tsm1.WriteWALEntry{
+			Values: make(map[string][]tsm1.Value),
+		}
+	case tsm1.DeleteWALEntryType:
+		entry = &tsm1.DeleteWALEntry{}
+	case tsm1.DeleteRangeWALEntryType:
+		entry = &tsm1.DeleteRangeWALEntry{}
+	}
+
+	if err := entry.UnmarshalBinary(data); err != nil {
+		return nil, 0, err
+	}
+
+	return entry, _walEntryHeaderSize + length, nil
+}
@@ -0,0 +1,131 @@
+package storage
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/influxdata/influxdb/tsdb/engine/tsm1"
+	"github.com/stretchr/testify/assert"
+)
+
+func encodeTestWALEntry(t *testing.T, entry tsm1.WALEntry) []byte {
+	b, err := entry.Encode(nil)
+	assert.NoError(t, err)
+
+	var buf bytes.Buffer
+	w := tsm1.NewWALSegmentWriter(nopWriteCloser{&buf})
+	assert.NoError(t, w.Write(entry.Type(), snappy.Encode(nil, b)))
+	assert.NoError(t, w.Flush())
+
+	return buf.Bytes()
+}
+
+type nopWriteCloser struct {
+	*bytes.Buffer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+func newTestWriteWALEntry(key string, ts int64) *tsm1.WriteWALEntry {
+	return &tsm1.WriteWALEntry{
+		Values: map[string][]tsm1.Value{
+			key: {tsm1.NewFloatValue(ts, 1.5)},
+		},
+	}
+}
+
+func readAllWALEntries(t *testing.T, r *WALRepairReader) []tsm1.WALEntry {
+	var entries []tsm1.WALEntry
+	for r.Next() {
+		entry, err := r.Read()
+		assert.NoError(t, err)
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestWALRepairReader_ShouldReadValidSegment(t *testing.T) {
+	var segment []byte
+	segment = append(segment, encodeTestWALEntry(t, newTestWriteWALEntry("cpu,host=a#!~#idle", 1))...)
+	segment = append(segment, encodeTestWALEntry(t, &tsm1.DeleteWALEntry{Keys: [][]byte{[]byte("cpu,host=a#!~#idle")}})...)
+
+	r, err := NewWALRepairReader(bytes.NewReader(segment))
+	assert.NoError(t, err)
+
+	entries := readAllWALEntries(t, r)
+	assert.Len(t, entries, 2)
+	assert.Empty(t, r.Lost())
+	assert.Equal(t, int64(len(segment)), r.Count())
+}
+
+func TestWALRepairReader_ShouldResyncAfterCorruptEntry(t *testing.T) {
+	first := encodeTestWALEntry(t, newTestWriteWALEntry("cpu,host=a#!~#idle", 1))
+	corrupt := encodeTestWALEntry(t, newTestWriteWALEntry("cpu,host=b#!~#idle", 2))
+	last := encodeTestWALEntry(t, newTestWriteWALEntry("cpu,host=c#!~#idle", 3))
+
+	// Garble the payload of the second entry
+	for i := _walEntryHeaderSize; i < len(corrupt); i++ {
+		corrupt[i] = 0xff
+	}
+
+	var segment []byte
+	segment = append(segment, first...)
+	segment = append(segment, corrupt...)
+	segment = append(segment, last...)
+
+	r, err := NewWALRepairReader(bytes.NewReader(segment))
+	assert.NoError(t, err)
+
+	entries := readAllWALEntries(t, r)
+	assert.Len(t, entries, 2)
+
+	keys := make(map[string]bool)
+	for _, e := range entries {
+		for k := range e.(*tsm1.WriteWALEntry).Values {
+			keys[k] = true
+		}
+	}
+	assert.Equal(t, map[string]bool{"cpu,host=a#!~#idle": true, "cpu,host=c#!~#idle": true}, keys)
+
+	start := int64(len(first))
+	assert.Equal(t, []WALByteRange{{Start: start, End: start + int64(len(corrupt))}}, r.Lost())
+}
+
+func TestWALRepairReader_ShouldReportTruncatedTail(t *testing.T) {
+	first := encodeTestWALEntry(t, newTestWriteWALEntry("cpu,host=a#!~#idle", 1))
+	truncated := encodeTestWALEntry(t, newTestWriteWALEntry("cpu,host=b#!~#idle", 2))
+	truncated = truncated[:len(truncated)-3]
+
+	segment := append(append([]byte{}, first...), truncated...)
+
+	r, err := NewWALRepairReader(bytes.NewReader(segment))
+	assert.NoError(t, err)
+
+	entries := readAllWALEntries(t, r)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, []WALByteRange{{Start: int64(len(first)), End: int64(len(segment))}}, r.Lost())
+}
+
+func TestWALRepairReader_ShouldRejectImplausibleDecodedLength(t *testing.T) {
+	// A snappy block announcing 4 GiB - 1 of decoded data in a few bytes
+	compressed := []byte{0xff, 0xff, 0xff, 0xff, 0x0f, 0x00}
+	b := append([]byte{byte(tsm1.WriteWALEntryType), 0, 0, 0, byte(len(compressed))}, compressed...)
+
+	_, _, err := decodeWALEntry(b)
+	assert.Equal(t, tsm1.ErrWALCorrupt, err)
+
+	// Highly compressible entries are still decoded
+	values := make([]tsm1.Value, 10000)
+	for i := range values {
+		values[i] = tsm1.NewFloatValue(0, 0)
+	}
+	segment := encodeTestWALEntry(t, &tsm1.WriteWALEntry{Values: map[string][]tsm1.Value{"cpu,host=a#!~#idle": values}})
+
+	entry, n, err := decodeWALEntry(segment)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(segment)), n)
+	assert.Len(t, entry.(*tsm1.WriteWALEntry).Values["cpu,host=a#!~#idle"], 10000)
+}